@@ -0,0 +1,109 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"time"
+
+	"github.com/negrel/aegis/internal/acme"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xnet"
+	"github.com/negrel/conc"
+)
+
+// acmeClusterName is the name of the cluster forwarding ACME HTTP-01
+// challenges to aegis.
+const acmeClusterName = "aegis-acme-challenge"
+
+// StartAcme creates an ACME manager and serves HTTP-01 challenges on a random
+// local port. Gateway is configured to route challenges requests of all
+// virtual hosts to it. Certificates are obtained once RunAcme is called.
+func StartAcme(n conc.Nursery, logger *slog.Logger, cfg config.Acme, g *Gateway) (*acme.Manager, error) {
+	manager, err := acme.NewManager(logger, acme.Options{
+		DirectoryUrl: cfg.DirectoryUrl,
+		CaCert:       cfg.CaCert,
+		Email:        cfg.Email,
+		StorageDir:   cfg.StorageDir,
+		RenewBefore:  cfg.RenewBefore,
+		Domains:      cfg.Domains,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	lis, port, err := xnet.RandomListener("tcp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup ACME challenges listener: %w", err)
+	}
+	srv := &http.Server{
+		Handler:           manager,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	n.Go(func() error {
+		err := srv.Serve(lis)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			return fmt.Errorf("ACME challenges server failed: %w", err)
+		}
+		return nil
+	})
+	n.Go(func() error {
+		<-n.Done()
+		return srv.Close()
+	})
+
+	g.UseAcme(manager, &cds.Cluster{
+		Name:           acmeClusterName,
+		ConnectTimeout: config.DefaultConnectTimeout,
+	}, &eds.ClusterLoadAssignment{
+		ClusterName: acmeClusterName,
+		Endpoints: []eds.Endpoint{{
+			Address: xnet.IPSocketAddr{
+				Host: netip.MustParseAddr("127.0.0.1"),
+				Port: port,
+			},
+			Health: eds.Healthy,
+		}},
+	})
+
+	return manager, nil
+}
+
+// RunAcme obtains and renews certificates in background. Gateway is updated
+// whenever a certificate is issued.
+func RunAcme(n conc.Nursery, logger *slog.Logger, manager *acme.Manager, g *Gateway) {
+	n.Go(func() error {
+		return manager.Run(n, func(cert acme.Certificate) {
+			err := g.Refresh(n)
+			if err != nil {
+				logger.Error("failed to update envoy certificates",
+					slog.String("domain", cert.Domain),
+					slog.Any("error", err),
+				)
+			}
+		})
+	})
+}
+
+// InjectAcmeChallengeRoute adds a route forwarding ACME HTTP-01 challenges to
+// cluster to every virtual host of route configurations. Route is matched
+// before any other route and HTTPS redirection.
+func InjectAcmeChallengeRoute(routeConfigs []*rds.RouteConfig, cluster *cds.Cluster) {
+	challengeRoute := rds.Route{
+		Name:    "acme-challenge",
+		Prefix:  acme.ChallengePathPrefix,
+		Cluster: cluster,
+	}
+
+	for _, rc := range routeConfigs {
+		for i := range rc.VirtualHosts {
+			vh := &rc.VirtualHosts[i]
+			vh.PriorityRoutes = append([]rds.Route{challengeRoute}, vh.PriorityRoutes...)
+		}
+	}
+}
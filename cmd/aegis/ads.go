@@ -1,27 +1,137 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"log/slog"
+	"net"
+	"net/netip"
+	"os"
 
+	"github.com/negrel/aegis/internal/config"
 	"github.com/negrel/aegis/internal/xds/ads"
 	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
 	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/sds"
 	"github.com/negrel/aegis/internal/xnet"
 	"github.com/negrel/conc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 )
 
-// Start ADS gRPC server.
-func StartAds(n conc.Nursery) (*ads.Service, uint16, error) {
-	// Create xDS services.
-	ads := ads.ProvideService(
-		lds.ProvideService(),
-		cds.ProvideService(),
-	)
+// Start ADS gRPC server serving Envoy node with the given id.
+func StartAds(n conc.Nursery, logger *slog.Logger, nodeId string) (*ads.Service, uint16, error) {
 	lis, adsPort, err := xnet.RandomListener("tcp")
 	if err != nil {
 		return nil, 0, fmt.Errorf("failed to setup TCP listener: %w", err)
 	}
 
+	ads := newAds(logger, ads.IdHash{}, nodeId)
+	serveAds(n, ads, lis)
+
+	return ads, adsPort, nil
+}
+
+// StartControlPlane starts ADS gRPC server serving remote Envoy nodes on
+// control plane address. Nodes are identified by their cluster or id as
+// configured in Envoy configuration. Address must be a loopback address unless
+// nodes are authenticated using mTLS.
+func StartControlPlane(n conc.Nursery, logger *slog.Logger, cfg config.ControlPlane, envoy config.Envoy) (*ads.Service, error) {
+	addr, err := netip.ParseAddrPort(cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control plane address: %w", err)
+	}
+	if !addr.Addr().IsLoopback() && (cfg.Tls == nil || cfg.Tls.ClientCaFile == "") {
+		return nil, fmt.Errorf("control plane address %v isn't a loopback address, mTLS is required (--tls-client-ca)", cfg.Address)
+	}
+
+	var opts []grpc.ServerOption
+	if cfg.Tls != nil {
+		tlsCfg, err := controlPlaneTlsConfig(*cfg.Tls)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(tlsCfg)))
+	}
+
+	var hash ads.NodeHash
+	var key string
+	switch cfg.NodeHash {
+	case "cluster":
+		hash, key = ads.ClusterHash{}, envoy.NodeCluster
+	case "id":
+		hash, key = ads.IdHash{}, envoy.NodeId
+	default:
+		return nil, fmt.Errorf("unknown node hash %q, expected \"id\" or \"cluster\"", cfg.NodeHash)
+	}
+
+	lis, err := net.Listen("tcp", cfg.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to setup TCP listener: %w", err)
+	}
+
+	ads := newAds(logger, hash, key, opts...)
+	serveAds(n, ads, lis)
+	logger.Info("control plane started",
+		slog.String("address", lis.Addr().String()),
+		slog.String("node_hash", cfg.NodeHash),
+		slog.String("node_key", key),
+		slog.Bool("tls", cfg.Tls != nil),
+		slog.Bool("mtls", cfg.Tls != nil && cfg.Tls.ClientCaFile != ""),
+	)
+
+	return ads, nil
+}
+
+// controlPlaneTlsConfig returns TLS configuration of control plane gRPC
+// server. Client certificates are required and verified if a client CA file
+// is set.
+func controlPlaneTlsConfig(cfg config.ControlPlaneTls) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load control plane certificate: %w", err)
+	}
+	tlsCfg := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if cfg.ClientCaFile != "" {
+		pem, err := os.ReadFile(cfg.ClientCaFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read control plane client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in control plane client CA file %q", cfg.ClientCaFile)
+		}
+		tlsCfg.ClientCAs = pool
+		tlsCfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsCfg, nil
+}
+
+// newAds returns an ADS service serving Envoy nodes whose hash is key.
+func newAds(logger *slog.Logger, hash ads.NodeHash, key string, opts ...grpc.ServerOption) *ads.Service {
+	return ads.ProvideService(
+		logger,
+		hash,
+		key,
+		lds.ProvideService(),
+		rds.ProvideService(),
+		cds.ProvideService(),
+		eds.ProvideService(),
+		sds.ProvideService(),
+		opts...,
+	)
+}
+
+// serveAds serves ads on lis until nursery is done.
+func serveAds(n conc.Nursery, ads *ads.Service, lis net.Listener) {
 	n.Go(func() error {
 		err := ads.Serve(lis)
 		if err != nil {
@@ -34,6 +144,4 @@ func StartAds(n conc.Nursery) (*ads.Service, uint16, error) {
 		ads.GracefulStop()
 		return nil
 	})
-
-	return ads, adsPort, nil
 }
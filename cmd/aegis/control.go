@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/negrel/conc"
+)
+
+// DefaultControlSocket returns default path of control socket of aegis
+// instance with Envoy node id nodeId. Instances running on the same host must
+// use different node ids or control sockets.
+func DefaultControlSocket(nodeId string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "aegis-"+strings.ReplaceAll(nodeId, "/", "_")+".sock")
+}
+
+// ServeControl listens on unix socket at path and executes control commands
+// sent by aegis subcommands (e.g. reload-service). A rolling restart of all
+// services is performed on SIGUSR1.
+//
+// Protocol is line based: client sends a single command line and server
+// replies with "ok" or "error: <message>" once command is done.
+func ServeControl(n conc.Nursery, logger *slog.Logger, g *Gateway, path string) error {
+	// Remove stale socket.
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("control socket %v already in use, is another aegis instance with the same node id running?", path)
+	}
+	_ = os.Remove(path)
+
+	lis, err := net.Listen("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to listen on control socket: %w", err)
+	}
+
+	sigusr1 := make(chan os.Signal, 1)
+	signal.Notify(sigusr1, syscall.SIGUSR1)
+
+	n.Go(func() error {
+		<-n.Done()
+		signal.Stop(sigusr1)
+		return lis.Close()
+	})
+
+	n.Go(func() error {
+		for {
+			select {
+			case <-n.Done():
+				return nil
+			case <-sigusr1:
+				logger.Info("SIGUSR1 received, restarting services...")
+				err := g.RollingRestartAll(n)
+				if err != nil {
+					logger.Error("failed to restart services", slog.Any("error", err))
+				}
+			}
+		}
+	})
+
+	n.Go(func() error {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return nil
+				}
+				return fmt.Errorf("failed to accept control connection: %w", err)
+			}
+
+			n.Go(func() error {
+				defer conn.Close()
+				handleControlConn(n, logger, g, conn)
+				return nil
+			})
+		}
+	})
+
+	return nil
+}
+
+func handleControlConn(ctx context.Context, logger *slog.Logger, g *Gateway, conn net.Conn) {
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		logger.Error("failed to read control command", slog.Any("error", err))
+		return
+	}
+
+	command := strings.Fields(line)
+	logger.Info("control command received", slog.Any("command", command))
+
+	switch {
+	case len(command) == 2 && command[0] == "reload-service":
+		err = g.RollingRestart(ctx, command[1])
+	default:
+		err = fmt.Errorf("unknown command %q", strings.TrimSpace(line))
+	}
+
+	if err != nil {
+		logger.Error("control command failed", slog.Any("command", command), slog.Any("error", err))
+		_, _ = fmt.Fprintf(conn, "error: %v\n", err)
+	} else {
+		_, _ = fmt.Fprintln(conn, "ok")
+	}
+}
+
+// SendControlCommand sends a command to aegis instance listening on control
+// socket at path and waits until it is done.
+func SendControlCommand(path string, command ...string) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to connect to control socket: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintln(conn, strings.Join(command, " "))
+	if err != nil {
+		return fmt.Errorf("failed to send control command: %w", err)
+	}
+
+	resp, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("failed to read control command response: %w", err)
+	}
+	resp = strings.TrimSpace(resp)
+	if resp != "ok" {
+		return errors.New(strings.TrimPrefix(resp, "error: "))
+	}
+
+	return nil
+}
@@ -1,73 +1,149 @@
 package main
 
 import (
+	"bytes"
 	"context"
-	_ "embed"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
 	"os"
-	"text/template"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/xds/ads"
+	"github.com/negrel/aegis/internal/xds/bootstrap"
+	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xnet"
 	"github.com/negrel/conc"
 )
 
-//go:embed envoy.tmpl.yml
-var envoyConfigTemplate string
+const (
+	// binaryDebounce is the delay to wait for after Envoy binary changed
+	// before hot restarting it. Package managers may write binary in multiple
+	// steps.
+	binaryDebounce = time.Second
+	// hotRestartTimeout is the maximum delay for a hot restarted Envoy process
+	// to be live.
+	hotRestartTimeout = 30 * time.Second
+)
 
-// Envoy wraps underlying Envoy process.
+// Envoy wraps underlying Envoy processes. Envoy is hot restarted when its
+// binary or bootstrap configuration changes: a new process is started with
+// the next restart epoch and the same base id, it takes over listeners sockets
+// of its parent which drains connections and exits.
 type Envoy struct {
-	logger *slog.Logger
-	proc   *Process
+	logger     *slog.Logger
+	output     *slog.Logger
+	ads        *ads.Service
+	xdsPort    uint16
+	rlsPort    uint16
+	dir        string
+	supervisor *Supervisor
+
+	// restartMu serializes hot restarts.
+	restartMu sync.Mutex
+
+	mu        sync.Mutex
+	cfg       config.Envoy
+	adminAddr netip.AddrPort
+	bootstrap []byte
+	restarted bool
+	// baseId is the base id of the last epoch 0 process, once read from its
+	// base id file.
+	baseId string
+	// live contains restart epoch of started processes that didn't exit yet,
+	// including draining parents.
+	live map[*Process]int
 }
 
-// StartEnvoy starts an Envoy process with the provided configuration and returns
-// it. If process failed to start, an error is returned. Logs are forwarded to
-// the given logger.
-func StartEnvoy(n conc.Nursery, logger *slog.Logger, xdsPort uint16, adminPort uint16) error {
-	// Create config file.
-	cfgFile, err := os.CreateTemp(os.TempDir(), "aegis-envoy-config-*.yml")
+// StartEnvoy starts an Envoy process with the provided configuration and
+// restarts it according to its restart policy, restarted processes are served
+// current ads snapshot. If process failed to start, an error is returned.
+// If Envoy exits and isn't restarted, an error is returned to the nursery.
+// Envoy is hot restarted when its binary changes. Envoy output is forwarded
+// to output logger. If admin address port is 0, a random port is used. Envoy
+// connects to ADS and rate limit servers on xdsPort and rlsPort.
+func StartEnvoy(n conc.Nursery, logger *slog.Logger, output *slog.Logger, cfg config.Envoy, xdsPort uint16, rlsPort uint16, ads *ads.Service) (*Envoy, error) {
+	adminAddr, err := envoyAdminAddr(cfg.AdminAddress)
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file for envoy config: %w", err)
+		return nil, err
 	}
-	defer cfgFile.Close()
 
-	// Generate config using template.
-	tmpl, err := template.New("envoy-config").Parse(envoyConfigTemplate)
+	// Create config file.
+	e := &Envoy{
+		logger:    logger,
+		output:    output,
+		ads:       ads,
+		xdsPort:   xdsPort,
+		rlsPort:   rlsPort,
+		cfg:       cfg,
+		adminAddr: adminAddr,
+		live:      make(map[*Process]int),
+	}
+	e.bootstrap, err = e.marshalBootstrap(cfg, adminAddr)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = tmpl.Execute(cfgFile, map[string]any{
-		"XdsPort":   xdsPort,
-		"AdminPort": adminPort,
-	})
+	e.dir, err = os.MkdirTemp(os.TempDir(), "aegis-envoy-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file for envoy config: %w", err)
+		return nil, fmt.Errorf("failed to create temporary directory for envoy config: %w", err)
+	}
+	err = os.WriteFile(e.bootstrapPath(), e.bootstrap, 0o600)
+	if err != nil {
+		os.RemoveAll(e.dir)
+		return nil, fmt.Errorf("failed to write envoy config: %w", err)
 	}
 
-	// Start Envoy process.
-	proc, err := StartProcess("envoy", []string{"-c", cfgFile.Name()}, nil)
+	// Start and supervise Envoy process. Restarted processes receive current
+	// configuration once connected to ADS server.
+	e.supervisor, err = Supervise(logger.With(slog.String("process", "envoy")), cfg.Restart.WithDefaults(), e.start)
 	if err != nil {
-		return err
+		os.RemoveAll(e.dir)
+		return nil, err
 	}
+	logger.Info("envoy started",
+		slog.Int("pid", e.supervisor.Process().Pid()),
+		slog.String("admin_address", adminAddr.String()),
+		slog.String("node_id", cfg.NodeId),
+	)
 
-	// Remove config file when process is done.
+	err = e.watchBinary(n)
+	if err != nil {
+		logger.Warn("failed to watch envoy binary, it won't be hot restarted on upgrades", slog.Any("error", err))
+	}
+
+	// Stop envoy processes when nursery is canceled. An error is returned if
+	// envoy exited and isn't restarted.
 	n.Go(func() error {
-		defer os.Remove(cfgFile.Name())
-		state, err := proc.Wait()
-		if err != nil || state.ExitCode() > 0 {
-			panic("envoy exited with a non zero exit code")
+		defer os.RemoveAll(e.dir)
+
+		select {
+		case <-e.supervisor.Done():
+			return fmt.Errorf("envoy stopped: %w", e.supervisor.Err())
+		case <-n.Done():
 		}
-		return nil
-	})
 
-	// Stop envoy process when nursery is canceled.
-	n.Go(func() error {
-		<-n.Done()
 		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 		defer cancel()
 		logger.Debug("gracefully stopping envoy...")
-		err := proc.GracefulStop(ctx)
+		err := e.supervisor.GracefulStop(ctx)
+		// Stop draining parents too.
+		e.mu.Lock()
+		for proc := range e.live {
+			err = errors.Join(err, proc.GracefulStop(ctx))
+		}
+		e.mu.Unlock()
 		if err != nil {
 			logger.Error("failed to stop envoy process", slog.Any("error", err))
 		} else {
@@ -76,5 +152,396 @@ func StartEnvoy(n conc.Nursery, logger *slog.Logger, xdsPort uint16, adminPort u
 		return nil
 	})
 
+	return e, nil
+}
+
+// start starts an Envoy process. It is used by supervisor to start and
+// restart Envoy. Supervised process exited so the new one can't be its hot
+// restart child, it is started with epoch 0 and a new base id.
+func (e *Envoy) start() (*Process, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.restarted {
+		err := restoreFile(e.logger, e.bootstrapPath(), e.bootstrap)
+		if err != nil {
+			return nil, fmt.Errorf("failed to recreate envoy config: %w", err)
+		}
+	}
+
+	proc, err := e.startProcess(0)
+	if err != nil {
+		return nil, err
+	}
+	if e.restarted {
+		go replaySnapshot(e.logger, e.ads, proc)
+	}
+	e.restarted = true
+
+	return proc, nil
+}
+
+// startProcess starts an Envoy process with the given restart epoch. Epoch 0
+// processes allocate a new base id, other epochs use the base id of the last
+// epoch 0 process. Base id is kept once read so it survives removal of its
+// file. Caller must hold e.mu.
+func (e *Envoy) startProcess(epoch int) (*Process, error) {
+	baseIdPath := filepath.Join(e.dir, "base-id")
+	args := []string{"-c", e.bootstrapPath(), "--restart-epoch", strconv.Itoa(epoch)}
+	if epoch == 0 {
+		e.baseId = ""
+		args = append(args, "--use-dynamic-base-id", "--base-id-path", baseIdPath)
+	} else {
+		if e.baseId == "" {
+			baseId, err := os.ReadFile(baseIdPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read envoy base id: %w", err)
+			}
+			e.baseId = strings.TrimSpace(string(baseId))
+		}
+		args = append(args, "--base-id", e.baseId)
+	}
+	args = append(args, e.cfg.Args...)
+
+	proc, err := StartProcess(e.cfg.Binary, args, nil)
+	if err != nil {
+		return nil, err
+	}
+	ForwardOutput(e.output, proc)
+
+	e.live[proc] = epoch
+	go func() {
+		<-proc.Done()
+		e.mu.Lock()
+		delete(e.live, proc)
+		e.mu.Unlock()
+	}()
+
+	return proc, nil
+}
+
+// Update hot restarts Envoy if cfg modifies its binary, arguments or bootstrap
+// configuration. Changes of node identity and restart policy are ignored as
+// they require an aegis restart.
+func (e *Envoy) Update(ctx context.Context, cfg config.Envoy) error {
+	e.mu.Lock()
+	current := e.cfg
+	e.mu.Unlock()
+
+	if cfg.NodeId != current.NodeId || cfg.NodeCluster != current.NodeCluster || !cfg.Restart.Equal(current.Restart) {
+		e.logger.Warn("envoy node identity or restart policy changed, restart aegis to apply it")
+		cfg.NodeId, cfg.NodeCluster, cfg.Restart = current.NodeId, current.NodeCluster, current.Restart
+	}
+
+	return e.HotRestart(ctx, cfg, false)
+}
+
+// HotRestart starts a new Envoy process with cfg as a hot restart child of
+// current process. Once it is live, it replaces current process which drains
+// its connections and exits. If force is false, Envoy is hot restarted only
+// if binary, arguments or bootstrap configuration changed. If child process
+// fails, current process keeps running.
+func (e *Envoy) HotRestart(ctx context.Context, cfg config.Envoy, force bool) error {
+	e.restartMu.Lock()
+	defer e.restartMu.Unlock()
+
+	e.mu.Lock()
+	adminAddr := e.adminAddr
+	if cfg.AdminAddress != e.cfg.AdminAddress {
+		var err error
+		adminAddr, err = envoyAdminAddr(cfg.AdminAddress)
+		if err != nil {
+			e.mu.Unlock()
+			return err
+		}
+	}
+	data, err := e.marshalBootstrap(cfg, adminAddr)
+	if err != nil {
+		e.mu.Unlock()
+		return err
+	}
+	if !force && cfg.Binary == e.cfg.Binary && slices.Equal(cfg.Args, e.cfg.Args) && bytes.Equal(data, e.bootstrap) {
+		e.mu.Unlock()
+		return nil
+	}
+
+	prevCfg, prevAdminAddr, prevData := e.cfg, e.adminAddr, e.bootstrap
+	rollback := func() {
+		e.cfg, e.adminAddr, e.bootstrap = prevCfg, prevAdminAddr, prevData
+		_ = os.WriteFile(e.bootstrapPath(), prevData, 0o600)
+	}
+	e.cfg, e.adminAddr, e.bootstrap = cfg, adminAddr, data
+	err = os.MkdirAll(e.dir, 0o700)
+	if err == nil {
+		err = os.WriteFile(e.bootstrapPath(), data, 0o600)
+	}
+	if err != nil {
+		rollback()
+		e.mu.Unlock()
+		return fmt.Errorf("failed to write envoy config: %w", err)
+	}
+
+	// Child epoch follows the one of its parent. A new base id is allocated
+	// if no process is live.
+	parent := e.supervisor.Process()
+	epoch := 0
+	if parentEpoch, ok := e.live[parent]; ok {
+		epoch = parentEpoch + 1
+	}
+	child, err := e.startProcess(epoch)
+	if err != nil {
+		rollback()
+		e.mu.Unlock()
+		return fmt.Errorf("failed to start envoy: %w", err)
+	}
+	e.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, hotRestartTimeout)
+	defer cancel()
+	err = waitEnvoyLive(ctx, adminAddr, child, epoch)
+	if err != nil {
+		// Wait for child exit so its epoch can be reused.
+		_ = child.Signal(os.Kill)
+		<-child.Done()
+		e.mu.Lock()
+		rollback()
+		e.mu.Unlock()
+		return fmt.Errorf("hot restarted envoy isn't live: %w", err)
+	}
+
+	if !e.supervisor.Replace(child) {
+		return fmt.Errorf("envoy is stopped")
+	}
+	attrs := []any{
+		slog.Int("pid", child.Pid()),
+		slog.Int("restart_epoch", epoch),
+		slog.String("admin_address", adminAddr.String()),
+	}
+	if parent != nil {
+		attrs = append(attrs, slog.Int("parent_pid", parent.Pid()))
+	}
+	e.logger.Info("envoy hot restarted", attrs...)
+
 	return nil
 }
+
+// Config returns current Envoy configuration.
+func (e *Envoy) Config() config.Envoy {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.cfg
+}
+
+func (e *Envoy) bootstrapPath() string {
+	return filepath.Join(e.dir, "envoy.json")
+}
+
+func (e *Envoy) marshalBootstrap(cfg config.Envoy, adminAddr netip.AddrPort) ([]byte, error) {
+	localhost := netip.MustParseAddr("127.0.0.1")
+	b, err := EnvoyBootstrap(cfg, adminAddr, bootstrap.Xds{
+		Address: xnet.IPSocketAddr{Host: localhost, Port: e.xdsPort},
+	})
+	if err != nil {
+		return nil, err
+	}
+	b.StaticClusters = append(b.StaticClusters, bootstrap.GrpcCluster(
+		lds.RateLimitClusterName,
+		xnet.IPSocketAddr{Host: localhost, Port: e.rlsPort},
+	))
+
+	return b.Marshal()
+}
+
+// watchBinary hot restarts Envoy whenever its binary changes.
+func (e *Envoy) watchBinary(n conc.Nursery) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch parent directory as binary is usually replaced.
+	binaryPath := func() (string, error) {
+		path, err := exec.LookPath(e.Config().Binary)
+		if err != nil {
+			return "", err
+		}
+		path, err = filepath.Abs(path)
+		if err == nil {
+			err = watcher.Add(filepath.Dir(path))
+		}
+		return path, err
+	}
+	path, err := binaryPath()
+	if err != nil {
+		watcher.Close()
+		return err
+	}
+
+	n.Go(func() error {
+		defer watcher.Close()
+
+		debounce := time.NewTimer(binaryDebounce)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-n.Done():
+				return nil
+
+			case ev := <-watcher.Events:
+				if ev.Name == path && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce.Reset(binaryDebounce)
+				}
+
+			case <-debounce.C:
+				e.logger.Info("envoy binary changed, hot restarting envoy...", slog.String("path", path))
+				err := e.HotRestart(n, e.Config(), true)
+				if err != nil {
+					e.logger.Error("failed to hot restart envoy", slog.Any("error", err))
+				}
+
+			case err := <-watcher.Errors:
+				e.logger.Error("envoy binary watcher error", slog.Any("error", err))
+			}
+
+			// Binary may have changed on configuration reload.
+			if p, err := binaryPath(); err == nil {
+				path = p
+			}
+		}
+	})
+
+	return nil
+}
+
+// envoyServerInfo contains fields of Envoy admin /server_info response.
+type envoyServerInfo struct {
+	State              string `json:"state"`
+	CommandLineOptions struct {
+		RestartEpoch int `json:"restart_epoch"`
+	} `json:"command_line_options"`
+}
+
+// waitEnvoyLive waits until Envoy process with the given restart epoch serves
+// its admin interface on adminAddr and is live. During a hot restart, parent
+// admin interface is served until child takes it over.
+func waitEnvoyLive(ctx context.Context, adminAddr netip.AddrPort, proc *Process, epoch int) error {
+	host := adminAddr.Addr()
+	if host.IsUnspecified() {
+		host = netip.MustParseAddr("127.0.0.1")
+	}
+	url := fmt.Sprintf("http://%v/server_info", netip.AddrPortFrom(host, adminAddr.Port()))
+	client := http.Client{Timeout: time.Second}
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-proc.Done():
+			state, err := proc.Wait()
+			if state != nil {
+				err = errors.New(state.String())
+			}
+			return fmt.Errorf("envoy exited: %w", err)
+		case <-ticker.C:
+		}
+
+		resp, err := client.Get(url)
+		if err != nil {
+			continue
+		}
+		var info envoyServerInfo
+		err = json.NewDecoder(resp.Body).Decode(&info)
+		resp.Body.Close()
+		if err == nil && info.State == "LIVE" && info.CommandLineOptions.RestartEpoch == epoch {
+			return nil
+		}
+	}
+}
+
+// envoyAdminAddr parses Envoy admin address. If port is 0, a random port is
+// allocated.
+func envoyAdminAddr(addr string) (netip.AddrPort, error) {
+	adminAddr, err := netip.ParseAddrPort(addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid envoy admin address: %w", err)
+	}
+	if adminAddr.Port() == 0 {
+		adminAddr, err = randomAddrPort(adminAddr.Addr())
+		if err != nil {
+			return netip.AddrPort{}, fmt.Errorf("failed to allocate envoy admin port: %w", err)
+		}
+	}
+
+	return adminAddr, nil
+}
+
+// restoreFile writes data to file at path if it was removed or modified. Its
+// directory is recreated if it was removed (e.g. by a tmp cleaner).
+func restoreFile(logger *slog.Logger, path string, data []byte) error {
+	current, err := os.ReadFile(path)
+	if err == nil && bytes.Equal(current, data) {
+		return nil
+	}
+
+	logger.Warn("envoy config file removed or modified, recreating it", slog.String("path", path))
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
+
+// replaySnapshot waits until restarted Envoy process acknowledged current ADS
+// snapshot.
+func replaySnapshot(logger *slog.Logger, ads *ads.Service, proc *Process) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	go func() {
+		select {
+		case <-proc.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	err := ads.WaitSync(ctx)
+	switch {
+	case err == nil:
+		logger.Info("configuration replayed to restarted envoy", slog.Int("pid", proc.Pid()))
+	case !errors.Is(ctx.Err(), context.Canceled):
+		logger.Error("restarted envoy didn't accept configuration",
+			slog.Int("pid", proc.Pid()),
+			slog.Any("error", err),
+		)
+	}
+}
+
+// EnvoyBootstrap returns bootstrap configuration of an Envoy node identified,
+// administered and extended as configured connecting to ADS server at xds.
+func EnvoyBootstrap(cfg config.Envoy, adminAddr netip.AddrPort, xds bootstrap.Xds) (*bootstrap.Bootstrap, error) {
+	b := &bootstrap.Bootstrap{
+		NodeId:       cfg.NodeId,
+		NodeCluster:  cfg.NodeCluster,
+		AdminAddress: adminAddr,
+		Xds:          xds,
+	}
+	err := cfg.BuildBootstrap(b)
+	if err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// randomAddrPort returns addr with a random available TCP port.
+func randomAddrPort(addr netip.Addr) (netip.AddrPort, error) {
+	lis, err := net.Listen("tcp", netip.AddrPortFrom(addr, 0).String())
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	defer lis.Close()
+
+	return netip.ParseAddrPort(lis.Addr().String())
+}
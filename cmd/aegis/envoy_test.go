@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/negrel/aegis/internal/config"
+	"golang.org/x/sys/unix"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("AEGIS_FAKE_ENVOY") == "1" {
+		err := fakeEnvoy(os.Args[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// fakeEnvoy serves Envoy admin /server_info endpoint of a live Envoy process
+// started with the given arguments. Admin socket is shared with parent and
+// child processes like Envoy does on hot restart.
+func fakeEnvoy(args []string) error {
+	var bootstrapPath, baseIdPath, epoch string
+	for i := 0; i+1 < len(args); i++ {
+		switch args[i] {
+		case "-c":
+			bootstrapPath = args[i+1]
+		case "--base-id-path":
+			baseIdPath = args[i+1]
+		case "--restart-epoch":
+			epoch = args[i+1]
+		}
+	}
+	if baseIdPath != "" {
+		err := os.WriteFile(baseIdPath, []byte("42\n"), 0o600)
+		if err != nil {
+			return err
+		}
+	}
+
+	data, err := os.ReadFile(bootstrapPath)
+	if err != nil {
+		return err
+	}
+	var bootstrap struct {
+		Admin struct {
+			Address struct {
+				SocketAddress struct {
+					Address   string `json:"address"`
+					PortValue int    `json:"port_value"`
+				} `json:"socket_address"`
+			} `json:"address"`
+		} `json:"admin"`
+	}
+	err = json.Unmarshal(data, &bootstrap)
+	if err != nil {
+		return err
+	}
+
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var err error
+		ctrlErr := c.Control(func(fd uintptr) {
+			err = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+		})
+		if ctrlErr != nil {
+			return ctrlErr
+		}
+		return err
+	}}
+	addr := bootstrap.Admin.Address.SocketAddress
+	lis, err := lc.Listen(context.Background(), "tcp", net.JoinHostPort(addr.Address, fmt.Sprint(addr.PortValue)))
+	if err != nil {
+		return err
+	}
+
+	// Connections aren't reused so requests reach the child once it listens.
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"state":"LIVE","command_line_options":{"restart_epoch":%v}}`, epoch)
+	})}
+	srv.SetKeepAlivesEnabled(false)
+	return srv.Serve(lis)
+}
+
+func TestRestoreFile(t *testing.T) {
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	data := []byte(`{"node":{"id":"aegis"}}`)
+
+	tests := []struct {
+		name   string
+		remove func(dir, path string) error
+	}{
+		{name: "Unchanged", remove: func(dir, path string) error { return nil }},
+		{name: "Modified", remove: func(dir, path string) error { return os.WriteFile(path, []byte("{}"), 0o600) }},
+		{name: "FileRemoved", remove: func(dir, path string) error { return os.Remove(path) }},
+		{name: "DirRemoved", remove: func(dir, path string) error { return os.RemoveAll(dir) }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := filepath.Join(t.TempDir(), "aegis-envoy")
+			path := filepath.Join(dir, "envoy.json")
+			err := os.Mkdir(dir, 0o700)
+			if err == nil {
+				err = os.WriteFile(path, data, 0o600)
+			}
+			if err == nil {
+				err = test.remove(dir, path)
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			err = restoreFile(logger, path, data)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			restored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if string(restored) != string(data) {
+				t.Fatalf("expected file content %q, got %q", data, restored)
+			}
+		})
+	}
+}
+
+func TestEnvoyHotRestartOnBootstrapChange(t *testing.T) {
+	t.Setenv("AEGIS_FAKE_ENVOY", "1")
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	ctx := context.Background()
+
+	adminAddr, err := envoyAdminAddr("127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := config.Envoy{Binary: os.Args[0], AdminAddress: adminAddr.String(), NodeId: "aegis", NodeCluster: "aegis"}
+	e := &Envoy{
+		logger:    logger,
+		output:    logger,
+		dir:       t.TempDir(),
+		cfg:       cfg,
+		adminAddr: adminAddr,
+		live:      make(map[*Process]int),
+	}
+	e.bootstrap, err = e.marshalBootstrap(cfg, adminAddr)
+	if err == nil {
+		err = os.WriteFile(e.bootstrapPath(), e.bootstrap, 0o600)
+	}
+	if err == nil {
+		e.supervisor, err = Supervise(logger, (&config.RestartPolicy{Policy: config.RestartNever}).WithDefaults(), e.start)
+	}
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() {
+		e.mu.Lock()
+		for proc := range e.live {
+			_ = proc.Signal(os.Kill)
+		}
+		e.mu.Unlock()
+		_ = e.supervisor.GracefulStop(ctx)
+	})
+
+	parent := e.supervisor.Process()
+	waitCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+	err = waitEnvoyLive(waitCtx, adminAddr, parent, 0)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Same bootstrap, Envoy isn't hot restarted.
+	err = e.Update(ctx, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if proc := e.supervisor.Process(); proc != parent {
+		t.Fatalf("expected envoy not to be hot restarted")
+	}
+
+	// A new stats sink is added to bootstrap and Envoy is hot restarted.
+	cfg.StatsSinks = []map[string]any{{
+		"name": "envoy.stat_sinks.statsd",
+		"typed_config": map[string]any{
+			"@type":            "type.googleapis.com/envoy.config.metrics.v3.StatsdSink",
+			"tcp_cluster_name": "statsd",
+		},
+	}}
+	err = e.Update(ctx, cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	child := e.supervisor.Process()
+	if child == parent {
+		t.Fatalf("expected envoy to be hot restarted")
+	}
+	e.mu.Lock()
+	epoch := e.live[child]
+	e.mu.Unlock()
+	if epoch != 1 {
+		t.Fatalf("expected restart epoch 1, got %v", epoch)
+	}
+	data, err := os.ReadFile(e.bootstrapPath())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(string(data), "envoy.stat_sinks.statsd") {
+		t.Fatalf("expected bootstrap to contain stats sink, got %s", data)
+	}
+}
@@ -0,0 +1,512 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/negrel/aegis/internal/acme"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/ratelimit"
+	"github.com/negrel/aegis/internal/xds/ads"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/conc"
+)
+
+// Gateway manages services processes and keeps Envoy configuration in sync
+// with aegis configuration.
+type Gateway struct {
+	mu       sync.Mutex
+	logger   *slog.Logger
+	output   *slog.Logger
+	ads      *ads.Service
+	cfg      *config.Config
+	services map[string]*gatewayService
+	// commitOpts are applied when committing configuration updates.
+	commitOpts []ads.CommitOption
+
+	acme               *acme.Manager
+	acmeCluster        *cds.Cluster
+	acmeLoadAssignment *eds.ClusterLoadAssignment
+
+	rateLimit *ratelimit.Service
+}
+
+type gatewayService struct {
+	cfg       config.Service
+	instances []*Service
+	// draining contains replaced instances that still serve in flight
+	// requests.
+	draining []*Service
+	// restarting is true while a rolling restart of service is in progress.
+	restarting bool
+}
+
+// NewGateway returns a new gateway with no services and no configuration.
+// Services output is forwarded to output logger. Commit options are applied
+// on every Envoy configuration update.
+func NewGateway(logger *slog.Logger, output *slog.Logger, ads *ads.Service, opts ...ads.CommitOption) *Gateway {
+	return &Gateway{
+		logger:     logger,
+		output:     output,
+		ads:        ads,
+		cfg:        &config.Config{},
+		services:   make(map[string]*gatewayService),
+		commitOpts: opts,
+	}
+}
+
+// Apply applies the given configuration. New and modified services are
+// started, once they're ready Envoy configuration is updated and then removed
+// and outdated services are stopped after their drain period. Services that
+// didn't change are left untouched. If an error occurs, previous configuration
+// is kept.
+func (g *Gateway) Apply(ctx context.Context, cfg *config.Config) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Start new and modified services.
+	services := make(map[string]*gatewayService, len(cfg.Services))
+	var started []*gatewayService
+	err := conc.Block(func(n conc.Nursery) error {
+		for _, s := range cfg.Services {
+			if gs, ok := g.services[s.Name]; ok && gs.cfg.EqualInstances(&s) {
+				services[s.Name] = gs
+				continue
+			}
+
+			gs := &gatewayService{cfg: s}
+			if prev, ok := g.services[s.Name]; ok {
+				gs.draining = prev.instances
+			}
+			services[s.Name] = gs
+			started = append(started, gs)
+			n.Go(func() error {
+				instances, err := g.startInstances(n, s)
+				if err != nil {
+					return err
+				}
+				gs.instances = instances
+				return nil
+			})
+		}
+		return nil
+	}, conc.WithContext(ctx))
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		for _, gs := range started {
+			StopServices(gs.instances)
+		}
+		return err
+	}
+
+	// Update rate limit rules, clusters and listeners.
+	err = g.setRateLimits(cfg)
+	if err != nil {
+		for _, gs := range started {
+			StopServices(gs.instances)
+		}
+		return err
+	}
+	tx := g.ads.Begin()
+	g.setResources(tx, g.cfg, cfg, services)
+	err = g.commit(ctx, tx)
+	if err != nil {
+		_ = g.setRateLimits(g.cfg)
+		tx := g.ads.Begin()
+		g.setResources(tx, cfg, g.cfg, g.services)
+		g.restore(tx)
+		for _, gs := range started {
+			StopServices(gs.instances)
+		}
+		return err
+	}
+
+	// Stop removed and outdated services.
+	var stale []*Service
+	var drainPeriod time.Duration
+	for name, gs := range g.services {
+		if services[name] != gs {
+			stale = append(stale, gs.instances...)
+			drainPeriod = max(drainPeriod, gs.cfg.DrainPeriodOrDefault())
+		}
+	}
+	g.cfg = cfg
+	g.services = services
+	if len(stale) > 0 {
+		g.drain(ctx, drainPeriod)
+		StopServices(stale)
+
+		// Remove draining endpoints. Configuration may have been updated
+		// while draining.
+		for _, gs := range g.services {
+			gs.draining = slices.DeleteFunc(gs.draining, func(s *Service) bool {
+				return slices.Contains(stale, s)
+			})
+		}
+		tx = g.ads.Begin()
+		g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+		err = g.commit(ctx, tx)
+		if err != nil && ctx.Err() == nil {
+			g.logger.Error("failed to remove draining endpoints", slog.Any("error", err))
+		}
+	}
+
+	return nil
+}
+
+// UseAcme configures gateway to use certificates of ACME manager and route
+// ACME HTTP-01 challenges to cluster. It must be called before configuration
+// is applied.
+func (g *Gateway) UseAcme(manager *acme.Manager, cluster *cds.Cluster, loadAssignment *eds.ClusterLoadAssignment) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.acme = manager
+	g.acmeCluster = cluster
+	g.acmeLoadAssignment = loadAssignment
+}
+
+// UseRateLimit configures gateway to update rules of rate limit service along
+// with Envoy configuration. It must be called before configuration is applied.
+func (g *Gateway) UseRateLimit(rls *ratelimit.Service) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rateLimit = rls
+}
+
+// Refresh updates Envoy configuration without modifying services. Secrets are
+// reloaded so it must be called when certificates changes.
+func (g *Gateway) Refresh(ctx context.Context) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tx := g.ads.Begin()
+	g.setResources(tx, g.cfg, g.cfg, g.services)
+	return g.commit(ctx, tx)
+}
+
+// refreshEndpoints updates Envoy endpoints health without modifying services.
+func (g *Gateway) refreshEndpoints() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	tx := g.ads.Begin()
+	g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+	err := g.commit(context.Background(), tx)
+	if err != nil {
+		g.logger.Error("failed to update endpoints health", slog.Any("error", err))
+	}
+}
+
+// Config returns current configuration.
+func (g *Gateway) Config() *config.Config {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.cfg
+}
+
+// RollingRestart replaces instances of the service with the given name with
+// new ones without dropping requests. Instances are replaced one by one: a new
+// instance is started and added to service cluster once ready. Then, old
+// instance is marked as draining and stopped after the service drain period.
+// Only endpoints of the service cluster are updated. Rolling restart stops
+// early if service is updated or removed while an instance is draining.
+func (g *Gateway) RollingRestart(ctx context.Context, name string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	gs, ok := g.services[name]
+	if !ok {
+		return fmt.Errorf("unknown service %q", name)
+	}
+	if gs.restarting {
+		return fmt.Errorf("rolling restart of service %q already in progress", name)
+	}
+	gs.restarting = true
+	defer func() { gs.restarting = false }()
+	logger := g.logger.With(slog.String("service", name))
+	logger.Info("rolling restart started")
+
+	for i := range gs.instances {
+		prevInstances := gs.instances
+		oldInstance := prevInstances[i]
+		newInstance, err := g.startInstance(ctx, gs.cfg, i)
+		if err != nil {
+			return err
+		}
+
+		// Route traffic to both old and new instances.
+		gs.instances = append(slices.Clone(prevInstances), newInstance)
+		tx := g.ads.Begin()
+		g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+		err = g.commit(ctx, tx)
+		if err != nil {
+			gs.instances = prevInstances
+			tx = g.ads.Begin()
+			g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+			g.restore(tx)
+			newInstance.Stop()
+			return err
+		}
+
+		// Route traffic away from old instance.
+		gs.instances = slices.Clone(prevInstances)
+		gs.instances[i] = newInstance
+		gs.draining = []*Service{oldInstance}
+		tx = g.ads.Begin()
+		g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+		err = g.commit(ctx, tx)
+		if err != nil {
+			// Remove new instance and keep old one.
+			gs.instances = prevInstances
+			gs.draining = nil
+			tx = g.ads.Begin()
+			g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+			g.restore(tx)
+			newInstance.Stop()
+			return err
+		}
+
+		g.drain(ctx, gs.cfg.DrainPeriodOrDefault())
+		oldInstance.Stop()
+
+		gs.draining = slices.DeleteFunc(gs.draining, func(s *Service) bool { return s == oldInstance })
+		tx = g.ads.Begin()
+		g.setLoadAssignments(tx, g.cfg, g.cfg, g.services)
+		err = g.commit(ctx, tx)
+		if err != nil {
+			return err
+		}
+		if g.services[name] != gs {
+			logger.Info("rolling restart stopped, service was updated")
+			return nil
+		}
+	}
+	logger.Info("rolling restart done")
+
+	return nil
+}
+
+// RollingRestartAll performs a rolling restart of every service, one after
+// the other.
+func (g *Gateway) RollingRestartAll(ctx context.Context) error {
+	g.mu.Lock()
+	var names []string
+	for _, s := range g.cfg.Services {
+		names = append(names, s.Name)
+	}
+	g.mu.Unlock()
+
+	for _, name := range names {
+		err := g.RollingRestart(ctx, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// startInstances starts all instances of the given service and waits until
+// they're ready.
+func (g *Gateway) startInstances(ctx context.Context, cfg config.Service) ([]*Service, error) {
+	instances := make([]*Service, cfg.ReplicasOrDefault())
+	err := conc.Block(func(n conc.Nursery) error {
+		for i := range instances {
+			n.Go(func() error {
+				instance, err := g.startInstance(n, cfg, i)
+				instances[i] = instance
+				return err
+			})
+		}
+		return nil
+	}, conc.WithContext(ctx))
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		StopServices(slices.DeleteFunc(instances, func(s *Service) bool { return s == nil }))
+		return nil, err
+	}
+
+	return instances, nil
+}
+
+// startInstance starts i-th instance of the given service and waits until
+// it is ready.
+func (g *Gateway) startInstance(ctx context.Context, cfg config.Service, i int) (*Service, error) {
+	attrs := []any{slog.String("service", cfg.Name), slog.Int("instance", i)}
+	logger := g.logger.With(attrs...)
+	output := g.output.With(attrs...)
+
+	instance, err := StartService(logger, output, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start service %q: %w", cfg.Name, err)
+	}
+
+	err = instance.WaitReady(ctx)
+	if err != nil {
+		instance.Stop()
+		return nil, fmt.Errorf("service %q: %w", cfg.Name, err)
+	}
+	instance.OnHealthChange(g.refreshEndpoints)
+
+	return instance, nil
+}
+
+// setResources stages replacement of secrets, clusters, endpoints, route
+// configurations and listeners of prev configuration with the ones of cfg.
+func (g *Gateway) setResources(tx *ads.Tx, prev, cfg *config.Config, services map[string]*gatewayService) {
+	secrets, err := LoadSecrets(cfg.SecretRefs(), g.acme)
+	if err != nil {
+		g.logger.Error("failed to load secrets, filter chains using them are disabled", slog.Any("error", err))
+	}
+	clusters := cfg.BuildClusters()
+	listeners := cfg.BuildListeners(clusters, secrets)
+	routeConfigs := cfg.BuildRouteConfigs(clusters)
+	if g.acme != nil {
+		InjectAcmeChallengeRoute(routeConfigs, g.acmeCluster)
+		clusters = append(clusters, g.acmeCluster)
+	}
+
+	// Route configurations of disabled listeners must not be sent to Envoy.
+	var usedRouteConfigs []string
+	for _, l := range listeners {
+		usedRouteConfigs = append(usedRouteConfigs, l.References()[rds.ResourceType]...)
+	}
+	routeConfigs = slices.DeleteFunc(routeConfigs, func(rc *rds.RouteConfig) bool {
+		return !slices.Contains(usedRouteConfigs, rc.Name)
+	})
+
+	for _, ref := range prev.SecretRefs() {
+		tx.RemoveSecret(ref.Name)
+	}
+	for _, s := range secrets {
+		tx.SetSecret(s)
+	}
+	for _, c := range prev.AllClusters() {
+		tx.RemoveCluster(c.Name)
+	}
+	for _, c := range clusters {
+		tx.SetCluster(c)
+	}
+	g.setLoadAssignments(tx, prev, cfg, services)
+	for _, rc := range prev.RouteConfigs() {
+		tx.RemoveRouteConfig(rc.Name)
+	}
+	for _, rc := range routeConfigs {
+		tx.SetRouteConfig(rc)
+	}
+	for _, l := range prev.Listeners {
+		tx.RemoveListener(l.Name)
+	}
+	for _, l := range listeners {
+		tx.SetListener(l)
+	}
+}
+
+// setRateLimits replaces rules of rate limit service with the ones of cfg.
+func (g *Gateway) setRateLimits(cfg *config.Config) error {
+	if g.rateLimit == nil {
+		return nil
+	}
+
+	err := g.rateLimit.SetConfigs(cfg.BuildRateLimitConfigs())
+	if err != nil {
+		return fmt.Errorf("failed to update rate limit rules: %w", err)
+	}
+
+	return nil
+}
+
+// setLoadAssignments stages replacement of load assignments of prev
+// configuration clusters with the ones of cfg.
+func (g *Gateway) setLoadAssignments(tx *ads.Tx, prev, cfg *config.Config, services map[string]*gatewayService) {
+	endpoints := make(map[string][]eds.Endpoint, len(services))
+	for name, gs := range services {
+		for _, instance := range gs.instances {
+			health := eds.Healthy
+			if !instance.Healthy() {
+				health = eds.Unhealthy
+			}
+			endpoints[name] = append(endpoints[name], eds.Endpoint{
+				Address: instance.Endpoint(),
+				Health:  health,
+			})
+		}
+		for _, instance := range gs.draining {
+			endpoints[name] = append(endpoints[name], eds.Endpoint{
+				Address: instance.Endpoint(),
+				Health:  eds.Draining,
+			})
+		}
+	}
+
+	for _, c := range prev.AllClusters() {
+		tx.RemoveLoadAssignment(c.Name)
+	}
+	for _, cla := range cfg.BuildLoadAssignments(endpoints) {
+		tx.SetLoadAssignment(cla)
+	}
+	if g.acme != nil {
+		tx.SetLoadAssignment(g.acmeLoadAssignment)
+	}
+}
+
+// commit commits tx and waits until Envoy accepts it.
+func (g *Gateway) commit(ctx context.Context, tx *ads.Tx) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	err := tx.Commit(ctx, append([]ads.CommitOption{ads.WaitAck()}, g.commitOpts...)...)
+	if err != nil {
+		return fmt.Errorf("failed to update envoy configuration: %w", err)
+	}
+
+	return nil
+}
+
+// restore commits tx restoring resources after a failed commit so rejected
+// resources aren't served to Envoy anymore.
+func (g *Gateway) restore(tx *ads.Tx) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := tx.Commit(ctx)
+	if err != nil {
+		g.logger.Error("failed to restore previous envoy configuration", slog.Any("error", err))
+	}
+}
+
+// drain waits for the given drain period or until context is canceled. g.mu
+// is released while waiting so configuration can be updated meanwhile, caller
+// must hold it.
+func (g *Gateway) drain(ctx context.Context, period time.Duration) {
+	g.mu.Unlock()
+	defer g.mu.Lock()
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(period):
+	}
+}
+
+// Stop stops all services.
+func (g *Gateway) Stop() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var services []*Service
+	for _, gs := range g.services {
+		services = append(services, gs.instances...)
+	}
+	StopServices(services)
+	g.services = make(map[string]*gatewayService)
+}
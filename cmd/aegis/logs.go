@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// maxLogLineSize is the maximum size of a process output line.
+const maxLogLineSize = 1024 * 1024
+
+// reservedLogKeys contains keys set by aegis on forwarded log records. Keys of
+// JSON log lines that collide with them are dropped.
+var reservedLogKeys = map[string]struct{}{
+	slog.TimeKey:    {},
+	slog.LevelKey:   {},
+	slog.MessageKey: {},
+	"message":       {},
+	"component":     {},
+	"service":       {},
+	"instance":      {},
+	"stream":        {},
+	"pid":           {},
+}
+
+// ForwardOutput consumes process stdout and stderr and re-emits them line by
+// line through logger with stream and pid attributes. JSON object lines are
+// merged into log record: "msg"/"message", "level" and "time" fields are used
+// as record message, level and time and other fields as attributes. Other
+// lines are logged as is at info level.
+func ForwardOutput(logger *slog.Logger, proc *Process) {
+	logger = logger.With(slog.Int("pid", proc.Pid()))
+	go forwardLines(logger.With(slog.String("stream", "stdout")), proc.Stdout())
+	go forwardLines(logger.With(slog.String("stream", "stderr")), proc.Stderr())
+}
+
+func forwardLines(logger *slog.Logger, r io.ReadCloser) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), maxLogLineSize)
+	for scanner.Scan() {
+		logLine(logger, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		logger.Error("failed to read process output, discarding remaining output", slog.Any("error", err))
+		_, _ = io.Copy(io.Discard, r)
+	}
+}
+
+func logLine(logger *slog.Logger, line string) {
+	ctx := context.Background()
+
+	var fields map[string]any
+	if !strings.HasPrefix(line, "{") || json.Unmarshal([]byte(line), &fields) != nil {
+		logger.Info(line)
+		return
+	}
+
+	level := parseLogLevel(fields[slog.LevelKey])
+	if !logger.Enabled(ctx, level) {
+		return
+	}
+
+	msg, _ := fields[slog.MessageKey].(string)
+	if msg == "" {
+		msg, _ = fields["message"].(string)
+	}
+
+	t := time.Now()
+	if s, ok := fields[slog.TimeKey].(string); ok {
+		if parsed, ok := parseLogTime(s); ok {
+			t = parsed
+		}
+	}
+
+	record := slog.NewRecord(t, level, msg, 0)
+	for k, v := range fields {
+		if _, reserved := reservedLogKeys[k]; !reserved {
+			record.AddAttrs(slog.Any(k, v))
+		}
+	}
+	_ = logger.Handler().Handle(ctx, record)
+}
+
+func parseLogLevel(v any) slog.Level {
+	s, _ := v.(string)
+	switch strings.ToLower(s) {
+	case "trace":
+		return slog.LevelDebug - 4
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error", "err":
+		return slog.LevelError
+	case "critical", "fatal", "panic":
+		return slog.LevelError + 4
+	default:
+		return slog.LevelInfo
+	}
+}
+
+var logTimeLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999", // Envoy.
+}
+
+func parseLogTime(s string) (time.Time, bool) {
+	for _, layout := range logTimeLayouts {
+		t, err := time.Parse(layout, s)
+		if err == nil {
+			return t, true
+		}
+	}
+
+	return time.Time{}, false
+}
@@ -1,28 +1,63 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
 	"context"
 	"fmt"
 	"log/slog"
 	"net/netip"
 	"os"
 	"os/signal"
+	"slices"
 	"syscall"
-	"time"
 
-	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
-	"github.com/negrel/aegis/internal/xds/cds"
-	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/acme"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/ratelimit"
+	"github.com/negrel/aegis/internal/xds/ads"
+	"github.com/negrel/aegis/internal/xds/bootstrap"
 	"github.com/negrel/aegis/internal/xnet"
 	"github.com/negrel/conc"
 	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
 )
 
 func main() {
+	// Subcommands.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "reload-service":
+			reloadServiceMain(os.Args[2:])
+			return
+		case "control-plane":
+			controlPlaneMain(os.Args[2:])
+			return
+		case "bootstrap":
+			bootstrapMain(os.Args[2:])
+			return
+		}
+	}
+
 	help := pflag.BoolP("help", "h", false, "Print this help and exit")
 	debug := pflag.Bool("debug", false, "Enable debug logs")
+	cfgPath := pflag.StringP("config", "c", "", "Configuration file (YAML)")
 	port := pflag.Uint16P("port", "p", 8080, "Listening port")
 	domain := pflag.StringP("domain", "d", "*", "Service domain name")
+	routes := pflag.StringArrayP("route", "r", nil, "Route of the N-th SERVICE as [HOST][/PREFIX] (repeatable)")
+	replicas := pflag.IntP("replicas", "n", 1, "Number of instances of each SERVICE")
+	controlSocket := pflag.String("control-socket", "", `Control socket path (default "$XDG_RUNTIME_DIR/aegis-NODE_ID.sock")`)
+	envoyBinary := pflag.String("envoy", "", `Envoy binary path (default "envoy")`)
+	envoyArgs := pflag.StringArray("envoy-arg", nil, "Extra Envoy command line argument (repeatable)")
+	envoyAdmin := pflag.String("envoy-admin-address", "", `Envoy admin interface address, port 0 means random (default "127.0.0.1:0")`)
+	nodeId := pflag.String("node-id", "", `Envoy node id (default "aegis")`)
+	nodeCluster := pflag.String("node-cluster", "", `Envoy node cluster (default "aegis")`)
+	httpsPort := pflag.Uint16("https-port", 8443, "HTTPS listening port when --acme is set")
+	useAcme := pflag.Bool("acme", false, "Obtain certificates of --domain and --route hosts using ACME")
+	acmeEmail := pflag.String("acme-email", "", "ACME account contact email")
+	acmeDirectory := pflag.String("acme-directory", config.DefaultAcme.DirectoryUrl, "ACME directory URL")
+	acmeCaCert := pflag.String("acme-ca-cert", "", "PEM file of CA certificates trusted to connect to ACME directory")
+	acmeStorage := pflag.String("acme-storage", config.DefaultAcme.StorageDir, "ACME account and certificates directory")
 
 	pflag.Parse()
 
@@ -31,19 +66,29 @@ func main() {
 		return
 	}
 
-	logLevel := slog.LevelInfo
-	if *debug {
-		logLevel = slog.LevelDebug
-	}
-
-	// Setup logger.
-	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
-		Level: logLevel,
-	})).With(slog.String("component", "aegis"))
-
-	err := aegisMain(logger, Args{
-		domain:    *domain,
-		port:      *port,
+	baseLogger, logger := newLoggers(*debug)
+	err := aegisMain(baseLogger, logger, Args{
+		config:        *cfgPath,
+		controlSocket: *controlSocket,
+		domain:        *domain,
+		port:          *port,
+		routes:        *routes,
+		replicas:      *replicas,
+		envoy: config.Envoy{
+			Binary:       *envoyBinary,
+			Args:         *envoyArgs,
+			AdminAddress: *envoyAdmin,
+			NodeId:       *nodeId,
+			NodeCluster:  *nodeCluster,
+		},
+		httpsPort: *httpsPort,
+		acme:      *useAcme,
+		acmeOptions: config.Acme{
+			Email:        *acmeEmail,
+			DirectoryUrl: *acmeDirectory,
+			CaCert:       *acmeCaCert,
+			StorageDir:   *acmeStorage,
+		},
 		remaining: pflag.Args(),
 	})
 	if err != nil {
@@ -52,6 +97,20 @@ func main() {
 	}
 }
 
+// newLoggers returns base logger and aegis logger. Child processes output is
+// forwarded to base logger with a different component.
+func newLoggers(debug bool) (*slog.Logger, *slog.Logger) {
+	logLevel := slog.LevelInfo
+	if debug {
+		logLevel = slog.LevelDebug
+	}
+
+	baseLogger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
+		Level: logLevel,
+	}))
+	return baseLogger, baseLogger.With(slog.String("component", "aegis"))
+}
+
 func printUsage() {
 	fmt.Fprintln(os.Stderr, "aegis 0.1.0")
 	fmt.Fprintln(os.Stderr, "Alexandre Negrel <alexandre@negrel.dev>")
@@ -61,30 +120,263 @@ func printUsage() {
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "USAGE:")
 	fmt.Fprintln(os.Stderr, "  aegis [OPTIONS] SERVICE...")
+	fmt.Fprintln(os.Stderr, "  aegis [OPTIONS] --config aegis.yml")
+	fmt.Fprintln(os.Stderr, "  aegis reload-service [OPTIONS] NAME")
+	fmt.Fprintln(os.Stderr, "  aegis control-plane [OPTIONS] --config aegis.yml")
+	fmt.Fprintln(os.Stderr, "  aegis bootstrap [OPTIONS]")
 	fmt.Fprintln(os.Stderr, "  aegis 'deno run -A ./main.ts --port=$PORT'")
 	fmt.Fprintln(os.Stderr, "  aegis 'deno run ./main.ts' 'python main.py'")
+	fmt.Fprintln(os.Stderr, "  aegis -r api.example.com -r /admin 'deno run ./api.ts' 'python admin.py'")
 	fmt.Fprintln(os.Stderr, "")
 	fmt.Fprintln(os.Stderr, "Options:")
 	pflag.PrintDefaults()
 }
 
+func reloadServiceMain(args []string) {
+	flags := pflag.NewFlagSet("reload-service", pflag.ExitOnError)
+	help := flags.BoolP("help", "h", false, "Print this help and exit")
+	controlSocket := flags.String("control-socket", "", `Control socket path (default "$XDG_RUNTIME_DIR/aegis-NODE_ID.sock")`)
+	nodeId := flags.String("node-id", config.DefaultEnvoy.NodeId, "Envoy node id of aegis instance")
+	_ = flags.Parse(args)
+
+	if *help || flags.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "Performs a zero-downtime rolling restart of a service.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "USAGE:")
+		fmt.Fprintln(os.Stderr, "  aegis reload-service [OPTIONS] NAME")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+		if !*help {
+			os.Exit(1)
+		}
+		return
+	}
+
+	socket := cmp.Or(*controlSocket, DefaultControlSocket(*nodeId))
+	err := SendControlCommand(socket, "reload-service", flags.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to reload service: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func controlPlaneMain(args []string) {
+	flags := pflag.NewFlagSet("control-plane", pflag.ExitOnError)
+	help := flags.BoolP("help", "h", false, "Print this help and exit")
+	debug := flags.Bool("debug", false, "Enable debug logs")
+	cfgPath := flags.StringP("config", "c", "", "Configuration file (YAML)")
+	controlSocket := flags.String("control-socket", "", `Control socket path (default "$XDG_RUNTIME_DIR/aegis-NODE_ID.sock")`)
+	address := flags.String("address", "", fmt.Sprintf("ADS gRPC server listening address (default %q)", config.DefaultControlPlane.Address))
+	nodeHash := flags.String("node-hash", "", `Serve Envoy nodes by "cluster" or "id" (default "cluster")`)
+	nodeId := flags.String("node-id", "", `Envoy node id served when --node-hash is "id" (default "aegis")`)
+	nodeCluster := flags.String("node-cluster", "", `Envoy node cluster served when --node-hash is "cluster" (default "aegis")`)
+	tlsCert := flags.String("tls-cert", "", "PEM certificate file of ADS gRPC server")
+	tlsKey := flags.String("tls-key", "", "PEM private key file of ADS gRPC server")
+	tlsClientCa := flags.String("tls-client-ca", "", "PEM file of CA certificates Envoy client certificates must be signed by (mTLS)")
+	_ = flags.Parse(args)
+
+	if *help || *cfgPath == "" || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Serves configuration to remote Envoy nodes without starting Envoy.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "USAGE:")
+		fmt.Fprintln(os.Stderr, "  aegis control-plane [OPTIONS] --config aegis.yml")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+		if !*help {
+			os.Exit(1)
+		}
+		return
+	}
+
+	switch *nodeHash {
+	case "", "id", "cluster":
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --node-hash %q, expected \"id\" or \"cluster\"\n", *nodeHash)
+		os.Exit(1)
+	}
+
+	var tlsFlags *config.ControlPlaneTls
+	if *tlsCert != "" || *tlsKey != "" || *tlsClientCa != "" {
+		tlsFlags = &config.ControlPlaneTls{
+			CertFile:     *tlsCert,
+			KeyFile:      *tlsKey,
+			ClientCaFile: *tlsClientCa,
+		}
+	}
+
+	baseLogger, logger := newLoggers(*debug)
+	err := aegisMain(baseLogger, logger, Args{
+		config:        *cfgPath,
+		controlSocket: *controlSocket,
+		envoy: config.Envoy{
+			NodeId:      *nodeId,
+			NodeCluster: *nodeCluster,
+		},
+		controlPlane: &config.ControlPlane{
+			Address:  *address,
+			NodeHash: *nodeHash,
+			Tls:      tlsFlags,
+		},
+	})
+	if err != nil {
+		logger.Error("unexpected error occured", slog.Any("error", err))
+		os.Exit(1)
+	}
+}
+
+func bootstrapMain(args []string) {
+	flags := pflag.NewFlagSet("bootstrap", pflag.ExitOnError)
+	help := flags.BoolP("help", "h", false, "Print this help and exit")
+	cfgPath := flags.StringP("config", "c", "", "Configuration file (YAML)")
+	output := flags.StringP("output", "o", "yaml", `Output format, "yaml" or "json"`)
+	envoyAdmin := flags.String("envoy-admin-address", "", `Envoy admin interface address, port 0 means random (default "127.0.0.1:0")`)
+	nodeId := flags.String("node-id", "", `Envoy node id (default "aegis")`)
+	nodeCluster := flags.String("node-cluster", "", `Envoy node cluster (default "aegis")`)
+	xdsAddress := flags.String("xds-address", "", "HOST:PORT address of aegis control plane (default control plane address)")
+	xdsSni := flags.String("xds-sni", "", "SNI of TLS connections to control plane")
+	xdsCa := flags.String("xds-ca", "", "PEM file of CA certificates trusted to connect to control plane (TLS)")
+	xdsCert := flags.String("xds-cert", "", "PEM client certificate file presented to control plane (mTLS)")
+	xdsKey := flags.String("xds-key", "", "PEM client private key file (mTLS)")
+	_ = flags.Parse(args)
+
+	if *help || flags.NArg() != 0 {
+		fmt.Fprintln(os.Stderr, "Prints bootstrap configuration of an Envoy node served by aegis control plane.")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "USAGE:")
+		fmt.Fprintln(os.Stderr, "  aegis bootstrap [OPTIONS]")
+		fmt.Fprintln(os.Stderr, "  aegis bootstrap --config aegis.yml --xds-address aegis.internal:18000 > envoy.yml")
+		fmt.Fprintln(os.Stderr, "")
+		fmt.Fprintln(os.Stderr, "Options:")
+		flags.PrintDefaults()
+		if !*help {
+			os.Exit(1)
+		}
+		return
+	}
+
+	var xdsTls *bootstrap.XdsTls
+	if *xdsSni != "" || *xdsCa != "" || *xdsCert != "" || *xdsKey != "" {
+		xdsTls = &bootstrap.XdsTls{
+			Sni:      *xdsSni,
+			CaFile:   *xdsCa,
+			CertFile: *xdsCert,
+			KeyFile:  *xdsKey,
+		}
+	}
+
+	data, err := bootstrapOutput(*cfgPath, *output, *xdsAddress, xdsTls, config.Envoy{
+		AdminAddress: *envoyAdmin,
+		NodeId:       *nodeId,
+		NodeCluster:  *nodeCluster,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to generate bootstrap: %v\n", err)
+		os.Exit(1)
+	}
+	_, _ = os.Stdout.Write(data)
+}
+
+// bootstrapOutput returns bootstrap configuration of an Envoy node connecting
+// to control plane at xdsAddress encoded in the given format. Control plane
+// address of configuration file is used if xdsAddress is empty.
+func bootstrapOutput(cfgPath, format, xdsAddress string, xdsTls *bootstrap.XdsTls, envoyFlags config.Envoy) ([]byte, error) {
+	if format != "yaml" && format != "json" {
+		return nil, fmt.Errorf("unknown output format %q", format)
+	}
+
+	cfg := &config.Config{}
+	if cfgPath != "" {
+		var err error
+		cfg, err = config.Load(cfgPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+	envoyCfg := EnvoyConfig(cfg, envoyFlags)
+
+	adminAddr, err := netip.ParseAddrPort(envoyCfg.AdminAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy admin address: %w", err)
+	}
+	if xdsAddress == "" {
+		xdsAddress = ControlPlaneConfig(cfg, config.ControlPlane{}).Address
+		if addr, err := netip.ParseAddrPort(xdsAddress); err == nil && addr.Addr().IsUnspecified() {
+			return nil, fmt.Errorf("control plane listens on %v, please specify an address reachable by envoy using --xds-address", xdsAddress)
+		}
+	}
+	xdsAddr, err := xnet.ParseSocketAddr(xdsAddress)
+	if err != nil {
+		return nil, fmt.Errorf("invalid control plane address: %w", err)
+	}
+
+	b, err := EnvoyBootstrap(envoyCfg, adminAddr, bootstrap.Xds{
+		Address: xdsAddr,
+		Tls:     xdsTls,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := b.Marshal()
+	if err != nil || format == "json" {
+		return data, err
+	}
+
+	// JSON is valid YAML.
+	var v any
+	err = yaml.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 type Args struct {
-	domain    string
-	port      uint16
-	remaining []string
+	config        string
+	controlSocket string
+	domain        string
+	port          uint16
+	routes        []string
+	replicas      int
+	envoy         config.Envoy
+	httpsPort     uint16
+	acme          bool
+	acmeOptions   config.Acme
+	remaining     []string
+	// controlPlane contains control plane flags, it is nil unless aegis runs in
+	// control-plane mode.
+	controlPlane *config.ControlPlane
 }
 
-func aegisMain(logger *slog.Logger, args Args) error {
-	if args.port == 0 {
-		return fmt.Errorf("please specify a valid port")
+func aegisMain(baseLogger *slog.Logger, logger *slog.Logger, args Args) error {
+	var cfg *config.Config
+	var err error
+	if args.config != "" {
+		if len(args.remaining) > 0 {
+			return fmt.Errorf("services must be declared in configuration file when --config is used")
+		}
+		cfg, err = config.Load(args.config)
+	} else {
+		cfg, err = ArgsConfig(args)
 	}
-	if args.domain == "" {
-		return fmt.Errorf("please specify a valid domain")
+	if err != nil {
+		return err
 	}
-	if len(args.remaining) != 1 {
-		return fmt.Errorf("please specify a single command")
+	envoyCfg := EnvoyConfig(cfg, args.envoy)
+	if args.controlPlane != nil {
+		err = cfg.ValidateControlPlane()
+		if err != nil {
+			return err
+		}
 	}
-	service := args.remaining[0]
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
@@ -93,81 +385,128 @@ func aegisMain(logger *slog.Logger, args Args) error {
 	return conc.Block(func(n conc.Nursery) error {
 		// Cancel nursery on signal.
 		n.Go(func() error {
-			<-signals
-			logger.Info("signal received, stopping services...")
-			cancel()
+			select {
+			case <-signals:
+				logger.Info("signal received, stopping services...")
+				cancel()
+			case <-n.Done():
+			}
 			return nil
 		})
 
-		// Start ADS gRPC server.
-		ads, adsPort, err := StartAds(n)
-		if err != nil {
-			return fmt.Errorf("failed to start ADS gRPC server: %w", err)
+		// Start ADS gRPC server and envoy, or serve remote envoy nodes in
+		// control-plane mode.
+		var adsService *ads.Service
+		var commitOpts []ads.CommitOption
+		var envoy *Envoy
+		var rateLimit *ratelimit.Service
+		var err error
+		if args.controlPlane != nil {
+			adsService, err = StartControlPlane(n, logger, ControlPlaneConfig(cfg, *args.controlPlane), envoyCfg)
+			if err != nil {
+				return fmt.Errorf("failed to start control plane: %w", err)
+			}
+			// Remote nodes may not be connected yet.
+			commitOpts = append(commitOpts, ads.AllowDisconnected())
+		} else {
+			var adsPort, rlsPort uint16
+			adsService, adsPort, err = StartAds(n, logger, envoyCfg.NodeId)
+			if err != nil {
+				return fmt.Errorf("failed to start ADS gRPC server: %w", err)
+			}
+			rateLimit, rlsPort, err = StartRateLimit(n, logger, cfg.RateLimitService)
+			if err != nil {
+				return fmt.Errorf("failed to start rate limit gRPC server: %w", err)
+			}
+
+			envoy, err = StartEnvoy(n, logger, baseLogger.With(slog.String("component", "envoy")), envoyCfg, adsPort, rlsPort, adsService)
+			if err != nil {
+				return fmt.Errorf("failed to start envoy: %w", err)
+			}
 		}
 
-		// Start envoy.
-		err = StartEnvoy(n, logger, adsPort, 9901)
+		// Start services and create initial configuration.
+		gateway := NewGateway(logger, baseLogger.With(slog.String("component", "service")), adsService, commitOpts...)
+		if rateLimit != nil {
+			gateway.UseRateLimit(rateLimit)
+		}
+		n.Go(func() error {
+			<-n.Done()
+			gateway.Stop()
+			return nil
+		})
+		var acmeManager *acme.Manager
+		if cfg.Acme != nil {
+			acmeManager, err = StartAcme(n, logger, cfg.Acme.WithDefaults(), gateway)
+			if err != nil {
+				return fmt.Errorf("failed to start ACME client: %w", err)
+			}
+		}
+		err = gateway.Apply(n, cfg)
 		if err != nil {
-			return fmt.Errorf("failed to start envoy: %w", err)
+			return err
+		}
+
+		// Obtain certificates once challenges are routed to aegis.
+		if acmeManager != nil {
+			RunAcme(n, logger, acmeManager, gateway)
 		}
 
-		// Start service.
-		servicePort, err := StartService(
-			n,
-			logger.With(slog.Any("service", service)),
-			service,
-		)
+		// Reload configuration on changes.
+		err = WatchConfig(n, logger, gateway, envoy, args.envoy, args.config)
 		if err != nil {
-			return fmt.Errorf("failed to start service process: %w", err)
-		}
-
-		// Create cluster.
-		serviceCluster := &cds.Cluster{
-			Name:           "service",
-			ConnectTimeout: time.Second,
-			LbPolicy:       cluster.Cluster_ROUND_ROBIN,
-			Endpoints: []xnet.SocketAddr{
-				xnet.IPSocketAddr{
-					Host: netip.MustParseAddr("127.0.0.1"),
-					Port: servicePort,
-				},
-			},
-			TcpKeepAlive: nil,
-		}
-		ads.CDS.SetCluster(serviceCluster)
-
-		// Create listener.
-		ads.LDS.SetListener(&lds.Listener{
-			Name: "entrypoint",
-			Address: xnet.IPSocketAddr{
-				Host: netip.MustParseAddr("0.0.0.0"),
-				Port: args.port,
-			},
-			FilterChains: [][]lds.Filter{{
-				lds.HttpProxyFilter{
-					HttpFilters: []lds.HttpFilter{lds.HttpRouter{}},
-					RouteConfig: lds.RouteConfig{
-						Name: "service",
-						VirtualHosts: []lds.VirtualHost{
-							{
-								Name:    "service",
-								Domains: []string{"*"},
-								Cluster: serviceCluster,
-							},
-						},
-					},
-				},
-			}},
-		})
+			return err
+		}
 
-		// Create snapshot of initial configuration.
-		ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-		defer cancel()
-		err = ads.Snapshot(ctx)
+		// Serve control commands.
+		err = ServeControl(n, logger, gateway, cmp.Or(args.controlSocket, DefaultControlSocket(envoyCfg.NodeId)))
 		if err != nil {
-			return fmt.Errorf("failed to create xDS snapshot: %w", err)
+			return err
 		}
 
 		return nil
 	}, conc.WithContext(ctx))
 }
+
+// EnvoyConfig returns Envoy configuration of cfg with unset fields set to their
+// default value and overridden by command line flags. Extra Envoy arguments
+// are appended to configured ones.
+func EnvoyConfig(cfg *config.Config, flags config.Envoy) config.Envoy {
+	result := cfg.Envoy.WithDefaults()
+	if flags.Binary != "" {
+		result.Binary = flags.Binary
+	}
+	if flags.AdminAddress != "" {
+		result.AdminAddress = flags.AdminAddress
+	}
+	if flags.NodeId != "" {
+		result.NodeId = flags.NodeId
+	}
+	if flags.NodeCluster != "" {
+		result.NodeCluster = flags.NodeCluster
+	}
+	result.Args = append(slices.Clone(result.Args), flags.Args...)
+
+	return result
+}
+
+// ControlPlaneConfig returns control plane configuration of cfg with unset
+// fields set to their default value and overridden by command line flags.
+func ControlPlaneConfig(cfg *config.Config, flags config.ControlPlane) config.ControlPlane {
+	result := cfg.ControlPlane
+	if result == nil {
+		result = &config.ControlPlane{}
+	}
+	merged := *result
+	if flags.Address != "" {
+		merged.Address = flags.Address
+	}
+	if flags.NodeHash != "" {
+		merged.NodeHash = flags.NodeHash
+	}
+	if flags.Tls != nil {
+		merged.Tls = flags.Tls
+	}
+
+	return merged.WithDefaults()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"context"
 	"errors"
+	"io"
 	"os"
 	"os/exec"
 	"slices"
@@ -39,16 +40,31 @@ func StartProcess(command string, args []string, env []string) (*Process, error)
 		return nil, err
 	}
 
+	// Create stdout and stderr pipes.
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	defer stdoutW.Close()
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		return nil, err
+	}
+	defer stderrW.Close()
+
 	// Start process.
 	osProc, err := os.StartProcess(command, args, &os.ProcAttr{
 		Env: env,
 		Files: []*os.File{
 			nil,
-			os.Stdout,
-			os.Stderr,
+			stdoutW,
+			stderrW,
 		},
 	})
 	if err != nil {
+		stdoutR.Close()
+		stderrR.Close()
 		return nil, err
 	}
 
@@ -57,6 +73,8 @@ func StartProcess(command string, args []string, env []string) (*Process, error)
 		done:      make(chan struct{}),
 		doneState: atomic.Pointer[os.ProcessState]{},
 		doneErr:   atomic.Pointer[error]{},
+		stdout:    stdoutR,
+		stderr:    stderrR,
 	}
 
 	go func() {
@@ -115,6 +133,18 @@ func (p *Process) Wait() (*os.ProcessState, error) {
 	return p.doneState.Load(), err
 }
 
+// Stdout returns read end of process stdout pipe. It must be consumed until
+// EOF to prevent process from blocking on writes and then closed.
+func (p *Process) Stdout() io.ReadCloser {
+	return p.stdout
+}
+
+// Stderr returns read end of process stderr pipe. It must be consumed until
+// EOF to prevent process from blocking on writes and then closed.
+func (p *Process) Stderr() io.ReadCloser {
+	return p.stderr
+}
+
 // Pid returns process id.
 func (p *Process) Pid() int {
 	return p.os.Pid
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/ratelimit"
+	"github.com/negrel/aegis/internal/xnet"
+	"github.com/negrel/conc"
+)
+
+// StartRateLimit starts rate limit gRPC server storing counters in the store
+// of cfg, in memory if cfg is nil. Envoy reaches it through a static cluster
+// of its bootstrap configuration.
+func StartRateLimit(n conc.Nursery, logger *slog.Logger, cfg *config.RateLimitService) (*ratelimit.Service, uint16, error) {
+	lis, port, err := xnet.RandomListener("tcp")
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to setup TCP listener: %w", err)
+	}
+
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if cfg != nil && cfg.Redis != nil {
+		redis := ratelimit.NewRedisStore(ratelimit.RedisOptions{
+			Address:     cfg.Redis.Address,
+			Password:    cfg.Redis.Password,
+			Db:          cfg.Redis.Db,
+			DialTimeout: time.Second,
+		})
+		n.Go(func() error {
+			<-n.Done()
+			_ = redis.Close()
+			return nil
+		})
+		store = redis
+		logger.Info("rate limit counters stored in redis", slog.String("address", cfg.Redis.Address))
+	}
+
+	rls := ratelimit.NewService(logger, store)
+	n.Go(func() error {
+		err := rls.Serve(lis)
+		if err != nil {
+			return fmt.Errorf("rate limit gRPC server failed: %w", err)
+		}
+		return nil
+	})
+	n.Go(func() error {
+		<-n.Done()
+		rls.GracefulStop()
+		return nil
+	})
+
+	return rls, port, nil
+}
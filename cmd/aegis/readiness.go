@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/negrel/aegis/internal/config"
+)
+
+// probeTimeout is the maximum duration of a single probe attempt.
+const probeTimeout = time.Second
+
+// WaitReady runs readiness probe against a service listening on the given
+// port until it succeeds. An error is returned if probe startup timeout
+// expires or context is canceled. Output of exec probes is forwarded to
+// output logger.
+func WaitReady(ctx context.Context, output *slog.Logger, probe config.ReadinessProbe, port uint16) error {
+	ctx, cancel := context.WithTimeout(ctx, probe.StartupTimeout)
+	defer cancel()
+
+	ticker := time.NewTicker(probe.Interval)
+	defer ticker.Stop()
+
+	var err error
+	for {
+		err = runProbe(ctx, output, probe, port)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return fmt.Errorf("service not ready after %v: %w", probe.StartupTimeout, err)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+func runProbe(ctx context.Context, output *slog.Logger, probe config.ReadinessProbe, port uint16) error {
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	addr := net.JoinHostPort("127.0.0.1", strconv.Itoa(int(port)))
+	switch {
+	case probe.Http != nil:
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+addr+probe.Http.Path, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode != probe.Http.Status {
+			return fmt.Errorf("unexpected HTTP status %v, expected %v", resp.StatusCode, probe.Http.Status)
+		}
+		return nil
+
+	case probe.Exec != nil:
+		args, env, err := ParseCommand(probe.Exec.Command, probe.Exec.Shell, port)
+		if err != nil {
+			return err
+		}
+		proc, err := StartProcess(args[0], args[1:], env)
+		if err != nil {
+			return err
+		}
+		ForwardOutput(output.With(slog.String("probe", "exec")), proc)
+		select {
+		case <-proc.Done():
+		case <-ctx.Done():
+			_ = proc.GracefulStop(context.Background())
+			return ctx.Err()
+		}
+		state, err := proc.Wait()
+		if err != nil {
+			return err
+		}
+		if state.ExitCode() != 0 {
+			return fmt.Errorf("probe command exited with code %v", state.ExitCode())
+		}
+		return nil
+
+	default:
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/conc"
+)
+
+// reloadDebounce is the delay to wait for after a configuration file change
+// before reloading it. Editors often write files in multiple steps.
+const reloadDebounce = 100 * time.Millisecond
+
+// WatchConfig reloads configuration file at path and applies it to gateway on
+// SIGHUP and whenever file changes. Invalid configurations are logged and
+// ignored. If envoy isn't nil, it is hot restarted when its configuration
+// changes, envoyFlags overriding configuration file. Otherwise aegis runs in
+// control-plane mode and configurations it doesn't support are ignored too.
+// If path is empty, SIGHUP is ignored.
+func WatchConfig(n conc.Nursery, logger *slog.Logger, g *Gateway, envoy *Envoy, envoyFlags config.Envoy, path string) error {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+
+	// Watch parent directory as editors may replace file instead of writing it.
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create configuration file watcher: %w", err)
+	}
+	if path != "" {
+		path, err = filepath.Abs(path)
+		if err == nil {
+			err = watcher.Add(filepath.Dir(path))
+		}
+		if err != nil {
+			watcher.Close()
+			return fmt.Errorf("failed to watch configuration file: %w", err)
+		}
+	}
+
+	reload := func() {
+		if path == "" {
+			logger.Warn("no configuration file, nothing to reload")
+			return
+		}
+
+		cfg, err := config.Load(path)
+		if err == nil && envoy == nil {
+			// Envoy doesn't run next to aegis in control-plane mode.
+			err = cfg.ValidateControlPlane()
+		}
+		if err != nil {
+			logger.Error("failed to reload configuration", slog.Any("error", err))
+			return
+		}
+
+		prev := g.Config()
+		if !cfg.Envoy.Equal(prev.Envoy) {
+			if envoy == nil {
+				logger.Warn("envoy configuration changed, restart aegis to apply it")
+			} else if err := envoy.Update(n, EnvoyConfig(cfg, envoyFlags)); err != nil {
+				logger.Error("failed to hot restart envoy", slog.Any("error", err))
+			}
+		}
+		if !cfg.ControlPlane.Equal(prev.ControlPlane) {
+			logger.Warn("control plane configuration changed, restart aegis to apply it")
+		}
+		if !cfg.Acme.Equal(prev.Acme) {
+			logger.Warn("acme configuration changed, restart aegis to apply it")
+		}
+		if !cfg.RateLimitService.Equal(prev.RateLimitService) {
+			logger.Warn("rate limit service configuration changed, restart aegis to apply it")
+		}
+
+		err = g.Apply(n, cfg)
+		if err != nil {
+			logger.Error("failed to apply configuration", slog.Any("error", err))
+			return
+		}
+		logger.Info("configuration reloaded")
+	}
+
+	n.Go(func() error {
+		defer watcher.Close()
+		defer signal.Stop(sighup)
+
+		debounce := time.NewTimer(reloadDebounce)
+		debounce.Stop()
+
+		for {
+			select {
+			case <-n.Done():
+				return nil
+
+			case <-sighup:
+				logger.Info("SIGHUP received, reloading configuration...")
+				reload()
+
+			case ev := <-watcher.Events:
+				if ev.Name == path && ev.Op&(fsnotify.Write|fsnotify.Create) != 0 {
+					debounce.Reset(reloadDebounce)
+				}
+
+			case <-debounce.C:
+				logger.Info("configuration file changed, reloading configuration...")
+				reload()
+
+			case err := <-watcher.Errors:
+				logger.Error("configuration file watcher error", slog.Any("error", err))
+			}
+		}
+	})
+
+	return nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/negrel/aegis/internal/config"
+)
+
+// ServiceRoute define where a service is attached in the entrypoint route
+// configuration.
+type ServiceRoute struct {
+	Host   string
+	Prefix string
+}
+
+// ParseServiceRoute parses a route of the form [HOST][/PREFIX]. If host is
+// omitted, defaultHost is used. If prefix is omitted, "/" is used.
+func ParseServiceRoute(route string, defaultHost string) (ServiceRoute, error) {
+	host, prefix := route, "/"
+	if i := strings.IndexByte(route, '/'); i >= 0 {
+		host, prefix = route[:i], route[i:]
+	}
+	if host == "" {
+		host = defaultHost
+	}
+	if strings.ContainsAny(host, " \t") {
+		return ServiceRoute{}, fmt.Errorf("invalid route host %q", host)
+	}
+
+	return ServiceRoute{Host: host, Prefix: prefix}, nil
+}
+
+// RouteConfig builds a route configuration that forwards traffic to clusters
+// according to routes. Routes sharing the same host are grouped in a single
+// virtual host and ordered from the longest prefix to the shortest one.
+func RouteConfig(name string, routes []ServiceRoute, clusters []string) config.RouteConfig {
+	var vhosts []config.VirtualHost
+	for i, r := range routes {
+		j := slices.IndexFunc(vhosts, func(vh config.VirtualHost) bool {
+			return vh.Domains[0] == r.Host
+		})
+		if j == -1 {
+			vhosts = append(vhosts, config.VirtualHost{
+				Name:    r.Host,
+				Domains: []string{r.Host},
+			})
+			j = len(vhosts) - 1
+		}
+
+		vhosts[j].Routes = append(vhosts[j].Routes, config.Route{
+			Name:    clusters[i],
+			Prefix:  r.Prefix,
+			Cluster: clusters[i],
+		})
+	}
+
+	for _, vh := range vhosts {
+		slices.SortStableFunc(vh.Routes, func(a, b config.Route) int {
+			return cmp.Compare(len(b.Prefix), len(a.Prefix))
+		})
+	}
+
+	return config.RouteConfig{
+		Name:         name,
+		VirtualHosts: vhosts,
+	}
+}
+
+// ArgsConfig returns configuration equivalent to command line arguments.
+func ArgsConfig(args Args) (*config.Config, error) {
+	if args.port == 0 {
+		return nil, fmt.Errorf("please specify a valid port")
+	}
+	if args.domain == "" {
+		return nil, fmt.Errorf("please specify a valid domain")
+	}
+	if len(args.remaining) == 0 {
+		return nil, fmt.Errorf("please specify at least one service")
+	}
+	if len(args.routes) > len(args.remaining) {
+		return nil, fmt.Errorf("more routes than services specified")
+	}
+	if args.replicas < 1 {
+		return nil, fmt.Errorf("please specify a valid number of replicas")
+	}
+
+	cfg := &config.Config{}
+	routes := make([]ServiceRoute, len(args.remaining))
+	names := make([]string, len(args.remaining))
+	for i, service := range args.remaining {
+		route := ""
+		if i < len(args.routes) {
+			route = args.routes[i]
+		}
+		r, err := ParseServiceRoute(route, args.domain)
+		if err != nil {
+			return nil, err
+		}
+		if j := slices.Index(routes[:i], r); j >= 0 {
+			return nil, fmt.Errorf("services %q and %q have the same route %v%v, use --route to route them separately", args.remaining[j], service, r.Host, r.Prefix)
+		}
+		routes[i] = r
+		names[i] = fmt.Sprintf("service-%v", i)
+
+		cfg.Services = append(cfg.Services, config.Service{
+			Name:     names[i],
+			Command:  service,
+			Replicas: args.replicas,
+		})
+	}
+
+	routeConfig := RouteConfig("entrypoint", routes, names)
+	cfg.Listeners = []config.Listener{{
+		Name:    "entrypoint",
+		Address: fmt.Sprintf("0.0.0.0:%v", args.port),
+		FilterChains: []config.FilterChain{{
+			Filters: []config.Filter{{
+				HttpProxy: &config.HttpProxyFilter{
+					RouteConfig: routeConfig,
+				},
+			}},
+		}},
+	}}
+
+	if args.acme {
+		if args.httpsPort == 0 || args.httpsPort == args.port {
+			return nil, fmt.Errorf("please specify a valid HTTPS port")
+		}
+		acme := args.acmeOptions
+		for _, r := range routes {
+			if !strings.Contains(r.Host, "*") && !slices.Contains(acme.Domains, r.Host) {
+				acme.Domains = append(acme.Domains, r.Host)
+			}
+		}
+		if len(acme.Domains) == 0 {
+			return nil, fmt.Errorf("please specify a non wildcard domain to use ACME")
+		}
+		cfg.Acme = &acme
+
+		// Serve each domain with its own certificate.
+		listener := config.Listener{
+			Name:    "entrypoint-tls",
+			Address: fmt.Sprintf("0.0.0.0:%v", args.httpsPort),
+			Tls:     &config.Tls{Alpn: []string{"h2", "http/1.1"}},
+		}
+		for _, domain := range acme.Domains {
+			listener.FilterChains = append(listener.FilterChains, config.FilterChain{
+				ServerNames: []string{domain},
+				Tls: &config.Tls{
+					Certificates: []config.TlsCertificate{{Acme: domain}},
+				},
+				Filters: []config.Filter{{
+					HttpProxy: &config.HttpProxyFilter{
+						RouteConfig: routeConfig,
+					},
+				}},
+			})
+		}
+		cfg.Listeners = append(cfg.Listeners, listener)
+	}
+
+	return cfg, cfg.Validate()
+}
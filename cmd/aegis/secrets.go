@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/negrel/aegis/internal/acme"
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/xds/sds"
+)
+
+// LoadSecrets reads files of secrets referenced by configuration and returns
+// secrets indexed by name. ACME certificates are loaded from manager, those not
+// issued yet are omitted. Secrets that can't be read are omitted and reported
+// in returned error.
+func LoadSecrets(refs []config.SecretRef, manager *acme.Manager) (map[string]*sds.Secret, error) {
+	secrets := make(map[string]*sds.Secret, len(refs))
+	var errs []error
+	for _, ref := range refs {
+		var secret *sds.Secret
+		var err error
+		switch {
+		case ref.CaFile != "":
+			secret, err = loadValidationContext(ref.Name, ref.CaFile)
+
+		case ref.Certificate.Acme != "":
+			if manager == nil {
+				continue
+			}
+			cert, ok := manager.Certificate(ref.Certificate.Acme)
+			if !ok {
+				continue
+			}
+			secret, err = loadCertificate(ref.Name, cert.CertFile, cert.KeyFile)
+
+		default:
+			secret, err = loadCertificate(ref.Name, ref.Certificate.CertFile, ref.Certificate.KeyFile)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("failed to load secret %q: %w", ref.Name, err))
+			continue
+		}
+		secrets[ref.Name] = secret
+	}
+
+	return secrets, errors.Join(errs...)
+}
+
+func loadCertificate(name, certFile, keyFile string) (*sds.Secret, error) {
+	cert, err := readPem(certFile, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+	key, err := readPem(keyFile, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sds.Secret{
+		Name: name,
+		TlsCertificate: &sds.TlsCertificate{
+			CertificateChain: cert,
+			PrivateKey:       key,
+		},
+	}, nil
+}
+
+func loadValidationContext(name, caFile string) (*sds.Secret, error) {
+	ca, err := readPem(caFile, "CERTIFICATE")
+	if err != nil {
+		return nil, err
+	}
+
+	return &sds.Secret{
+		Name:              name,
+		ValidationContext: &sds.ValidationContext{TrustedCa: ca},
+	}, nil
+}
+
+// readPem reads a PEM file and checks that it contains a block whose type
+// ends with blockType.
+func readPem(path string, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.Contains(string(data), blockType+"-----") {
+		return nil, fmt.Errorf("no PEM encoded %v found in %v", strings.ToLower(blockType), path)
+	}
+
+	return data, nil
+}
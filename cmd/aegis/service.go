@@ -4,24 +4,145 @@ import (
 	"context"
 	"fmt"
 	"log/slog"
+	"net/netip"
 	"os"
 	"strconv"
-	"strings"
+	"sync"
 	"time"
 
+	"github.com/negrel/aegis/internal/config"
+	"github.com/negrel/aegis/internal/shlex"
 	"github.com/negrel/aegis/internal/xnet"
-	"github.com/negrel/conc"
 )
 
-// StartService starts a service process.
-func StartService(n conc.Nursery, logger *slog.Logger, service string) (uint16, error) {
+// Service wraps a supervised service process.
+type Service struct {
+	logger     *slog.Logger
+	output     *slog.Logger
+	supervisor *Supervisor
+	readiness  config.ReadinessProbe
+	port       uint16
+
+	mu             sync.Mutex
+	healthy        bool
+	stopped        bool
+	onHealthChange func()
+}
+
+// StartService starts a service process listening on a random port provided
+// through $PORT environment variable. Process is restarted on the same port
+// according to the service restart policy. Process stdout and stderr are
+// forwarded to output logger. Service is unhealthy until WaitReady succeeds,
+// it becomes unhealthy again when process exits and healthy once restarted
+// process is ready.
+func StartService(logger *slog.Logger, output *slog.Logger, cfg config.Service) (*Service, error) {
 	// Determinate service TCP port.
 	lis, tcpPort, err := xnet.RandomListener("tcp")
 	if err != nil {
-		return 0, fmt.Errorf("failed to listen on random TCP port: %w", err)
+		return nil, fmt.Errorf("failed to listen on random TCP port: %w", err)
 	}
 	lis.Close()
 
+	// Start and supervise service process.
+	args, env, err := ParseCommand(cfg.Command, cfg.Shell, tcpPort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse service command: %w", err)
+	}
+	s := &Service{
+		logger:    logger,
+		output:    output,
+		readiness: cfg.Readiness.WithDefaults(),
+		port:      tcpPort,
+	}
+	restarted := false
+	supervisor, err := Supervise(logger, cfg.Restart.WithDefaults(), func() (*Process, error) {
+		proc, err := StartProcess(args[0], args[1:], env)
+		if err != nil {
+			return nil, err
+		}
+		ForwardOutput(output, proc)
+		go s.watch(proc, restarted)
+		restarted = true
+		return proc, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start service process %v: %w", args, err)
+	}
+	s.supervisor = supervisor
+
+	logger.Info("service started",
+		slog.Int("pid", supervisor.Process().Pid()),
+		slog.Int("port", int(tcpPort)),
+	)
+
+	return s, nil
+}
+
+// watch marks service unhealthy once proc exits. If proc is a restarted
+// process, service is marked healthy once it is ready.
+func (s *Service) watch(proc *Process, restarted bool) {
+	if restarted {
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			<-proc.Done()
+			cancel()
+		}()
+		err := WaitReady(ctx, s.output, s.readiness, s.port)
+		cancel()
+		if err == nil {
+			s.logger.Info("service ready")
+			s.setHealthy(true)
+		} else if ctx.Err() == nil {
+			s.logger.Warn("restarted service is not ready", slog.Any("error", err))
+		}
+	}
+
+	<-proc.Done()
+	s.setHealthy(false)
+}
+
+// setHealthy updates service health and calls health change callback if it
+// changed.
+func (s *Service) setHealthy(healthy bool) {
+	s.mu.Lock()
+	changed := s.healthy != healthy && !s.stopped
+	s.healthy = healthy
+	onHealthChange := s.onHealthChange
+	s.mu.Unlock()
+
+	if changed && onHealthChange != nil {
+		onHealthChange()
+	}
+}
+
+// Healthy reports whether service process is running and ready.
+func (s *Service) Healthy() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.healthy
+}
+
+// OnHealthChange sets a callback called whenever service health changes
+// after WaitReady returned. Callback isn't called once service is stopped.
+func (s *Service) OnHealthChange(fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onHealthChange = fn
+}
+
+// ParseCommand parses a service command and returns its arguments and
+// environment. Command is split into words following POSIX shell rules,
+// leading NAME=VALUE words are added to the environment and environment
+// variables are substituted. $PORT is substituted with tcpPort. If shell is
+// true, command is executed by /bin/sh as is with $PORT environment variable
+// set.
+func ParseCommand(command string, shell bool, tcpPort uint16) (args []string, env []string, err error) {
+	env = os.Environ()
+	env = append(env, fmt.Sprintf("PORT=%v", tcpPort))
+	if shell {
+		return []string{"/bin/sh", "-c", command}, env, nil
+	}
+
 	getEnv := func(key string) string {
 		if key == "PORT" {
 			return strconv.Itoa(int(tcpPort))
@@ -30,43 +151,67 @@ func StartService(n conc.Nursery, logger *slog.Logger, service string) (uint16,
 		}
 	}
 
-	// Parse service command and substitute environment variables.
-	args := strings.Split(service, " ")
-	env := os.Environ()
-	env = append(env, fmt.Sprintf("PORT=%v", tcpPort))
-	for i, arg := range args {
-		if strings.Contains(arg, "=") {
-			env = append(env, os.Expand(arg, getEnv))
-		} else {
-			args = args[i:]
-			break
-		}
+	assignments, args, err := shlex.SplitCommand(command, getEnv)
+	if err != nil {
+		return nil, nil, err
 	}
-	for i, arg := range args {
-		args[i] = os.Expand(arg, getEnv)
+	env = append(env, assignments...)
+	if len(args) == 0 {
+		return nil, nil, fmt.Errorf("empty command")
 	}
 
-	// Start service process.
-	proc, err := StartProcess(args[0], args[1:], env)
+	return args, env, nil
+}
+
+// WaitReady waits until service readiness probe succeeds. An error is
+// returned if startup timeout expires or context is canceled.
+func (s *Service) WaitReady(ctx context.Context) error {
+	start := time.Now()
+	err := WaitReady(ctx, s.output, s.readiness, s.port)
 	if err != nil {
-		return 0, fmt.Errorf("failed to start service process %v: %w", args, err)
+		return err
 	}
 
-	// Stop process when nursery is canceled.
-	n.Go(func() error {
-		<-n.Done()
+	s.logger.Info("service ready", slog.Duration("duration", time.Since(start)))
+	s.mu.Lock()
+	s.healthy = true
+	s.mu.Unlock()
+	return nil
+}
 
-		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
-		defer cancel()
-		logger.Debug("gracefully stopping service...")
-		err := proc.GracefulStop(ctx)
-		if err != nil {
-			logger.Error("failed to stop service process", slog.Any("error", err))
-		} else {
-			logger.Info("service gracefully stopped")
-		}
-		return nil
-	})
+// Endpoint returns address service is listening on.
+func (s *Service) Endpoint() xnet.SocketAddr {
+	return xnet.IPSocketAddr{
+		Host: netip.MustParseAddr("127.0.0.1"),
+		Port: s.port,
+	}
+}
+
+// Stop gracefully stops service process.
+func (s *Service) Stop() {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	s.mu.Lock()
+	s.stopped = true
+	s.mu.Unlock()
+	s.logger.Debug("gracefully stopping service...")
+	err := s.supervisor.GracefulStop(ctx)
+	if err != nil {
+		s.logger.Error("failed to stop service process", slog.Any("error", err))
+	} else {
+		s.logger.Info("service gracefully stopped")
+	}
+}
 
-	return tcpPort, nil
+// StopServices gracefully stops all services concurrently.
+func StopServices(services []*Service) {
+	var wg sync.WaitGroup
+	for _, s := range services {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Stop()
+		}()
+	}
+	wg.Wait()
 }
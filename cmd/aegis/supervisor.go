@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/negrel/aegis/internal/config"
+)
+
+// Supervisor runs a process and restarts it according to a restart policy.
+type Supervisor struct {
+	logger *slog.Logger
+	policy config.RestartPolicy
+	start  func() (*Process, error)
+
+	mu        sync.Mutex
+	proc      *Process
+	startedAt time.Time
+	// err is the reason supervisor stopped restarting process.
+	err error
+
+	stopOnce sync.Once
+	stop     chan struct{}
+	done     chan struct{}
+	// replaced is notified when process is replaced.
+	replaced chan struct{}
+}
+
+// Supervise starts a process using start and restarts it according to policy
+// once it exits. Restarts and exits are logged using the provided logger. An
+// error is returned if initial process fails to start.
+func Supervise(logger *slog.Logger, policy config.RestartPolicy, start func() (*Process, error)) (*Supervisor, error) {
+	proc, err := start()
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Supervisor{
+		logger:    logger,
+		policy:    policy,
+		start:     start,
+		proc:      proc,
+		startedAt: time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+		replaced:  make(chan struct{}, 1),
+	}
+	go s.supervise()
+
+	return s, nil
+}
+
+func (s *Supervisor) supervise() {
+	defer close(s.done)
+
+	var restarts []time.Time
+	retries := 0
+	// reason is why last process exited or failed to start.
+	var reason error
+	for {
+		s.mu.Lock()
+		proc, startedAt := s.proc, s.startedAt
+		s.mu.Unlock()
+
+		// Wait for process to exit. proc is nil if restart failed.
+		exitCode := -1
+		if proc != nil {
+			select {
+			case <-proc.Done():
+			case <-s.replaced:
+				continue
+			}
+			state, err := proc.Wait()
+			if state != nil {
+				exitCode = state.ExitCode()
+				reason = errors.New(state.String())
+			} else {
+				reason = err
+			}
+
+			select {
+			case <-s.stop:
+				return
+			default:
+			}
+
+			level := slog.LevelInfo
+			if exitCode != 0 {
+				level = slog.LevelWarn
+			}
+			s.logger.Log(context.Background(), level, "process exited",
+				slog.Int("pid", proc.Pid()),
+				slog.Int("exit_code", exitCode),
+				slog.String("reason", reason.Error()),
+				slog.Duration("uptime", time.Since(startedAt)),
+				slog.Any("error", err),
+			)
+		}
+
+		if !s.shouldRestart(exitCode) {
+			s.logger.Info("process not restarted", slog.String("restart_policy", s.policy.Policy))
+			s.setErr(fmt.Errorf("process exited and wasn't restarted: %w", reason))
+			return
+		}
+
+		// Reset backoff if process was stable.
+		now := time.Now()
+		if now.Sub(startedAt) >= s.policy.CrashLoopWindow {
+			retries = 0
+		}
+		retries++
+		if s.policy.MaxRetries > 0 && retries > s.policy.MaxRetries {
+			s.logger.Error("process restarted too many times, giving up",
+				slog.Int("max_retries", s.policy.MaxRetries),
+			)
+			s.setErr(fmt.Errorf("process restarted too many times: %w", reason))
+			return
+		}
+
+		backoff := s.backoff(retries)
+
+		// Detect crash loop.
+		restarts = append(restarts, now)
+		for len(restarts) > 0 && now.Sub(restarts[0]) > s.policy.CrashLoopWindow {
+			restarts = restarts[1:]
+		}
+		if len(restarts) > s.policy.CrashLoopRestarts {
+			s.logger.Error("process is crash looping",
+				slog.Int("restarts", len(restarts)),
+				slog.Duration("window", s.policy.CrashLoopWindow),
+			)
+			backoff = s.policy.MaxBackoff
+		}
+
+		s.logger.Info("restarting process",
+			slog.Int("attempt", retries),
+			slog.Duration("backoff", backoff),
+			slog.String("reason", reason.Error()),
+		)
+		select {
+		case <-s.stop:
+			return
+		case <-s.replaced:
+			continue
+		case <-time.After(backoff):
+		}
+
+		if err := s.restart(); err != nil {
+			reason = err
+		}
+	}
+}
+
+// restart starts a new process and returns an error if it failed to start. If
+// supervisor was stopped meanwhile, new process is stopped immediately.
+func (s *Supervisor) restart() error {
+	proc, err := s.start()
+	if err != nil {
+		s.logger.Error("failed to restart process", slog.Any("error", err))
+	} else {
+		s.logger.Info("process restarted", slog.Int("pid", proc.Pid()))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.proc, s.startedAt = proc, time.Now()
+
+	select {
+	case <-s.stop:
+		if proc != nil {
+			_ = proc.Signal(os.Kill)
+		}
+	default:
+	}
+
+	return err
+}
+
+func (s *Supervisor) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *Supervisor) shouldRestart(exitCode int) bool {
+	switch s.policy.Policy {
+	case config.RestartAlways:
+		return true
+	case config.RestartOnFailure:
+		return exitCode != 0
+	default:
+		return false
+	}
+}
+
+// backoff returns delay before restart attempt.
+func (s *Supervisor) backoff(attempt int) time.Duration {
+	backoff := s.policy.InitialBackoff
+	for i := 1; i < attempt && backoff < s.policy.MaxBackoff; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, s.policy.MaxBackoff)
+}
+
+// Replace makes supervisor supervise proc instead of current process. Exit of
+// replaced process is ignored, it must be stopped by caller. If supervisor
+// was stopped, proc is killed and false is returned.
+func (s *Supervisor) Replace(proc *Process) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	select {
+	case <-s.stop:
+		_ = proc.Signal(os.Kill)
+		return false
+	case <-s.done:
+		_ = proc.Signal(os.Kill)
+		return false
+	default:
+	}
+
+	s.proc, s.startedAt = proc, time.Now()
+	select {
+	case s.replaced <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Process returns current process. It returns nil if last restart failed.
+func (s *Supervisor) Process() *Process {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proc
+}
+
+// Done returns a channel closed once supervisor stopped restarting process.
+func (s *Supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns why supervisor stopped restarting process once Done is closed.
+// It returns nil if supervisor was stopped using GracefulStop.
+func (s *Supervisor) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+// GracefulStop stops supervision and gracefully stops current process. See
+// Process.GracefulStop.
+func (s *Supervisor) GracefulStop(ctx context.Context) error {
+	s.stopOnce.Do(func() { close(s.stop) })
+
+	var err error
+	if proc := s.Process(); proc != nil {
+		err = proc.GracefulStop(ctx)
+	}
+	<-s.done
+
+	return err
+}
@@ -0,0 +1,301 @@
+package acme
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	xacme "golang.org/x/crypto/acme"
+)
+
+// ChallengePathPrefix is the path prefix of HTTP-01 challenges requests.
+const ChallengePathPrefix = "/.well-known/acme-challenge/"
+
+const (
+	// checkInterval is the delay between two certificates expiry checks.
+	checkInterval = time.Hour
+	// retryInterval is the delay before retrying a failed issuance.
+	retryInterval = time.Minute
+	// issueTimeout is the maximum duration of a certificate issuance.
+	issueTimeout = 5 * time.Minute
+)
+
+// Options define ACME manager options.
+type Options struct {
+	// DirectoryUrl is the ACME directory URL of the CA.
+	DirectoryUrl string
+	// CaCert is an optional PEM file containing CA certificates trusted to
+	// connect to the ACME directory (e.g. Pebble test CA).
+	CaCert string
+	// Email is the contact of the ACME account.
+	Email string
+	// StorageDir is the directory where account key and certificates are
+	// stored.
+	StorageDir string
+	// RenewBefore is the duration before certificate expiry at which it is
+	// renewed.
+	RenewBefore time.Duration
+	Domains     []string
+}
+
+// Manager obtains and renews certificates of domains from an ACME CA using
+// HTTP-01 challenges. Challenges are answered by Manager HTTP handler that
+// must be reachable on port 80 of the domains.
+type Manager struct {
+	logger      *slog.Logger
+	client      *xacme.Client
+	email       string
+	storage     storage
+	renewBefore time.Duration
+	domains     []string
+
+	mu     sync.Mutex
+	tokens map[string]string
+	certs  map[string]Certificate
+}
+
+// NewManager returns a new ACME manager. Account key and certificates
+// previously stored in options storage directory are loaded.
+func NewManager(logger *slog.Logger, opts Options) (*Manager, error) {
+	store := storage{dir: opts.StorageDir}
+	key, err := store.accountKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load ACME account key: %w", err)
+	}
+
+	client := &xacme.Client{
+		Key:          key,
+		DirectoryURL: opts.DirectoryUrl,
+		UserAgent:    "aegis",
+	}
+	if opts.CaCert != "" {
+		pem, err := os.ReadFile(opts.CaCert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read ACME CA certificate: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %v", opts.CaCert)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: pool},
+			},
+		}
+	}
+
+	m := &Manager{
+		logger:      logger,
+		client:      client,
+		email:       opts.Email,
+		storage:     store,
+		renewBefore: opts.RenewBefore,
+		domains:     opts.Domains,
+		tokens:      make(map[string]string),
+		certs:       make(map[string]Certificate),
+	}
+
+	for _, domain := range opts.Domains {
+		cert, ok, err := store.certificate(domain)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			m.certs[domain] = cert
+		}
+	}
+
+	return m, nil
+}
+
+// Certificate returns current certificate of domain, if any.
+func (m *Manager) Certificate(domain string) (Certificate, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cert, ok := m.certs[domain]
+	return cert, ok
+}
+
+// ServeHTTP implements http.Handler. It answers HTTP-01 challenges.
+func (m *Manager) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, ok := strings.CutPrefix(r.URL.Path, ChallengePathPrefix)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	m.mu.Lock()
+	keyAuth, ok := m.tokens[token]
+	m.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = w.Write([]byte(keyAuth))
+}
+
+// Run obtains missing certificates and renews expiring ones until context is
+// canceled. onUpdate is called every time a certificate is issued.
+func (m *Manager) Run(ctx context.Context, onUpdate func(Certificate)) error {
+	err := m.register(ctx)
+	for err != nil {
+		m.logger.Error("failed to register ACME account", slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(retryInterval):
+		}
+		err = m.register(ctx)
+	}
+
+	for {
+		next := checkInterval
+		for _, domain := range m.domains {
+			cert, ok := m.Certificate(domain)
+			if ok && time.Until(cert.NotAfter) > m.renewBefore {
+				continue
+			}
+
+			logger := m.logger.With(slog.String("domain", domain))
+			logger.Info("requesting certificate...")
+			newCert, err := m.issue(ctx, domain, cert)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				logger.Error("failed to obtain certificate", slog.Any("error", err))
+				next = retryInterval
+				continue
+			}
+
+			m.mu.Lock()
+			m.certs[domain] = newCert
+			m.mu.Unlock()
+			logger.Info("certificate issued", slog.Time("not_after", newCert.NotAfter))
+			onUpdate(newCert)
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(next):
+		}
+	}
+}
+
+func (m *Manager) register(ctx context.Context) error {
+	var contact []string
+	if m.email != "" {
+		contact = []string{"mailto:" + m.email}
+	}
+	_, err := m.client.Register(ctx, &xacme.Account{Contact: contact}, xacme.AcceptTOS)
+	if errors.Is(err, xacme.ErrAccountAlreadyExists) {
+		return nil
+	}
+	return err
+}
+
+// issue obtains a new certificate for domain and stores it. prev certificate
+// files are kept until next renewal.
+func (m *Manager) issue(ctx context.Context, domain string, prev Certificate) (Certificate, error) {
+	ctx, cancel := context.WithTimeout(ctx, issueTimeout)
+	defer cancel()
+
+	order, err := m.client.AuthorizeOrder(ctx, xacme.DomainIDs(domain))
+	if err != nil {
+		return Certificate{}, fmt.Errorf("failed to create order: %w", err)
+	}
+
+	for _, url := range order.AuthzURLs {
+		err := m.authorize(ctx, url)
+		if err != nil {
+			return Certificate{}, err
+		}
+	}
+
+	order, err = m.client.WaitOrder(ctx, order.URI)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("order failed: %w", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return Certificate{}, err
+	}
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		DNSNames: []string{domain},
+	}, key)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("failed to create certificate request: %w", err)
+	}
+	chain, _, err := m.client.CreateOrderCert(ctx, order.FinalizeURL, csr, true)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("failed to finalize order: %w", err)
+	}
+
+	cert, err := m.storage.storeCertificate(domain, chain, key, prev)
+	if err != nil {
+		return Certificate{}, fmt.Errorf("failed to store certificate: %w", err)
+	}
+
+	return cert, nil
+}
+
+// authorize completes HTTP-01 challenge of authorization at url.
+func (m *Manager) authorize(ctx context.Context, url string) error {
+	authz, err := m.client.GetAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("failed to get authorization: %w", err)
+	}
+	if authz.Status == xacme.StatusValid {
+		return nil
+	}
+
+	var chal *xacme.Challenge
+	for _, c := range authz.Challenges {
+		if c.Type == "http-01" {
+			chal = c
+			break
+		}
+	}
+	if chal == nil {
+		return fmt.Errorf("no http-01 challenge offered for %v", authz.Identifier.Value)
+	}
+
+	keyAuth, err := m.client.HTTP01ChallengeResponse(chal.Token)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.tokens[chal.Token] = keyAuth
+	m.mu.Unlock()
+	defer func() {
+		m.mu.Lock()
+		delete(m.tokens, chal.Token)
+		m.mu.Unlock()
+	}()
+
+	_, err = m.client.Accept(ctx, chal)
+	if err != nil {
+		return fmt.Errorf("failed to accept challenge: %w", err)
+	}
+	_, err = m.client.WaitAuthorization(ctx, url)
+	if err != nil {
+		return fmt.Errorf("authorization failed: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package acme
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestManagerServeHTTP(t *testing.T) {
+	m := &Manager{tokens: map[string]string{"token": "token.thumbprint"}}
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+	}{
+		{name: "Challenge", path: ChallengePathPrefix + "token", status: http.StatusOK, body: "token.thumbprint"},
+		{name: "UnknownToken", path: ChallengePathPrefix + "other", status: http.StatusNotFound},
+		{name: "OtherPath", path: "/token", status: http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, test.path, nil))
+			if rec.Code != test.status {
+				t.Fatalf("expected status %v, got %v", test.status, rec.Code)
+			}
+			if test.body != "" && rec.Body.String() != test.body {
+				t.Fatalf("expected body %q, got %q", test.body, rec.Body.String())
+			}
+		})
+	}
+}
+
+// TestManagerPebble obtains a certificate from a Pebble ACME test server. It
+// runs if AEGIS_PEBBLE_DIRECTORY is set to Pebble directory URL (e.g.
+// https://localhost:14000/dir) and AEGIS_PEBBLE_CA_CERT to Pebble
+// test/certs/pebble.minica.pem file. Pebble must run with
+// PEBBLE_VA_ALWAYS_VALID=1, or with its httpPort pointing to
+// AEGIS_PEBBLE_HTTP_ADDRESS where challenges are answered.
+func TestManagerPebble(t *testing.T) {
+	directory := os.Getenv("AEGIS_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("AEGIS_PEBBLE_DIRECTORY isn't set")
+	}
+
+	storageDir := t.TempDir()
+	m, err := NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), Options{
+		DirectoryUrl: directory,
+		CaCert:       os.Getenv("AEGIS_PEBBLE_CA_CERT"),
+		Email:        "admin@example.com",
+		StorageDir:   storageDir,
+		RenewBefore:  24 * time.Hour,
+		Domains:      []string{"api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if addr := os.Getenv("AEGIS_PEBBLE_HTTP_ADDRESS"); addr != "" {
+		srv := &http.Server{Addr: addr, Handler: m}
+		go func() { _ = srv.ListenAndServe() }()
+		defer srv.Close()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	issued := make(chan Certificate, 1)
+	go func() {
+		_ = m.Run(ctx, func(cert Certificate) {
+			issued <- cert
+			cancel()
+		})
+	}()
+
+	var cert Certificate
+	select {
+	case cert = <-issued:
+	case <-ctx.Done():
+		t.Fatalf("certificate wasn't issued: %v", ctx.Err())
+	}
+
+	x509Cert, err := readCertificate(cert.CertFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(x509Cert.DNSNames) != 1 || x509Cert.DNSNames[0] != "api.example.com" {
+		t.Fatalf("expected certificate of api.example.com, got %v", x509Cert.DNSNames)
+	}
+	_, err = readKey(cert.KeyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Issued certificate is loaded on restart.
+	m, err = NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)), Options{
+		DirectoryUrl: directory,
+		StorageDir:   storageDir,
+		Domains:      []string{"api.example.com"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if loaded, ok := m.Certificate("api.example.com"); !ok || loaded != cert {
+		t.Fatalf("expected certificate %v, got %v", cert, loaded)
+	}
+}
@@ -0,0 +1,244 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/negrel/aegis/internal/xnet"
+)
+
+// Certificate define a certificate chain and its private key stored on disk.
+// Files of a certificate are never modified, a renewed certificate is stored
+// in new files.
+type Certificate struct {
+	Domain   string
+	CertFile string
+	KeyFile  string
+	NotAfter time.Time
+}
+
+// storage stores ACME account key and certificates in a directory:
+//
+//	<dir>/account.key
+//	<dir>/<domain>/<serial>.crt
+//	<dir>/<domain>/<serial>.key
+type storage struct {
+	dir string
+}
+
+// accountKey loads ACME account key or generates a new one if none exists.
+func (s storage) accountKey() (crypto.Signer, error) {
+	path := filepath.Join(s.dir, "account.key")
+	key, err := readKey(path)
+	if err == nil {
+		return key, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	err = writeKey(path, newKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey, nil
+}
+
+// certificate returns latest stored certificate of domain.
+func (s storage) certificate(domain string) (Certificate, bool, error) {
+	dir, err := s.domainDir(domain)
+	if err != nil {
+		return Certificate{}, false, err
+	}
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return Certificate{}, false, nil
+	}
+	if err != nil {
+		return Certificate{}, false, err
+	}
+
+	var latest Certificate
+	found := false
+	for _, e := range entries {
+		name, ok := strings.CutSuffix(e.Name(), ".crt")
+		if !ok {
+			continue
+		}
+		certFile := filepath.Join(dir, e.Name())
+		keyFile := filepath.Join(dir, name+".key")
+		if _, err := os.Stat(keyFile); err != nil {
+			continue
+		}
+
+		cert, err := readCertificate(certFile)
+		if err != nil {
+			return Certificate{}, false, fmt.Errorf("failed to read certificate %v: %w", certFile, err)
+		}
+		if !found || cert.NotAfter.After(latest.NotAfter) {
+			latest = Certificate{
+				Domain:   domain,
+				CertFile: certFile,
+				KeyFile:  keyFile,
+				NotAfter: cert.NotAfter,
+			}
+			found = true
+		}
+	}
+
+	return latest, found, nil
+}
+
+// domainDir returns directory containing certificates of domain. Domain must
+// be a host name so it can't escape storage directory.
+func (s storage) domainDir(domain string) (string, error) {
+	if !xnet.IsHostname(domain) {
+		return "", fmt.Errorf("invalid domain %q", domain)
+	}
+	return filepath.Join(s.dir, domain), nil
+}
+
+// storeCertificate stores a DER encoded certificate chain and its private key.
+// Certificates of domain other than the new one and keep are removed.
+func (s storage) storeCertificate(domain string, chain [][]byte, key crypto.Signer, keep Certificate) (Certificate, error) {
+	leaf, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	dir, err := s.domainDir(domain)
+	if err != nil {
+		return Certificate{}, err
+	}
+	err = os.MkdirAll(dir, 0o700)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	name := leaf.SerialNumber.Text(16)
+	cert := Certificate{
+		Domain:   domain,
+		CertFile: filepath.Join(dir, name+".crt"),
+		KeyFile:  filepath.Join(dir, name+".key"),
+		NotAfter: leaf.NotAfter,
+	}
+
+	// Certificate file is written last as certificates without it are ignored.
+	err = writeKey(cert.KeyFile, key)
+	if err != nil {
+		return Certificate{}, err
+	}
+	var certPem []byte
+	for _, der := range chain {
+		certPem = append(certPem, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	err = writeFileAtomic(cert.CertFile, certPem, 0o644)
+	if err != nil {
+		return Certificate{}, err
+	}
+
+	// Remove outdated certificates.
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return cert, nil
+	}
+	for _, e := range entries {
+		path := filepath.Join(dir, e.Name())
+		switch path {
+		case cert.CertFile, cert.KeyFile, keep.CertFile, keep.KeyFile:
+		default:
+			_ = os.Remove(path)
+		}
+	}
+
+	return cert, nil
+}
+
+func readCertificate(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM encoded certificate found")
+	}
+
+	return x509.ParseCertificate(block.Bytes)
+}
+
+func readKey(path string) (crypto.Signer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found in %v", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse key %v: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported key type %T in %v", key, path)
+	}
+
+	return signer, nil
+}
+
+func writeKey(path string, key crypto.Signer) error {
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0o600)
+}
+
+// writeFileAtomic writes data to a temporary file and renames it to path so
+// readers never see a partially written file.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
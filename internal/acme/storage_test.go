@@ -0,0 +1,138 @@
+package acme
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// selfSigned returns a DER encoded certificate of domain and its key.
+func selfSigned(t *testing.T, domain string, serial int64, notAfter time.Time) ([]byte, crypto.Signer) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter.Truncate(time.Second),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return der, key
+}
+
+// storeCertificate stores a certificate of domain expiring at notAfter.
+func storeCertificate(t *testing.T, s storage, domain string, serial int64, notAfter time.Time, keep Certificate) Certificate {
+	t.Helper()
+	der, key := selfSigned(t, domain, serial, notAfter)
+	cert, err := s.storeCertificate(domain, [][]byte{der}, key, keep)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	return cert
+}
+
+// domainFiles returns names of files stored for domain.
+func domainFiles(t *testing.T, s storage, domain string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(filepath.Join(s.dir, domain))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func TestStorageStoreCertificate(t *testing.T) {
+	s := storage{dir: t.TempDir()}
+	now := time.Now()
+
+	first := storeCertificate(t, s, "api.example.com", 0x1, now.Add(30*24*time.Hour), Certificate{})
+	if first.CertFile != filepath.Join(s.dir, "api.example.com", "1.crt") || first.KeyFile != filepath.Join(s.dir, "api.example.com", "1.key") {
+		t.Fatalf("unexpected certificate files %v and %v", first.CertFile, first.KeyFile)
+	}
+	cert, err := readCertificate(first.CertFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !cert.NotAfter.Equal(first.NotAfter) {
+		t.Fatalf("expected not after %v, got %v", first.NotAfter, cert.NotAfter)
+	}
+	_, err = readKey(first.KeyFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Previous certificate is kept.
+	second := storeCertificate(t, s, "api.example.com", 0x2, now.Add(90*24*time.Hour), first)
+	if files := domainFiles(t, s, "api.example.com"); !slices.Equal(files, []string{"1.crt", "1.key", "2.crt", "2.key"}) {
+		t.Fatalf("expected first and second certificates files, got %v", files)
+	}
+
+	// Certificates other than the new and kept ones are removed.
+	storeCertificate(t, s, "api.example.com", 0x3, now.Add(60*24*time.Hour), second)
+	if files := domainFiles(t, s, "api.example.com"); !slices.Equal(files, []string{"2.crt", "2.key", "3.crt", "3.key"}) {
+		t.Fatalf("expected second and third certificates files, got %v", files)
+	}
+
+	// Domain can't escape storage directory.
+	der, key := selfSigned(t, "api.example.com", 0x4, now.Add(time.Hour))
+	_, err = s.storeCertificate("../api.example.com", [][]byte{der}, key, Certificate{})
+	if err == nil {
+		t.Fatalf("expected invalid domain error")
+	}
+}
+
+func TestStorageCertificate(t *testing.T) {
+	s := storage{dir: t.TempDir()}
+	now := time.Now()
+
+	_, ok, err := s.certificate("api.example.com")
+	if err != nil || ok {
+		t.Fatalf("expected no certificate, got %v, %v", ok, err)
+	}
+
+	first := storeCertificate(t, s, "api.example.com", 0x1, now.Add(90*24*time.Hour), Certificate{})
+	storeCertificate(t, s, "api.example.com", 0x2, now.Add(30*24*time.Hour), first)
+
+	// Certificate without its key file is ignored.
+	der, _ := selfSigned(t, "api.example.com", 0x3, now.Add(365*24*time.Hour))
+	orphan := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	err = os.WriteFile(filepath.Join(s.dir, "api.example.com", "3.crt"), orphan, 0o644)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Certificate expiring last is returned.
+	latest, ok, err := s.certificate("api.example.com")
+	if err != nil || !ok {
+		t.Fatalf("expected a certificate, got %v, %v", ok, err)
+	}
+	if latest != first {
+		t.Fatalf("expected certificate %v, got %v", first, latest)
+	}
+
+	_, _, err = s.certificate("../api.example.com")
+	if err == nil {
+		t.Fatalf("expected invalid domain error")
+	}
+}
@@ -0,0 +1,595 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	bootstrapv3 "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	rlsconf "github.com/envoyproxy/go-control-plane/ratelimit/config/ratelimit/v3"
+	"github.com/negrel/aegis/internal/xds/bootstrap"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
+	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/sds"
+	"github.com/negrel/aegis/internal/xnet"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// DefaultConnectTimeout is the cluster connect timeout used when none is
+// configured.
+const DefaultConnectTimeout = time.Second
+
+// BuildBootstrap sets stats, overload manager, runtime layers and tracing of
+// Envoy bootstrap b as configured.
+func (e *Envoy) BuildBootstrap(b *bootstrap.Bootstrap) error {
+	pb, errs := e.bootstrapProto("envoy")
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	b.StatsConfig = pb.StatsConfig
+	b.StatsSinks = pb.StatsSinks
+	b.OverloadManager = pb.OverloadManager
+	b.RuntimeLayers = pb.GetLayeredRuntime().GetLayers()
+	b.Tracing = pb.Tracing
+
+	return nil
+}
+
+// bootstrapProto decodes bootstrap fields of Envoy configuration into an
+// Envoy bootstrap protobuf. Fields are decoded and validated one by one so
+// errors are located at their key.
+func (e *Envoy) bootstrapProto(field string) (*bootstrapv3.Bootstrap, []error) {
+	fields := []struct {
+		key   string
+		set   bool
+		value map[string]any
+	}{
+		{"stats_config", e.StatsConfig != nil, map[string]any{"stats_config": e.StatsConfig}},
+		{"stats_sinks", e.StatsSinks != nil, map[string]any{"stats_sinks": e.StatsSinks}},
+		{"overload_manager", e.OverloadManager != nil, map[string]any{"overload_manager": e.OverloadManager}},
+		{"runtime_layers", e.RuntimeLayers != nil, map[string]any{"layered_runtime": map[string]any{"layers": e.RuntimeLayers}}},
+		{"tracing", e.Tracing != nil, map[string]any{"tracing": e.Tracing}},
+	}
+
+	var errs []error
+	pb := &bootstrapv3.Bootstrap{}
+	for _, f := range fields {
+		if !f.set {
+			continue
+		}
+		data, err := json.Marshal(f.value)
+		if err != nil {
+			errs = append(errs, e.errorf(field, f.key, "%v", err))
+			continue
+		}
+		part := &bootstrapv3.Bootstrap{}
+		err = protojson.Unmarshal(data, part)
+		if err == nil {
+			err = part.ValidateAll()
+		}
+		if err != nil {
+			errs = append(errs, e.errorf(field, f.key, "invalid envoy %v: %v", f.key, err))
+			continue
+		}
+		proto.Merge(pb, part)
+	}
+
+	return pb, errs
+}
+
+// AllClusters returns declared clusters followed by clusters implicitly
+// created for services.
+func (c *Config) AllClusters() []Cluster {
+	clusters := slices.Clone(c.Clusters)
+	for _, s := range c.Services {
+		declared := slices.ContainsFunc(c.Clusters, func(cl Cluster) bool {
+			return cl.Name == s.Name
+		})
+		if !declared {
+			clusters = append(clusters, Cluster{Name: s.Name, Service: s.Name})
+		}
+	}
+
+	return clusters
+}
+
+// BuildClusters returns clusters described by configuration.
+func (c *Config) BuildClusters() []*cds.Cluster {
+	var clusters []*cds.Cluster
+	for _, cl := range c.AllClusters() {
+		var service *Service
+		if i := slices.IndexFunc(c.Services, func(s Service) bool { return s.Name == cl.Service }); i >= 0 {
+			service = &c.Services[i]
+		}
+		clusters = append(clusters, cl.ToCluster(service))
+	}
+
+	return clusters
+}
+
+// BuildLoadAssignments returns load assignments of clusters described by
+// configuration. endpoints contains endpoints of services instances indexed by
+// service name.
+func (c *Config) BuildLoadAssignments(endpoints map[string][]eds.Endpoint) []*eds.ClusterLoadAssignment {
+	var loadAssignments []*eds.ClusterLoadAssignment
+	for _, cl := range c.AllClusters() {
+		loadAssignments = append(loadAssignments, cl.ToLoadAssignment(endpoints[cl.Service]))
+	}
+
+	return loadAssignments
+}
+
+// ToLoadAssignment returns load assignment of cluster. serviceEndpoints are
+// used as endpoints if cluster is bound to a service, static endpoints are
+// always healthy.
+func (c *Cluster) ToLoadAssignment(serviceEndpoints []eds.Endpoint) *eds.ClusterLoadAssignment {
+	var endpoints []eds.Endpoint
+	if c.Service != "" {
+		endpoints = slices.Clone(serviceEndpoints)
+	}
+	for _, e := range c.Endpoints {
+		addrPort := netip.MustParseAddrPort(e)
+		endpoints = append(endpoints, eds.Endpoint{
+			Address: xnet.IPSocketAddr{
+				Host: addrPort.Addr(),
+				Port: addrPort.Port(),
+			},
+			Health: eds.Healthy,
+		})
+	}
+
+	return &eds.ClusterLoadAssignment{
+		ClusterName: c.Name,
+		Endpoints:   endpoints,
+	}
+}
+
+// ToCluster converts cluster configuration to a *cds.Cluster. service is the
+// service cluster is bound to, if any. Circuit breakers of service are used if
+// cluster has none and default thresholds are scaled by service replicas.
+func (c *Cluster) ToCluster(service *Service) *cds.Cluster {
+	connectTimeout := c.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = DefaultConnectTimeout
+	}
+	lbPolicy := cluster.Cluster_ROUND_ROBIN
+	if c.LbPolicy != "" {
+		lbPolicy = cluster.Cluster_LbPolicy(cluster.Cluster_LbPolicy_value[strings.ToUpper(c.LbPolicy)])
+	}
+
+	var tcpKeepAlive *cds.TcpKeepAlive
+	if c.TcpKeepAlive != nil {
+		tcpKeepAlive = &cds.TcpKeepAlive{
+			Probes:   c.TcpKeepAlive.Probes,
+			Time:     c.TcpKeepAlive.Time,
+			Interval: c.TcpKeepAlive.Interval,
+		}
+	}
+
+	var tls *cds.Tls
+	if c.Tls != nil {
+		tls = &cds.Tls{Sni: c.Tls.Sni}
+		if c.Tls.CaFile != "" {
+			tls.ValidationContext = c.Tls.caSecretName()
+		}
+		if c.Tls.Certificate != nil {
+			tls.Certificate = c.Tls.Certificate.SecretName()
+		}
+	}
+
+	circuitBreakers, defaultThresholds := c.CircuitBreakers, DefaultCircuitBreakerThresholds
+	if service != nil {
+		if circuitBreakers == nil {
+			circuitBreakers = service.CircuitBreakers
+		}
+		defaultThresholds = DefaultServiceCircuitBreakerThresholds.scale(service.ReplicasOrDefault())
+	}
+	cb := circuitBreakers.WithDefaults(defaultThresholds)
+
+	return &cds.Cluster{
+		Name:           c.Name,
+		ConnectTimeout: connectTimeout,
+		LbPolicy:       lbPolicy,
+		TcpKeepAlive:   tcpKeepAlive,
+		Tls:            tls,
+		CircuitBreakers: &cds.CircuitBreakers{
+			Default: cb.Default.toThresholds(),
+			High:    cb.High.toThresholds(),
+		},
+	}
+}
+
+func (cbt *CircuitBreakerThresholds) toThresholds() cds.Thresholds {
+	thresholds := cds.Thresholds{
+		MaxConnections:     *cbt.MaxConnections,
+		MaxPendingRequests: *cbt.MaxPendingRequests,
+		MaxRequests:        *cbt.MaxRequests,
+		MaxRetries:         *cbt.MaxRetries,
+	}
+	if cbt.RetryBudget != nil {
+		thresholds.RetryBudget = &cds.RetryBudget{
+			BudgetPercent:       *cbt.RetryBudget.BudgetPercent,
+			MinRetryConcurrency: *cbt.RetryBudget.MinRetryConcurrency,
+		}
+	}
+
+	return thresholds
+}
+
+// BuildListeners returns listeners described by configuration. clusters must
+// contains all clusters returned by BuildClusters. secrets contains available
+// secrets indexed by name, filter chains using a missing secret are omitted
+// as well as listeners without filter chains.
+func (c *Config) BuildListeners(clusters []*cds.Cluster, secrets map[string]*sds.Secret) []*lds.Listener {
+	clustersByName := make(map[string]*cds.Cluster, len(clusters))
+	for _, cl := range clusters {
+		clustersByName[cl.Name] = cl
+	}
+
+	var listeners []*lds.Listener
+	for _, l := range c.Listeners {
+		listener := l.ToListener(clustersByName, secrets)
+		if len(listener.FilterChains) > 0 {
+			listeners = append(listeners, listener)
+		}
+	}
+
+	return listeners
+}
+
+// ToListener converts listener configuration to a *lds.Listener. See
+// BuildListeners for secrets.
+func (l *Listener) ToListener(clusters map[string]*cds.Cluster, secrets map[string]*sds.Secret) *lds.Listener {
+	addrPort := netip.MustParseAddrPort(l.Address)
+	listener := &lds.Listener{
+		Name: l.Name,
+		Address: xnet.IPSocketAddr{
+			Host: addrPort.Addr(),
+			Port: addrPort.Port(),
+		},
+	}
+
+	for _, fc := range l.FilterChains {
+		chain := lds.FilterChain{ServerNames: fc.ServerNames}
+		for _, f := range fc.Filters {
+			chain.Filters = append(chain.Filters, f.toFilter(clusters))
+		}
+		if tls := fc.Tls.Merge(l.Tls); tls != nil && len(tls.Certificates) > 0 {
+			var ok bool
+			chain.Tls, ok = tls.toTls(secrets)
+			if !ok {
+				continue
+			}
+		}
+		listener.FilterChains = append(listener.FilterChains, chain)
+	}
+
+	return listener
+}
+
+// tlsVersions maps configuration TLS versions to their Envoy protocol.
+var tlsVersions = map[string]tlsv3.TlsParameters_TlsProtocol{
+	"":    tlsv3.TlsParameters_TLS_AUTO,
+	"1.0": tlsv3.TlsParameters_TLSv1_0,
+	"1.1": tlsv3.TlsParameters_TLSv1_1,
+	"1.2": tlsv3.TlsParameters_TLSv1_2,
+	"1.3": tlsv3.TlsParameters_TLSv1_3,
+}
+
+// toTls converts TLS configuration to a *lds.Tls. It returns false if a
+// certificate secret is missing.
+func (t *Tls) toTls(secrets map[string]*sds.Secret) (*lds.Tls, bool) {
+	tls := &lds.Tls{
+		MinVersion:   tlsVersions[t.MinVersion],
+		CipherSuites: t.CipherSuites,
+		Alpn:         t.Alpn,
+	}
+	for _, c := range t.Certificates {
+		name := c.SecretName()
+		if _, ok := secrets[name]; !ok {
+			return nil, false
+		}
+		tls.Certificates = append(tls.Certificates, name)
+	}
+
+	return tls, true
+}
+
+// SecretName returns name of the SDS secret containing certificate.
+func (tc *TlsCertificate) SecretName() string {
+	if tc.Acme != "" {
+		return "acme:" + tc.Acme
+	}
+	return "file:" + tc.CertFile + ":" + tc.KeyFile
+}
+
+// SecretRef define a secret referenced by configuration. Exactly one of
+// Certificate and CaFile is set.
+type SecretRef struct {
+	Name        string
+	Certificate *TlsCertificate
+	CaFile      string
+}
+
+// SecretRefs returns secrets referenced by listeners and clusters.
+func (c *Config) SecretRefs() []SecretRef {
+	var refs []SecretRef
+	seen := make(map[string]struct{})
+	add := func(ref SecretRef) {
+		if _, ok := seen[ref.Name]; !ok {
+			seen[ref.Name] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+
+	for _, l := range c.Listeners {
+		for _, fc := range l.FilterChains {
+			if tls := fc.Tls.Merge(l.Tls); tls != nil {
+				for _, cert := range tls.Certificates {
+					add(SecretRef{Name: cert.SecretName(), Certificate: &cert})
+				}
+			}
+		}
+	}
+	for _, cl := range c.Clusters {
+		if cl.Tls == nil {
+			continue
+		}
+		if cl.Tls.CaFile != "" {
+			add(SecretRef{Name: cl.Tls.caSecretName(), CaFile: cl.Tls.CaFile})
+		}
+		if cl.Tls.Certificate != nil {
+			add(SecretRef{Name: cl.Tls.Certificate.SecretName(), Certificate: cl.Tls.Certificate})
+		}
+	}
+
+	return refs
+}
+
+func (ut *UpstreamTls) caSecretName() string {
+	return "ca:" + ut.CaFile
+}
+
+func (f *Filter) toFilter(clusters map[string]*cds.Cluster) lds.Filter {
+	if f.TcpProxy != nil {
+		return lds.TcpProxyFilter{Cluster: clusters[f.TcpProxy.Cluster]}
+	}
+
+	var httpFilters []lds.HttpFilter
+	hasRouter := false
+	for _, hf := range f.HttpProxy.HttpFilters {
+		switch {
+		case hf.Router != nil:
+			httpFilters = append(httpFilters, lds.HttpRouter{})
+			hasRouter = true
+		case hf.LocalRateLimit != nil:
+			httpFilters = append(httpFilters, hf.LocalRateLimit.toHttpFilter())
+		case hf.RateLimit != nil:
+			httpFilters = append(httpFilters, lds.RateLimit{
+				Timeout:         hf.RateLimit.Timeout,
+				FailureModeDeny: hf.RateLimit.FailureModeDeny,
+				ResponseBody:    hf.RateLimit.ResponseBody,
+			})
+		}
+	}
+	// Router is the last filter.
+	if !hasRouter {
+		httpFilters = append(httpFilters, lds.HttpRouter{})
+	}
+
+	return lds.HttpProxyFilter{
+		HttpFilters:     httpFilters,
+		RouteConfigName: f.HttpProxy.RouteConfig.Name,
+	}
+}
+
+func (lrlf *LocalRateLimitFilter) toHttpFilter() lds.LocalRateLimit {
+	filter := lds.LocalRateLimit{ResponseBody: lrlf.ResponseBody}
+	if lrlf.TokenBucket != nil {
+		tb := lrlf.TokenBucket.toTokenBucket()
+		filter.TokenBucket = &tb
+	}
+
+	return filter
+}
+
+func (tb *TokenBucket) toTokenBucket() lds.TokenBucket {
+	withDefaults := tb.WithDefaults()
+	return lds.TokenBucket{
+		MaxTokens:     withDefaults.MaxTokens,
+		TokensPerFill: withDefaults.TokensPerFill,
+		FillInterval:  withDefaults.FillInterval,
+	}
+}
+
+// filterConfigs returns HTTP filters configuration of a virtual host or route
+// with the given local rate limit and rate limit. name identifies virtual host
+// or route among route configurations.
+func filterConfigs(name string, virtualHost bool, localRateLimit *LocalRateLimit, rateLimit *RateLimit) []rds.FilterConfig {
+	var configs []rds.FilterConfig
+	if localRateLimit != nil {
+		config := localRateLimit.toFilterConfig()
+		config.VirtualHost = virtualHost
+		configs = append(configs, config)
+	}
+	if rateLimit != nil {
+		config := &lds.RateLimitConfig{VirtualHost: virtualHost}
+		for i, d := range rateLimit.Descriptors {
+			descriptor := rateLimitDescriptor(d.RemoteAddress, d.Header, d.Path)
+			descriptor.Name = rateLimitName(name, i)
+			config.Descriptors = append(config.Descriptors, descriptor)
+		}
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+func (lrl *LocalRateLimit) toFilterConfig() *lds.LocalRateLimitConfig {
+	config := &lds.LocalRateLimitConfig{TokenBucket: lrl.TokenBucket.toTokenBucket()}
+	for _, d := range lrl.Descriptors {
+		config.Descriptors = append(config.Descriptors, lds.LocalRateLimitDescriptor{
+			Descriptor:  rateLimitDescriptor(d.RemoteAddress, d.Header, d.Path),
+			TokenBucket: d.TokenBucket.toTokenBucket(),
+		})
+	}
+
+	return config
+}
+
+// rateLimitName returns name of i-th rate limit descriptor of virtual host or
+// route name.
+func rateLimitName(name string, i int) string {
+	return name + "#" + strconv.Itoa(i)
+}
+
+// virtualHostName returns name of virtual host among route configurations.
+func virtualHostName(rc *RouteConfig, vh *VirtualHost) string {
+	return rc.Name + "/" + vh.Name
+}
+
+// routeName returns name of i-th route of virtual host among route
+// configurations.
+func routeName(rc *RouteConfig, vh *VirtualHost, i int) string {
+	return virtualHostName(rc, vh) + "/" + strconv.Itoa(i)
+}
+
+// BuildRateLimitConfigs returns rules of aegis rate limit service matching
+// descriptors generated by virtual hosts and routes rate limits.
+func (c *Config) BuildRateLimitConfigs() []*rlsconf.RateLimitConfig {
+	cfg := &rlsconf.RateLimitConfig{Name: lds.RateLimitDomain, Domain: lds.RateLimitDomain}
+	addRules := func(name string, rl *RateLimit) {
+		if rl == nil {
+			return
+		}
+		for i, d := range rl.Descriptors {
+			cfg.Descriptors = append(cfg.Descriptors, d.toRule(rateLimitName(name, i)))
+		}
+	}
+	for _, rc := range c.RouteConfigs() {
+		for _, vh := range rc.VirtualHosts {
+			addRules(virtualHostName(&rc, &vh), vh.RateLimit)
+			for i, r := range vh.Routes {
+				addRules(routeName(&rc, &vh, i), r.RateLimit)
+			}
+		}
+	}
+
+	return []*rlsconf.RateLimitConfig{cfg}
+}
+
+// toRule returns rate limit service rule of descriptor named name. Rule
+// descriptors are nested in the order of descriptor entries, empty values
+// match any value.
+func (rld *RateLimitDescriptor) toRule(name string) *rlsconf.RateLimitDescriptor {
+	descriptor := rateLimitDescriptor(rld.RemoteAddress, rld.Header, rld.Path)
+	descriptor.Name = name
+
+	root := &rlsconf.RateLimitDescriptor{}
+	leaf := root
+	for i, e := range descriptor.Entries() {
+		if i > 0 {
+			child := &rlsconf.RateLimitDescriptor{}
+			leaf.Descriptors = []*rlsconf.RateLimitDescriptor{child}
+			leaf = child
+		}
+		leaf.Key, leaf.Value = e.Key, e.Value
+		if e.Key == rds.RemoteAddressKey && e.Value == AnyRemoteAddress {
+			leaf.Value = ""
+		}
+	}
+	leaf.RateLimit = &rlsconf.RateLimitPolicy{
+		Name:            name,
+		Unit:            rlsconf.RateLimitUnit(rlsconf.RateLimitUnit_value[strings.ToUpper(rld.Unit)]),
+		RequestsPerUnit: rld.RequestsPerUnit,
+	}
+
+	return root
+}
+
+func rateLimitDescriptor(remoteAddress string, header *HeaderMatch, path string) rds.RateLimitDescriptor {
+	descriptor := rds.RateLimitDescriptor{
+		RemoteAddress: remoteAddress,
+		PathPrefix:    path,
+	}
+	if header != nil {
+		descriptor.Header = &rds.HeaderMatch{Name: strings.ToLower(header.Name), Value: header.Value}
+	}
+
+	return descriptor
+}
+
+// RouteConfigs returns route configurations of listeners HTTP proxy filters.
+// Route configurations sharing the same name are returned once.
+func (c *Config) RouteConfigs() []RouteConfig {
+	var routeConfigs []RouteConfig
+	seen := make(map[string]struct{})
+	for _, l := range c.Listeners {
+		for _, fc := range l.FilterChains {
+			for _, f := range fc.Filters {
+				if f.HttpProxy == nil {
+					continue
+				}
+				rc := f.HttpProxy.RouteConfig
+				if _, ok := seen[rc.Name]; !ok {
+					seen[rc.Name] = struct{}{}
+					routeConfigs = append(routeConfigs, rc)
+				}
+			}
+		}
+	}
+
+	return routeConfigs
+}
+
+// BuildRouteConfigs returns route configurations described by configuration.
+// clusters must contains all clusters returned by BuildClusters.
+func (c *Config) BuildRouteConfigs(clusters []*cds.Cluster) []*rds.RouteConfig {
+	clustersByName := make(map[string]*cds.Cluster, len(clusters))
+	for _, cl := range clusters {
+		clustersByName[cl.Name] = cl
+	}
+
+	var routeConfigs []*rds.RouteConfig
+	for _, rc := range c.RouteConfigs() {
+		routeConfigs = append(routeConfigs, rc.ToRouteConfig(clustersByName))
+	}
+
+	return routeConfigs
+}
+
+// ToRouteConfig converts route configuration to a *rds.RouteConfig.
+func (rc *RouteConfig) ToRouteConfig(clusters map[string]*cds.Cluster) *rds.RouteConfig {
+	routeConfig := &rds.RouteConfig{Name: rc.Name}
+	for _, vh := range rc.VirtualHosts {
+		vhost := rds.VirtualHost{
+			Name:          vh.Name,
+			Domains:       vh.Domains,
+			HttpsRedirect: vh.HttpsRedirect,
+			FilterConfigs: filterConfigs(virtualHostName(rc, &vh), true, vh.LocalRateLimit, vh.RateLimit),
+		}
+		for i, r := range vh.Routes {
+			vhost.Routes = append(vhost.Routes, rds.Route{
+				Name:          r.Name,
+				Prefix:        r.Prefix,
+				Cluster:       clusters[r.Cluster],
+				Priority:      core.RoutingPriority(core.RoutingPriority_value[strings.ToUpper(r.Priority)]),
+				FilterConfigs: filterConfigs(routeName(rc, &vh, i), false, r.LocalRateLimit, r.RateLimit),
+			})
+		}
+		routeConfig.VirtualHosts = append(routeConfig.VirtualHosts, vhost)
+	}
+
+	return routeConfig
+}
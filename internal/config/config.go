@@ -0,0 +1,1098 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config define aegis declarative configuration. It describes services
+// processes and the Envoy listeners and clusters forwarding traffic to them.
+type Config struct {
+	node             `yaml:"-"`
+	Envoy            *Envoy            `yaml:"envoy"`
+	ControlPlane     *ControlPlane     `yaml:"control_plane"`
+	Acme             *Acme             `yaml:"acme"`
+	RateLimitService *RateLimitService `yaml:"rate_limit_service"`
+	Services         []Service         `yaml:"services"`
+	Clusters         []Cluster         `yaml:"clusters"`
+	Listeners        []Listener        `yaml:"listeners"`
+	// path is the path of the file configuration was loaded from, if any.
+	path string
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (c *Config) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Config
+	return decodeMapping(yn, (*plain)(c), &c.node)
+}
+
+// Envoy define how Envoy process is started, restarted and identifies itself
+// to aegis xDS server. StatsConfig, StatsSinks, OverloadManager, RuntimeLayers
+// and Tracing are added to Envoy bootstrap as is, using the Envoy bootstrap
+// YAML format. Envoy is hot restarted when Binary, Args, AdminAddress or
+// bootstrap fields change, NodeId, NodeCluster and Restart changes are applied
+// on aegis restart only.
+type Envoy struct {
+	node            `yaml:"-"`
+	Binary          string           `yaml:"binary"`
+	Args            []string         `yaml:"args"`
+	AdminAddress    string           `yaml:"admin_address"`
+	NodeId          string           `yaml:"node_id"`
+	NodeCluster     string           `yaml:"node_cluster"`
+	Restart         *RestartPolicy   `yaml:"restart"`
+	StatsConfig     map[string]any   `yaml:"stats_config"`
+	StatsSinks      []map[string]any `yaml:"stats_sinks"`
+	OverloadManager map[string]any   `yaml:"overload_manager"`
+	RuntimeLayers   []map[string]any `yaml:"runtime_layers"`
+	Tracing         map[string]any   `yaml:"tracing"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (e *Envoy) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Envoy
+	return decodeMapping(yn, (*plain)(e), &e.node)
+}
+
+// DefaultEnvoy is the Envoy configuration used when none is provided. Admin
+// interface listens on a random port.
+var DefaultEnvoy = Envoy{
+	Binary:       "envoy",
+	AdminAddress: "127.0.0.1:0",
+	NodeId:       "aegis",
+	NodeCluster:  "aegis",
+}
+
+// WithDefaults returns a copy of Envoy configuration with unset fields set to
+// their default value. It can be called on a nil configuration.
+func (e *Envoy) WithDefaults() Envoy {
+	if e == nil {
+		return DefaultEnvoy
+	}
+
+	result := *e
+	if result.Binary == "" {
+		result.Binary = DefaultEnvoy.Binary
+	}
+	if result.AdminAddress == "" {
+		result.AdminAddress = DefaultEnvoy.AdminAddress
+	}
+	if result.NodeId == "" {
+		result.NodeId = DefaultEnvoy.NodeId
+	}
+	if result.NodeCluster == "" {
+		result.NodeCluster = DefaultEnvoy.NodeCluster
+	}
+
+	return result
+}
+
+// Equal reports whether e and other define the same Envoy configuration.
+func (e *Envoy) Equal(other *Envoy) bool {
+	return yamlEqual(e, other)
+}
+
+// ControlPlane define the ADS gRPC server of control-plane mode serving remote
+// Envoy nodes. Configuration is served to nodes whose cluster, or id if
+// NodeHash is "id", matches Envoy node cluster or node id. Address must be a
+// loopback address unless Envoy nodes are authenticated using mTLS. Changes are
+// applied on aegis restart only.
+type ControlPlane struct {
+	node     `yaml:"-"`
+	Address  string           `yaml:"address"`
+	NodeHash string           `yaml:"node_hash"`
+	Tls      *ControlPlaneTls `yaml:"tls"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (cp *ControlPlane) UnmarshalYAML(yn *yaml.Node) error {
+	type plain ControlPlane
+	return decodeMapping(yn, (*plain)(cp), &cp.node)
+}
+
+// ControlPlaneTls define TLS parameters of the control plane gRPC server.
+// Envoy nodes must present a certificate signed by a CA of ClientCaFile if it
+// is set (mTLS).
+type ControlPlaneTls struct {
+	node         `yaml:"-"`
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCaFile string `yaml:"client_ca_file"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (cpt *ControlPlaneTls) UnmarshalYAML(yn *yaml.Node) error {
+	type plain ControlPlaneTls
+	return decodeMapping(yn, (*plain)(cpt), &cpt.node)
+}
+
+// DefaultControlPlane contains default control plane options.
+var DefaultControlPlane = ControlPlane{
+	Address:  "127.0.0.1:18000",
+	NodeHash: "cluster",
+}
+
+// WithDefaults returns a copy of control plane options with unset fields set
+// to their default value. It can be called on a nil options.
+func (cp *ControlPlane) WithDefaults() ControlPlane {
+	if cp == nil {
+		return DefaultControlPlane
+	}
+
+	result := *cp
+	if result.Address == "" {
+		result.Address = DefaultControlPlane.Address
+	}
+	if result.NodeHash == "" {
+		result.NodeHash = DefaultControlPlane.NodeHash
+	}
+
+	return result
+}
+
+// Equal reports whether cp and other define the same control plane options.
+func (cp *ControlPlane) Equal(other *ControlPlane) bool {
+	return yamlEqual(cp, other)
+}
+
+// Acme define automatic certificates management using an ACME CA (e.g. Let's
+// Encrypt). Certificates of Domains are obtained using HTTP-01 challenges,
+// stored in StorageDir and renewed RenewBefore they expire. CaCert is an
+// optional PEM file of CA certificates trusted to connect to the ACME
+// directory. Changes are applied on aegis restart only.
+type Acme struct {
+	node         `yaml:"-"`
+	Email        string        `yaml:"email"`
+	DirectoryUrl string        `yaml:"directory_url"`
+	CaCert       string        `yaml:"ca_cert"`
+	StorageDir   string        `yaml:"storage_dir"`
+	RenewBefore  time.Duration `yaml:"renew_before"`
+	Domains      []string      `yaml:"domains"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (a *Acme) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Acme
+	return decodeMapping(yn, (*plain)(a), &a.node)
+}
+
+// DefaultAcme contains default ACME options.
+var DefaultAcme = Acme{
+	DirectoryUrl: "https://acme-v02.api.letsencrypt.org/directory",
+	StorageDir:   DefaultAcmeStorageDir(),
+	RenewBefore:  30 * 24 * time.Hour,
+}
+
+// DefaultAcmeStorageDir returns default directory where ACME account and
+// certificates are stored.
+func DefaultAcmeStorageDir() string {
+	dir := os.Getenv("XDG_DATA_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return filepath.Join(os.TempDir(), "aegis", "acme")
+		}
+		dir = filepath.Join(home, ".local", "share")
+	}
+	return filepath.Join(dir, "aegis", "acme")
+}
+
+// WithDefaults returns a copy of ACME options with unset fields set to their
+// default value. It can be called on a nil options.
+func (a *Acme) WithDefaults() Acme {
+	if a == nil {
+		return DefaultAcme
+	}
+
+	result := *a
+	if result.DirectoryUrl == "" {
+		result.DirectoryUrl = DefaultAcme.DirectoryUrl
+	}
+	if result.StorageDir == "" {
+		result.StorageDir = DefaultAcme.StorageDir
+	}
+	if result.RenewBefore == 0 {
+		result.RenewBefore = DefaultAcme.RenewBefore
+	}
+
+	return result
+}
+
+// Equal reports whether a and other define the same ACME options.
+func (a *Acme) Equal(other *Acme) bool {
+	return yamlEqual(a, other)
+}
+
+// RateLimitService define the rate limit service embedded in aegis used by
+// rate_limit HTTP filters. Counters are kept in memory unless Redis is set,
+// aegis instances sharing a Redis server enforce the same limits. Changes are
+// applied on aegis restart only.
+type RateLimitService struct {
+	node  `yaml:"-"`
+	Redis *RedisStore `yaml:"redis"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rls *RateLimitService) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RateLimitService
+	return decodeMapping(yn, (*plain)(rls), &rls.node)
+}
+
+// Equal reports whether rls and other define the same rate limit service
+// options.
+func (rls *RateLimitService) Equal(other *RateLimitService) bool {
+	return yamlEqual(rls, other)
+}
+
+// RedisStore define a Redis server storing rate limit counters. Password
+// authenticates connections if it isn't empty, Db is the index of the
+// database storing counters.
+type RedisStore struct {
+	node     `yaml:"-"`
+	Address  string `yaml:"address"`
+	Password string `yaml:"password"`
+	Db       int    `yaml:"db"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rs *RedisStore) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RedisStore
+	return decodeMapping(yn, (*plain)(rs), &rs.node)
+}
+
+// Service define a process started and managed by aegis. A cluster with the
+// same name forwarding traffic to the service is created unless one is
+// declared. Command is parsed as a POSIX shell command line with leading
+// NAME=VALUE words added to the environment, or executed by /bin/sh if Shell
+// is true. CircuitBreakers apply to clusters bound to service without circuit
+// breakers.
+type Service struct {
+	node            `yaml:"-"`
+	Name            string           `yaml:"name"`
+	Command         string           `yaml:"command"`
+	Shell           bool             `yaml:"shell"`
+	Replicas        int              `yaml:"replicas"`
+	Restart         *RestartPolicy   `yaml:"restart"`
+	Readiness       *ReadinessProbe  `yaml:"readiness"`
+	DrainPeriod     time.Duration    `yaml:"drain_period"`
+	CircuitBreakers *CircuitBreakers `yaml:"circuit_breakers"`
+}
+
+// ReplicasOrDefault returns number of service instances to run. It defaults
+// to 1.
+func (s *Service) ReplicasOrDefault() int {
+	return max(s.Replicas, 1)
+}
+
+// DefaultDrainPeriod is the duration replaced service instances keep running
+// after traffic was routed away from them when no drain period is configured.
+const DefaultDrainPeriod = 5 * time.Second
+
+// DrainPeriodOrDefault returns service drain period or DefaultDrainPeriod if
+// none is configured.
+func (s *Service) DrainPeriodOrDefault() time.Duration {
+	if s.DrainPeriod == 0 {
+		return DefaultDrainPeriod
+	}
+	return s.DrainPeriod
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (s *Service) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Service
+	return decodeMapping(yn, (*plain)(s), &s.node)
+}
+
+// Equal reports whether s and other define the same service.
+func (s *Service) Equal(other *Service) bool {
+	return yamlEqual(s, other)
+}
+
+// EqualInstances reports whether s and other start the same instances. Fields
+// only used to build service cluster are ignored.
+func (s *Service) EqualInstances(other *Service) bool {
+	a, b := *s, *other
+	a.CircuitBreakers, b.CircuitBreakers = nil, nil
+	return yamlEqual(&a, &b)
+}
+
+// RestartPolicy define when and how a service is restarted after its process
+// exited. Process is restarted after an exponential backoff delay. If process
+// is restarted more than CrashLoopRestarts times in CrashLoopWindow, it is
+// considered as crash looping and MaxBackoff is used.
+type RestartPolicy struct {
+	node              `yaml:"-"`
+	Policy            string        `yaml:"policy"`
+	MaxRetries        int           `yaml:"max_retries"`
+	InitialBackoff    time.Duration `yaml:"initial_backoff"`
+	MaxBackoff        time.Duration `yaml:"max_backoff"`
+	CrashLoopWindow   time.Duration `yaml:"crash_loop_window"`
+	CrashLoopRestarts int           `yaml:"crash_loop_restarts"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rp *RestartPolicy) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RestartPolicy
+	return decodeMapping(yn, (*plain)(rp), &rp.node)
+}
+
+// Restart policies.
+const (
+	RestartAlways    = "always"
+	RestartOnFailure = "on-failure"
+	RestartNever     = "never"
+)
+
+// DefaultRestartPolicy is the restart policy used for services and Envoy with
+// no restart policy.
+var DefaultRestartPolicy = RestartPolicy{
+	Policy:            RestartOnFailure,
+	MaxRetries:        0,
+	InitialBackoff:    100 * time.Millisecond,
+	MaxBackoff:        30 * time.Second,
+	CrashLoopWindow:   time.Minute,
+	CrashLoopRestarts: 5,
+}
+
+// WithDefaults returns a copy of restart policy with unset fields set to their
+// default value. It can be called on a nil policy.
+func (rp *RestartPolicy) WithDefaults() RestartPolicy {
+	if rp == nil {
+		return DefaultRestartPolicy
+	}
+
+	result := *rp
+	if result.Policy == "" {
+		result.Policy = DefaultRestartPolicy.Policy
+	}
+	if result.InitialBackoff == 0 {
+		result.InitialBackoff = DefaultRestartPolicy.InitialBackoff
+	}
+	if result.MaxBackoff == 0 {
+		result.MaxBackoff = max(DefaultRestartPolicy.MaxBackoff, result.InitialBackoff)
+	}
+	if result.CrashLoopWindow == 0 {
+		result.CrashLoopWindow = DefaultRestartPolicy.CrashLoopWindow
+	}
+	if result.CrashLoopRestarts == 0 {
+		result.CrashLoopRestarts = DefaultRestartPolicy.CrashLoopRestarts
+	}
+
+	return result
+}
+
+// Equal reports whether restart policies are equal.
+func (rp *RestartPolicy) Equal(other *RestartPolicy) bool {
+	return yamlEqual(rp, other)
+}
+
+// ReadinessProbe define a condition that must be met before traffic is routed
+// to a service. At most one probe type must be set, a TCP probe is used if none
+// is. Probe is run every Interval until it succeeds or StartupTimeout expires.
+type ReadinessProbe struct {
+	node           `yaml:"-"`
+	Tcp            *struct{}     `yaml:"tcp"`
+	Http           *HttpProbe    `yaml:"http"`
+	Exec           *ExecProbe    `yaml:"exec"`
+	Interval       time.Duration `yaml:"interval"`
+	StartupTimeout time.Duration `yaml:"startup_timeout"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rp *ReadinessProbe) UnmarshalYAML(yn *yaml.Node) error {
+	type plain ReadinessProbe
+	return decodeMapping(yn, (*plain)(rp), &rp.node)
+}
+
+// DefaultReadinessProbe is the readiness probe used for services with no
+// readiness probe.
+var DefaultReadinessProbe = ReadinessProbe{
+	Tcp:            &struct{}{},
+	Interval:       100 * time.Millisecond,
+	StartupTimeout: 30 * time.Second,
+}
+
+// WithDefaults returns a copy of readiness probe with unset fields set to
+// their default value. It can be called on a nil probe.
+func (rp *ReadinessProbe) WithDefaults() ReadinessProbe {
+	if rp == nil {
+		return DefaultReadinessProbe
+	}
+
+	result := *rp
+	if result.Tcp == nil && result.Http == nil && result.Exec == nil {
+		result.Tcp = DefaultReadinessProbe.Tcp
+	}
+	if result.Http != nil && result.Http.Status == 0 {
+		http := *result.Http
+		http.Status = DefaultHttpProbeStatus
+		result.Http = &http
+	}
+	if result.Interval == 0 {
+		result.Interval = DefaultReadinessProbe.Interval
+	}
+	if result.StartupTimeout == 0 {
+		result.StartupTimeout = DefaultReadinessProbe.StartupTimeout
+	}
+
+	return result
+}
+
+// HttpProbe define a readiness probe that succeeds once an HTTP GET request
+// on Path returns Status.
+type HttpProbe struct {
+	node   `yaml:"-"`
+	Path   string `yaml:"path"`
+	Status int    `yaml:"status"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (hp *HttpProbe) UnmarshalYAML(yn *yaml.Node) error {
+	type plain HttpProbe
+	return decodeMapping(yn, (*plain)(hp), &hp.node)
+}
+
+// DefaultHttpProbeStatus is the status expected by HTTP probes with no status.
+const DefaultHttpProbeStatus = 200
+
+// ExecProbe define a readiness probe that succeeds once Command exits with a
+// zero exit code. Command is parsed as a service command.
+type ExecProbe struct {
+	node    `yaml:"-"`
+	Command string `yaml:"command"`
+	Shell   bool   `yaml:"shell"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ep *ExecProbe) UnmarshalYAML(yn *yaml.Node) error {
+	type plain ExecProbe
+	return decodeMapping(yn, (*plain)(ep), &ep.node)
+}
+
+// Cluster define a group of upstream hosts. Hosts are either instances of a
+// service or static endpoints.
+type Cluster struct {
+	node            `yaml:"-"`
+	Name            string           `yaml:"name"`
+	Service         string           `yaml:"service"`
+	Endpoints       []string         `yaml:"endpoints"`
+	ConnectTimeout  time.Duration    `yaml:"connect_timeout"`
+	LbPolicy        string           `yaml:"lb_policy"`
+	TcpKeepAlive    *TcpKeepAlive    `yaml:"tcp_keepalive"`
+	Tls             *UpstreamTls     `yaml:"tls"`
+	CircuitBreakers *CircuitBreakers `yaml:"circuit_breakers"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (c *Cluster) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Cluster
+	return decodeMapping(yn, (*plain)(c), &c.node)
+}
+
+// CircuitBreakers define thresholds of connections and requests to cluster
+// hosts. Default thresholds apply to requests of routes with default priority
+// and High ones to requests of routes with high priority. Unset High
+// thresholds default to Default ones.
+type CircuitBreakers struct {
+	node    `yaml:"-"`
+	Default *CircuitBreakerThresholds `yaml:"default"`
+	High    *CircuitBreakerThresholds `yaml:"high"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (cb *CircuitBreakers) UnmarshalYAML(yn *yaml.Node) error {
+	type plain CircuitBreakers
+	return decodeMapping(yn, (*plain)(cb), &cb.node)
+}
+
+// WithDefaults returns a copy of circuit breakers with unset thresholds set to
+// the ones of defaults for Default and the ones of Default for High. It can
+// be called on nil circuit breakers.
+func (cb *CircuitBreakers) WithDefaults(defaults CircuitBreakerThresholds) CircuitBreakers {
+	var result CircuitBreakers
+	if cb != nil {
+		result = *cb
+	}
+
+	def := result.Default.WithDefaults(defaults)
+	high := result.High.WithDefaults(def)
+	result.Default, result.High = &def, &high
+
+	return result
+}
+
+// CircuitBreakerThresholds define maximum number of connections, pending
+// requests, requests and retries to cluster hosts. Nil fields are unset and
+// zero ones disable what they limit, e.g. a zero MaxRetries disables retries.
+// If RetryBudget is set, MaxRetries is ignored.
+type CircuitBreakerThresholds struct {
+	node               `yaml:"-"`
+	MaxConnections     *uint32      `yaml:"max_connections"`
+	MaxPendingRequests *uint32      `yaml:"max_pending_requests"`
+	MaxRequests        *uint32      `yaml:"max_requests"`
+	MaxRetries         *uint32      `yaml:"max_retries"`
+	RetryBudget        *RetryBudget `yaml:"retry_budget"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (cbt *CircuitBreakerThresholds) UnmarshalYAML(yn *yaml.Node) error {
+	type plain CircuitBreakerThresholds
+	return decodeMapping(yn, (*plain)(cbt), &cbt.node)
+}
+
+// DefaultCircuitBreakerThresholds are the circuit breakers thresholds of
+// clusters of static endpoints. They're the same as Envoy defaults.
+var DefaultCircuitBreakerThresholds = CircuitBreakerThresholds{
+	MaxConnections:     ptr[uint32](1024),
+	MaxPendingRequests: ptr[uint32](1024),
+	MaxRequests:        ptr[uint32](1024),
+	MaxRetries:         ptr[uint32](3),
+}
+
+// DefaultServiceCircuitBreakerThresholds are the circuit breakers thresholds
+// of clusters bound to a service for each service instance. They're lower
+// than Envoy defaults so a single process isn't overloaded.
+var DefaultServiceCircuitBreakerThresholds = CircuitBreakerThresholds{
+	MaxConnections:     ptr[uint32](256),
+	MaxPendingRequests: ptr[uint32](128),
+	MaxRequests:        ptr[uint32](256),
+	MaxRetries:         ptr[uint32](3),
+}
+
+// WithDefaults returns a copy of thresholds with unset fields set to their
+// value in defaults. It can be called on nil thresholds.
+func (cbt *CircuitBreakerThresholds) WithDefaults(defaults CircuitBreakerThresholds) CircuitBreakerThresholds {
+	if cbt == nil {
+		return defaults
+	}
+
+	result := *cbt
+	if result.MaxConnections == nil {
+		result.MaxConnections = defaults.MaxConnections
+	}
+	if result.MaxPendingRequests == nil {
+		result.MaxPendingRequests = defaults.MaxPendingRequests
+	}
+	if result.MaxRequests == nil {
+		result.MaxRequests = defaults.MaxRequests
+	}
+	if result.MaxRetries == nil {
+		result.MaxRetries = defaults.MaxRetries
+	}
+	if result.RetryBudget == nil {
+		result.RetryBudget = defaults.RetryBudget
+	} else {
+		budget := result.RetryBudget.WithDefaults()
+		result.RetryBudget = &budget
+	}
+
+	return result
+}
+
+// scale returns a copy of thresholds with limits multiplied by n.
+func (cbt CircuitBreakerThresholds) scale(n int) CircuitBreakerThresholds {
+	for _, limit := range []**uint32{&cbt.MaxConnections, &cbt.MaxPendingRequests, &cbt.MaxRequests} {
+		if *limit != nil {
+			*limit = ptr(**limit * uint32(n))
+		}
+	}
+	return cbt
+}
+
+// RetryBudget limits concurrent retries to BudgetPercent percent of active
+// requests, with at least MinRetryConcurrency retries allowed. Nil fields are
+// unset.
+type RetryBudget struct {
+	node                `yaml:"-"`
+	BudgetPercent       *float64 `yaml:"budget_percent"`
+	MinRetryConcurrency *uint32  `yaml:"min_retry_concurrency"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rb *RetryBudget) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RetryBudget
+	return decodeMapping(yn, (*plain)(rb), &rb.node)
+}
+
+// DefaultRetryBudget is the retry budget used for unset retry budget fields.
+// It is the same as Envoy default.
+var DefaultRetryBudget = RetryBudget{
+	BudgetPercent:       ptr(20.0),
+	MinRetryConcurrency: ptr[uint32](3),
+}
+
+// WithDefaults returns a copy of retry budget with unset fields set to their
+// default value.
+func (rb *RetryBudget) WithDefaults() RetryBudget {
+	result := *rb
+	if result.BudgetPercent == nil {
+		result.BudgetPercent = DefaultRetryBudget.BudgetPercent
+	}
+	if result.MinRetryConcurrency == nil {
+		result.MinRetryConcurrency = DefaultRetryBudget.MinRetryConcurrency
+	}
+
+	return result
+}
+
+// UpstreamTls define TLS parameters of connections to cluster endpoints.
+// Endpoints certificates are verified against CA certificates of CaFile if
+// set. Certificate is an optional client certificate.
+type UpstreamTls struct {
+	node        `yaml:"-"`
+	Sni         string          `yaml:"sni"`
+	CaFile      string          `yaml:"ca_file"`
+	Certificate *TlsCertificate `yaml:"certificate"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (ut *UpstreamTls) UnmarshalYAML(yn *yaml.Node) error {
+	type plain UpstreamTls
+	return decodeMapping(yn, (*plain)(ut), &ut.node)
+}
+
+// TcpKeepAlive define cluster TCP keep alive options.
+type TcpKeepAlive struct {
+	node     `yaml:"-"`
+	Probes   uint32 `yaml:"probes"`
+	Time     uint32 `yaml:"time"`
+	Interval uint32 `yaml:"interval"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (tka *TcpKeepAlive) UnmarshalYAML(yn *yaml.Node) error {
+	type plain TcpKeepAlive
+	return decodeMapping(yn, (*plain)(tka), &tka.node)
+}
+
+// Listener define a named network location clients connect to. Tls contains
+// default TLS parameters of filter chains terminating TLS.
+type Listener struct {
+	node         `yaml:"-"`
+	Name         string        `yaml:"name"`
+	Address      string        `yaml:"address"`
+	Tls          *Tls          `yaml:"tls"`
+	FilterChains []FilterChain `yaml:"filter_chains"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (l *Listener) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Listener
+	return decodeMapping(yn, (*plain)(l), &l.node)
+}
+
+// FilterChain define an ordered list of listener filters. Chain is selected
+// for TLS connections whose SNI matches one of ServerNames or for all
+// connections if ServerNames is empty. TLS is terminated if chain or listener
+// has TLS certificates.
+type FilterChain struct {
+	node        `yaml:"-"`
+	ServerNames []string `yaml:"server_names"`
+	Tls         *Tls     `yaml:"tls"`
+	Filters     []Filter `yaml:"filters"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (fc *FilterChain) UnmarshalYAML(yn *yaml.Node) error {
+	type plain FilterChain
+	return decodeMapping(yn, (*plain)(fc), &fc.node)
+}
+
+// Tls define TLS termination parameters. MinVersion is one of "1.0", "1.1",
+// "1.2" or "1.3", Envoy default is used if empty.
+type Tls struct {
+	node         `yaml:"-"`
+	Certificates []TlsCertificate `yaml:"certificates"`
+	MinVersion   string           `yaml:"min_version"`
+	CipherSuites []string         `yaml:"cipher_suites"`
+	Alpn         []string         `yaml:"alpn"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (t *Tls) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Tls
+	return decodeMapping(yn, (*plain)(t), &t.node)
+}
+
+// Merge returns a copy of TLS parameters with unset fields set to the ones of
+// defaults. Both t and defaults can be nil.
+func (t *Tls) Merge(defaults *Tls) *Tls {
+	if t == nil {
+		return defaults
+	}
+	if defaults == nil {
+		return t
+	}
+
+	result := *t
+	if len(result.Certificates) == 0 {
+		result.Certificates = defaults.Certificates
+	}
+	if result.MinVersion == "" {
+		result.MinVersion = defaults.MinVersion
+	}
+	if len(result.CipherSuites) == 0 {
+		result.CipherSuites = defaults.CipherSuites
+	}
+	if len(result.Alpn) == 0 {
+		result.Alpn = defaults.Alpn
+	}
+
+	return &result
+}
+
+// TlsCertificate define a PEM encoded certificate chain and private key files
+// or a certificate managed by aegis ACME client for domain Acme.
+type TlsCertificate struct {
+	node     `yaml:"-"`
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	Acme     string `yaml:"acme"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (tc *TlsCertificate) UnmarshalYAML(yn *yaml.Node) error {
+	type plain TlsCertificate
+	return decodeMapping(yn, (*plain)(tc), &tc.node)
+}
+
+// Filter define a listener filter. Exactly one field must be set.
+type Filter struct {
+	node      `yaml:"-"`
+	HttpProxy *HttpProxyFilter `yaml:"http_proxy"`
+	TcpProxy  *TcpProxyFilter  `yaml:"tcp_proxy"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (f *Filter) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Filter
+	return decodeMapping(yn, (*plain)(f), &f.node)
+}
+
+// HttpProxyFilter define a listener filter processing HTTP streams.
+type HttpProxyFilter struct {
+	node        `yaml:"-"`
+	HttpFilters []HttpFilter `yaml:"http_filters"`
+	RouteConfig RouteConfig  `yaml:"route_config"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (hpf *HttpProxyFilter) UnmarshalYAML(yn *yaml.Node) error {
+	type plain HttpProxyFilter
+	return decodeMapping(yn, (*plain)(hpf), &hpf.node)
+}
+
+// TcpProxyFilter define a listener filter forwarding TCP connections to a
+// cluster.
+type TcpProxyFilter struct {
+	node    `yaml:"-"`
+	Cluster string `yaml:"cluster"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (tpf *TcpProxyFilter) UnmarshalYAML(yn *yaml.Node) error {
+	type plain TcpProxyFilter
+	return decodeMapping(yn, (*plain)(tpf), &tpf.node)
+}
+
+// HttpFilter define a filter processing HTTP streams. Exactly one field must
+// be set. A filter without options can be written as a plain string (e.g.
+// "router").
+type HttpFilter struct {
+	node           `yaml:"-"`
+	Router         *struct{}             `yaml:"router"`
+	LocalRateLimit *LocalRateLimitFilter `yaml:"local_rate_limit"`
+	RateLimit      *RateLimitFilter      `yaml:"rate_limit"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (hf *HttpFilter) UnmarshalYAML(yn *yaml.Node) error {
+	if yn.Kind == yaml.ScalarNode {
+		yn = &yaml.Node{
+			Kind:   yaml.MappingNode,
+			Line:   yn.Line,
+			Column: yn.Column,
+			Content: []*yaml.Node{
+				yn,
+				{Kind: yaml.MappingNode, Line: yn.Line, Column: yn.Column},
+			},
+		}
+	}
+
+	type plain HttpFilter
+	return decodeMapping(yn, (*plain)(hf), &hf.node)
+}
+
+// LocalRateLimitFilter define an HTTP filter rejecting requests with a 429
+// status once its token bucket is empty. If TokenBucket is nil, only requests
+// of virtual hosts and routes with a local rate limit are limited.
+// ResponseBody replaces body of rejected requests responses.
+type LocalRateLimitFilter struct {
+	node         `yaml:"-"`
+	TokenBucket  *TokenBucket `yaml:"token_bucket"`
+	ResponseBody string       `yaml:"response_body"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (lrlf *LocalRateLimitFilter) UnmarshalYAML(yn *yaml.Node) error {
+	type plain LocalRateLimitFilter
+	return decodeMapping(yn, (*plain)(lrlf), &lrlf.node)
+}
+
+// TokenBucket define a bucket of MaxTokens tokens refilled with TokensPerFill
+// tokens every FillInterval. Each request consumes a token. TokensPerFill
+// defaults to MaxTokens and FillInterval to a second.
+type TokenBucket struct {
+	node          `yaml:"-"`
+	MaxTokens     uint32        `yaml:"max_tokens"`
+	TokensPerFill uint32        `yaml:"tokens_per_fill"`
+	FillInterval  time.Duration `yaml:"fill_interval"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (tb *TokenBucket) UnmarshalYAML(yn *yaml.Node) error {
+	type plain TokenBucket
+	return decodeMapping(yn, (*plain)(tb), &tb.node)
+}
+
+// DefaultFillInterval is the fill interval of token buckets with no fill
+// interval.
+const DefaultFillInterval = time.Second
+
+// WithDefaults returns a copy of token bucket with unset fields set to their
+// default value.
+func (tb *TokenBucket) WithDefaults() TokenBucket {
+	result := *tb
+	if result.TokensPerFill == 0 {
+		result.TokensPerFill = result.MaxTokens
+	}
+	if result.FillInterval == 0 {
+		result.FillInterval = DefaultFillInterval
+	}
+
+	return result
+}
+
+// LocalRateLimit define local rate limit of a virtual host or route. Requests
+// matching one of Descriptors consume tokens of descriptor bucket, other
+// requests consume tokens of TokenBucket.
+type LocalRateLimit struct {
+	node        `yaml:"-"`
+	TokenBucket TokenBucket                `yaml:"token_bucket"`
+	Descriptors []LocalRateLimitDescriptor `yaml:"descriptors"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (lrl *LocalRateLimit) UnmarshalYAML(yn *yaml.Node) error {
+	type plain LocalRateLimit
+	return decodeMapping(yn, (*plain)(lrl), &lrl.node)
+}
+
+// LocalRateLimitDescriptor define a token bucket of requests from client IP
+// or CIDR prefix RemoteAddress, with header Header.Name equal to Header.Value
+// and whose path starts with Path. At least one of them must be set, requests
+// must match all set fields. Requests matching a descriptor share its bucket,
+// use a RateLimitDescriptor to limit each client IP separately.
+type LocalRateLimitDescriptor struct {
+	node          `yaml:"-"`
+	RemoteAddress string       `yaml:"remote_address"`
+	Header        *HeaderMatch `yaml:"header"`
+	Path          string       `yaml:"path"`
+	TokenBucket   TokenBucket  `yaml:"token_bucket"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (lrld *LocalRateLimitDescriptor) UnmarshalYAML(yn *yaml.Node) error {
+	type plain LocalRateLimitDescriptor
+	return decodeMapping(yn, (*plain)(lrld), &lrld.node)
+}
+
+// HeaderMatch define an HTTP header value.
+type HeaderMatch struct {
+	node  `yaml:"-"`
+	Name  string `yaml:"name"`
+	Value string `yaml:"value"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (hm *HeaderMatch) UnmarshalYAML(yn *yaml.Node) error {
+	type plain HeaderMatch
+	return decodeMapping(yn, (*plain)(hm), &hm.node)
+}
+
+// RateLimitFilter define an HTTP filter rejecting requests with a 429 status
+// once aegis rate limit service reports one of their descriptors is over
+// limit. Requests are allowed if rate limit service doesn't answer within
+// Timeout, unless FailureModeDeny is true. ResponseBody replaces body of
+// rejected requests responses.
+type RateLimitFilter struct {
+	node            `yaml:"-"`
+	Timeout         time.Duration `yaml:"timeout"`
+	FailureModeDeny bool          `yaml:"failure_mode_deny"`
+	ResponseBody    string        `yaml:"response_body"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rlf *RateLimitFilter) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RateLimitFilter
+	return decodeMapping(yn, (*plain)(rlf), &rlf.node)
+}
+
+// RateLimit define rules of aegis rate limit service for requests of a
+// virtual host or route.
+type RateLimit struct {
+	node        `yaml:"-"`
+	Descriptors []RateLimitDescriptor `yaml:"descriptors"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rl *RateLimit) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RateLimit
+	return decodeMapping(yn, (*plain)(rl), &rl.node)
+}
+
+// RateLimitDescriptor limits requests from client IP or CIDR prefix
+// RemoteAddress, with header Header.Name equal to Header.Value and whose path
+// starts with Path to RequestsPerUnit requests per Unit (second, minute, hour
+// or day). At least one of them must be set, requests must match all set
+// fields. If RemoteAddress is "*" or Header.Value is empty, each client IP or
+// header value has its own limit.
+type RateLimitDescriptor struct {
+	node            `yaml:"-"`
+	RemoteAddress   string       `yaml:"remote_address"`
+	Header          *HeaderMatch `yaml:"header"`
+	Path            string       `yaml:"path"`
+	RequestsPerUnit uint32       `yaml:"requests_per_unit"`
+	Unit            string       `yaml:"unit"`
+}
+
+// AnyRemoteAddress is the remote address of rate limit descriptors limiting
+// each client IP separately.
+const AnyRemoteAddress = "*"
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rld *RateLimitDescriptor) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RateLimitDescriptor
+	return decodeMapping(yn, (*plain)(rld), &rld.node)
+}
+
+// RouteConfig define HTTP route configuration.
+type RouteConfig struct {
+	node         `yaml:"-"`
+	Name         string        `yaml:"name"`
+	VirtualHosts []VirtualHost `yaml:"virtual_hosts"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (rc *RouteConfig) UnmarshalYAML(yn *yaml.Node) error {
+	type plain RouteConfig
+	return decodeMapping(yn, (*plain)(rc), &rc.node)
+}
+
+// VirtualHost define a virtual HTTP host. If HttpsRedirect is true, plain
+// HTTP requests are redirected to HTTPS and routes may be omitted.
+// LocalRateLimit overrides local rate limit filter token bucket for routes of
+// virtual host. RateLimit applies to routes of virtual host without one.
+type VirtualHost struct {
+	node           `yaml:"-"`
+	Name           string          `yaml:"name"`
+	Domains        []string        `yaml:"domains"`
+	Routes         []Route         `yaml:"routes"`
+	HttpsRedirect  bool            `yaml:"https_redirect"`
+	LocalRateLimit *LocalRateLimit `yaml:"local_rate_limit"`
+	RateLimit      *RateLimit      `yaml:"rate_limit"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (vh *VirtualHost) UnmarshalYAML(yn *yaml.Node) error {
+	type plain VirtualHost
+	return decodeMapping(yn, (*plain)(vh), &vh.node)
+}
+
+// Route define an HTTP route forwarding requests matching Prefix to Cluster.
+// Priority selects circuit breakers thresholds of cluster, it is either
+// "default" or "high". LocalRateLimit overrides local rate limit of listener
+// and virtual host, RateLimit overrides rate limit of virtual host.
+type Route struct {
+	node           `yaml:"-"`
+	Name           string          `yaml:"name"`
+	Prefix         string          `yaml:"prefix"`
+	Cluster        string          `yaml:"cluster"`
+	Priority       string          `yaml:"priority"`
+	LocalRateLimit *LocalRateLimit `yaml:"local_rate_limit"`
+	RateLimit      *RateLimit      `yaml:"rate_limit"`
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler.
+func (r *Route) UnmarshalYAML(yn *yaml.Node) error {
+	type plain Route
+	return decodeMapping(yn, (*plain)(r), &r.node)
+}
+
+// Route priorities.
+const (
+	RoutePriorityDefault = "default"
+	RoutePriorityHigh    = "high"
+)
+
+// Load reads, parses and validates configuration file at the given path.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read configuration file: %w", err)
+	}
+
+	cfg, err := Parse(data)
+	if err != nil {
+		return nil, withFile(err, path)
+	}
+	cfg.path = path
+
+	return cfg, nil
+}
+
+// Parse parses and validates the given YAML configuration.
+func Parse(data []byte) (*Config, error) {
+	cfg := &Config{}
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	err := dec.Decode(cfg)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// withFile sets File field of *Error contained in err.
+func withFile(err error, path string) error {
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		for _, e := range joined.Unwrap() {
+			_ = withFile(e, path)
+		}
+		return err
+	}
+
+	var cfgErr *Error
+	if errors.As(err, &cfgErr) {
+		cfgErr.File = path
+		return err
+	}
+
+	return fmt.Errorf("%v: %w", path, err)
+}
+
+// ptr returns a pointer to v.
+func ptr[T any](v T) *T {
+	return &v
+}
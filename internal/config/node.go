@@ -0,0 +1,141 @@
+package config
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Error define a configuration error located in a configuration file.
+type Error struct {
+	File   string
+	Line   int
+	Column int
+	Field  string
+	Err    error
+}
+
+// Error implements error.
+func (e *Error) Error() string {
+	file := e.File
+	if file == "" {
+		file = "<config>"
+	}
+	if e.Field == "" {
+		return fmt.Sprintf("%v:%v:%v: %v", file, e.Line, e.Column, e.Err)
+	}
+	return fmt.Sprintf("%v:%v:%v: %v: %v", file, e.Line, e.Column, e.Field, e.Err)
+}
+
+// Unwrap returns underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+type position struct {
+	line   int
+	column int
+}
+
+// node stores position of a YAML mapping and of its keys. It is embedded in
+// configuration structs to report errors at the right location.
+type node struct {
+	position
+	keys map[string]position
+}
+
+// errorf returns an *Error located at the given key of the mapping or at the
+// mapping itself if key is absent. field is the path of the mapping in the
+// configuration.
+func (n node) errorf(field, key string, format string, args ...any) *Error {
+	pos, ok := n.keys[key]
+	if !ok {
+		pos = n.position
+	}
+	if key != "" {
+		field = joinField(field, key)
+	}
+
+	return &Error{
+		Line:   pos.line,
+		Column: pos.column,
+		Field:  field,
+		Err:    fmt.Errorf(format, args...),
+	}
+}
+
+func joinField(parent, child string) string {
+	if parent == "" {
+		return child
+	}
+	return parent + "." + child
+}
+
+// decodeMapping decodes YAML mapping yn into v and records positions in n. It
+// returns an error if mapping contains a key that doesn't match any field of v.
+func decodeMapping(yn *yaml.Node, v any, n *node) error {
+	n.position = position{yn.Line, yn.Column}
+	if yn.Kind != yaml.MappingNode {
+		return &Error{
+			Line:   yn.Line,
+			Column: yn.Column,
+			Err:    fmt.Errorf("expected a mapping"),
+		}
+	}
+
+	fields := yamlFields(reflect.TypeOf(v).Elem())
+	n.keys = make(map[string]position, len(yn.Content)/2)
+	for i := 0; i < len(yn.Content); i += 2 {
+		key := yn.Content[i]
+		if _, ok := fields[key.Value]; !ok {
+			return &Error{
+				Line:   key.Line,
+				Column: key.Column,
+				Field:  key.Value,
+				Err:    fmt.Errorf("unknown field"),
+			}
+		}
+		n.keys[key.Value] = position{key.Line, key.Column}
+	}
+
+	return yn.Decode(v)
+}
+
+// yamlFields returns set of YAML keys of struct type t.
+func yamlFields(t reflect.Type) map[string]struct{} {
+	fields := make(map[string]struct{}, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("yaml"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = struct{}{}
+	}
+
+	return fields
+}
+
+// yamlEqual reports whether a and b have the same YAML representation.
+// Positions are ignored.
+func yamlEqual(a, b any) bool {
+	aData, err := yaml.Marshal(a)
+	if err != nil {
+		panic(err)
+	}
+	bData, err := yaml.Marshal(b)
+	if err != nil {
+		panic(err)
+	}
+
+	return bytes.Equal(aData, bData)
+}
@@ -0,0 +1,706 @@
+package config
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	"github.com/negrel/aegis/internal/shlex"
+	"github.com/negrel/aegis/internal/xnet"
+)
+
+// Validate validates configuration and returns all errors found.
+func (c *Config) Validate() error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if c.Envoy != nil {
+		errs = append(errs, c.Envoy.validate("envoy")...)
+	}
+	if c.ControlPlane != nil {
+		errs = append(errs, c.ControlPlane.validate("control_plane")...)
+	}
+	if c.RateLimitService != nil {
+		errs = append(errs, c.RateLimitService.validate("rate_limit_service")...)
+	}
+	acmeDomains := make(map[string]struct{})
+	if c.Acme != nil {
+		errs = append(errs, c.Acme.validate("acme")...)
+		for _, d := range c.Acme.Domains {
+			acmeDomains[d] = struct{}{}
+		}
+	}
+
+	services := make(map[string]struct{})
+	for i, s := range c.Services {
+		field := fmt.Sprintf("services[%v]", i)
+		if s.Name == "" {
+			addErr(s.errorf(field, "name", "must not be empty"))
+		} else if _, ok := services[s.Name]; ok {
+			addErr(s.errorf(field, "name", "duplicate service %q", s.Name))
+		}
+		services[s.Name] = struct{}{}
+
+		if err := validateCommand(s.Command, s.Shell); err != nil {
+			addErr(s.errorf(field, "command", "%v", err))
+		}
+		if s.Restart != nil {
+			errs = append(errs, s.Restart.validate(joinField(field, "restart"))...)
+		}
+		if s.Replicas < 0 {
+			addErr(s.errorf(field, "replicas", "must be positive"))
+		}
+		if s.DrainPeriod < 0 {
+			addErr(s.errorf(field, "drain_period", "must be positive"))
+		}
+		if s.Readiness != nil {
+			errs = append(errs, s.Readiness.validate(joinField(field, "readiness"))...)
+		}
+		if s.CircuitBreakers != nil {
+			errs = append(errs, s.CircuitBreakers.validate(joinField(field, "circuit_breakers"))...)
+		}
+	}
+
+	clusters := make(map[string]struct{})
+	for i, cl := range c.Clusters {
+		field := fmt.Sprintf("clusters[%v]", i)
+		if cl.Name == "" {
+			addErr(cl.errorf(field, "name", "must not be empty"))
+		} else if _, ok := clusters[cl.Name]; ok {
+			addErr(cl.errorf(field, "name", "duplicate cluster %q", cl.Name))
+		}
+		clusters[cl.Name] = struct{}{}
+
+		switch {
+		case cl.Service != "" && len(cl.Endpoints) > 0:
+			addErr(cl.errorf(field, "endpoints", "service and endpoints are mutually exclusive"))
+		case cl.Service == "" && len(cl.Endpoints) == 0:
+			addErr(cl.errorf(field, "", "either service or endpoints must be set"))
+		case cl.Service != "":
+			if _, ok := services[cl.Service]; !ok {
+				addErr(cl.errorf(field, "service", "unknown service %q", cl.Service))
+			}
+		}
+		for j, e := range cl.Endpoints {
+			if _, err := netip.ParseAddrPort(e); err != nil {
+				addErr(cl.errorf(field, "endpoints", "invalid endpoint %v %q: must be an IP:PORT address", j, e))
+			}
+		}
+
+		if cl.ConnectTimeout < 0 {
+			addErr(cl.errorf(field, "connect_timeout", "must be positive"))
+		}
+		if cl.LbPolicy != "" {
+			if _, ok := cluster.Cluster_LbPolicy_value[strings.ToUpper(cl.LbPolicy)]; !ok {
+				addErr(cl.errorf(field, "lb_policy", "unknown load balancing policy %q", cl.LbPolicy))
+			}
+		}
+		if cl.Tls != nil && cl.Tls.Certificate != nil {
+			field := joinField(field, "tls")
+			errs = append(errs, cl.Tls.Certificate.validate(joinField(field, "certificate"), acmeDomains)...)
+		}
+		if cl.CircuitBreakers != nil {
+			errs = append(errs, cl.CircuitBreakers.validate(joinField(field, "circuit_breakers"))...)
+		}
+	}
+	for _, s := range c.Services {
+		clusters[s.Name] = struct{}{}
+	}
+
+	listeners := make(map[string]struct{})
+	routeConfigs := make(map[string]*RouteConfig)
+	for i, l := range c.Listeners {
+		field := fmt.Sprintf("listeners[%v]", i)
+		if l.Name == "" {
+			addErr(l.errorf(field, "name", "must not be empty"))
+		} else if _, ok := listeners[l.Name]; ok {
+			addErr(l.errorf(field, "name", "duplicate listener %q", l.Name))
+		}
+		listeners[l.Name] = struct{}{}
+
+		if _, err := netip.ParseAddrPort(l.Address); err != nil {
+			addErr(l.errorf(field, "address", "invalid address %q: must be an IP:PORT address", l.Address))
+		}
+		if len(l.FilterChains) == 0 {
+			addErr(l.errorf(field, "filter_chains", "must not be empty"))
+		}
+		if l.Tls != nil {
+			errs = append(errs, l.Tls.validate(joinField(field, "tls"), acmeDomains)...)
+		}
+
+		serverNames := make(map[string]struct{})
+		matchAll := false
+		for j, fc := range l.FilterChains {
+			field := joinField(field, fmt.Sprintf("filter_chains[%v]", j))
+			if len(fc.Filters) == 0 {
+				addErr(fc.errorf(field, "filters", "must not be empty"))
+			}
+			if fc.Tls != nil {
+				errs = append(errs, fc.Tls.validate(joinField(field, "tls"), acmeDomains)...)
+			}
+			if len(fc.ServerNames) == 0 {
+				if matchAll {
+					addErr(fc.errorf(field, "", "only one filter chain without server_names is allowed"))
+				}
+				matchAll = true
+			} else if tls := fc.Tls.Merge(l.Tls); tls == nil || len(tls.Certificates) == 0 {
+				addErr(fc.errorf(field, "server_names", "TLS certificates are required to match server names"))
+			}
+			for _, name := range fc.ServerNames {
+				if _, ok := serverNames[name]; ok {
+					addErr(fc.errorf(field, "server_names", "duplicate server name %q", name))
+				}
+				serverNames[name] = struct{}{}
+			}
+			for k, f := range fc.Filters {
+				field := joinField(field, fmt.Sprintf("filters[%v]", k))
+				errs = append(errs, f.validate(field, clusters)...)
+				if f.HttpProxy == nil {
+					continue
+				}
+				// Route configurations are shared over RDS by name.
+				rc := &f.HttpProxy.RouteConfig
+				if other, ok := routeConfigs[rc.Name]; ok && !yamlEqual(rc, other) {
+					field := joinField(field, "http_proxy.route_config")
+					addErr(rc.errorf(field, "name", "route configuration %q is declared multiple times with different content", rc.Name))
+				}
+				routeConfigs[rc.Name] = rc
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// ValidateControlPlane returns an error if configuration uses features that
+// require Envoy to run next to aegis: services, which listen on loopback
+// interface, ACME and the rate_limit filter backed by aegis rate limit
+// service.
+func (c *Config) ValidateControlPlane() error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if len(c.Services) > 0 {
+		addErr(c.errorf("", "services", "services listen on loopback interface and aren't reachable by remote envoy nodes in control-plane mode"))
+	}
+	if c.Acme != nil {
+		addErr(c.errorf("", "acme", "acme isn't supported in control-plane mode"))
+	}
+	for i, l := range c.Listeners {
+		for j, fc := range l.FilterChains {
+			for k, f := range fc.Filters {
+				if f.HttpProxy == nil {
+					continue
+				}
+				for m, hf := range f.HttpProxy.HttpFilters {
+					if hf.RateLimit != nil {
+						field := fmt.Sprintf("listeners[%v].filter_chains[%v].filters[%v].http_proxy.http_filters[%v]", i, j, k, m)
+						addErr(hf.errorf(field, "rate_limit", "rate_limit filter isn't supported in control-plane mode"))
+					}
+				}
+			}
+		}
+	}
+
+	err := errors.Join(errs...)
+	if err != nil && c.path != "" {
+		return withFile(err, c.path)
+	}
+	return err
+}
+
+func (f *Filter) validate(field string, clusters map[string]struct{}) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	switch {
+	case f.HttpProxy != nil && f.TcpProxy != nil:
+		addErr(f.errorf(field, "", "only one filter type must be set"))
+
+	case f.HttpProxy != nil:
+		field := joinField(field, "http_proxy")
+		hpf := f.HttpProxy
+		localRateLimit, rateLimit := false, false
+		for i, hf := range hpf.HttpFilters {
+			field := joinField(field, fmt.Sprintf("http_filters[%v]", i))
+			types := 0
+			for _, set := range []bool{hf.Router != nil, hf.LocalRateLimit != nil, hf.RateLimit != nil} {
+				if set {
+					types++
+				}
+			}
+			switch {
+			case types > 1:
+				addErr(hf.errorf(field, "", "only one filter type must be set"))
+			case hf.Router != nil:
+				if i != len(hpf.HttpFilters)-1 {
+					addErr(hf.errorf(field, "router", "router must be the last filter"))
+				}
+			case hf.LocalRateLimit != nil:
+				if localRateLimit {
+					addErr(hf.errorf(field, "local_rate_limit", "duplicate local_rate_limit filter"))
+				}
+				localRateLimit = true
+				if tb := hf.LocalRateLimit.TokenBucket; tb != nil {
+					errs = append(errs, tb.validate(joinField(field, "local_rate_limit.token_bucket"))...)
+				}
+			case hf.RateLimit != nil:
+				if rateLimit {
+					addErr(hf.errorf(field, "rate_limit", "duplicate rate_limit filter"))
+				}
+				rateLimit = true
+				if hf.RateLimit.Timeout < 0 {
+					addErr(hf.RateLimit.errorf(joinField(field, "rate_limit"), "timeout", "must be positive"))
+				}
+			default:
+				addErr(hf.errorf(field, "", "filter type must be set"))
+			}
+		}
+		validateRateLimits := func(field string, lrl *LocalRateLimit, rl *RateLimit) {
+			if lrl != nil {
+				field := joinField(field, "local_rate_limit")
+				if !localRateLimit {
+					addErr(lrl.errorf(field, "", "local_rate_limit http filter is required"))
+				}
+				errs = append(errs, lrl.validate(field)...)
+			}
+			if rl != nil {
+				field := joinField(field, "rate_limit")
+				if !rateLimit {
+					addErr(rl.errorf(field, "", "rate_limit http filter is required"))
+				}
+				errs = append(errs, rl.validate(field)...)
+			}
+		}
+
+		rc := &hpf.RouteConfig
+		field = joinField(field, "route_config")
+		if rc.Name == "" {
+			addErr(rc.errorf(field, "name", "must not be empty"))
+		}
+		if len(rc.VirtualHosts) == 0 {
+			addErr(rc.errorf(field, "virtual_hosts", "must not be empty"))
+		}
+		domains := make(map[string]struct{})
+		for i, vh := range rc.VirtualHosts {
+			field := joinField(field, fmt.Sprintf("virtual_hosts[%v]", i))
+			if vh.Name == "" {
+				addErr(vh.errorf(field, "name", "must not be empty"))
+			}
+			if len(vh.Domains) == 0 {
+				addErr(vh.errorf(field, "domains", "must not be empty"))
+			}
+			for _, d := range vh.Domains {
+				if _, ok := domains[d]; ok {
+					addErr(vh.errorf(field, "domains", "duplicate domain %q", d))
+				}
+				domains[d] = struct{}{}
+			}
+			if len(vh.Routes) == 0 && !vh.HttpsRedirect {
+				addErr(vh.errorf(field, "routes", "must not be empty"))
+			}
+			validateRateLimits(field, vh.LocalRateLimit, vh.RateLimit)
+			prefixes := make(map[string]struct{}, len(vh.Routes))
+			for j, r := range vh.Routes {
+				field := joinField(field, fmt.Sprintf("routes[%v]", j))
+				if r.Prefix != "" && !strings.HasPrefix(r.Prefix, "/") {
+					addErr(r.errorf(field, "prefix", "must start with a '/'"))
+				}
+				prefix := cmp.Or(r.Prefix, "/")
+				if _, ok := prefixes[prefix]; ok {
+					addErr(r.errorf(field, "prefix", "duplicate prefix %q, route is unreachable", prefix))
+				}
+				prefixes[prefix] = struct{}{}
+				if _, ok := clusters[r.Cluster]; !ok {
+					addErr(r.errorf(field, "cluster", "unknown cluster %q", r.Cluster))
+				}
+				switch r.Priority {
+				case "", RoutePriorityDefault, RoutePriorityHigh:
+				default:
+					addErr(r.errorf(field, "priority", "unknown priority %q, expected %q or %q",
+						r.Priority, RoutePriorityDefault, RoutePriorityHigh))
+				}
+				validateRateLimits(field, r.LocalRateLimit, r.RateLimit)
+			}
+		}
+
+	case f.TcpProxy != nil:
+		if _, ok := clusters[f.TcpProxy.Cluster]; !ok {
+			addErr(f.TcpProxy.errorf(joinField(field, "tcp_proxy"), "cluster", "unknown cluster %q", f.TcpProxy.Cluster))
+		}
+
+	default:
+		addErr(f.errorf(field, "", "filter type must be set"))
+	}
+
+	return errs
+}
+
+// minFillInterval is the minimum fill interval of Envoy token buckets.
+const minFillInterval = 50 * time.Millisecond
+
+func (tb *TokenBucket) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if tb.MaxTokens == 0 {
+		addErr(tb.errorf(field, "max_tokens", "must be greater than 0"))
+	}
+	if tb.FillInterval != 0 && tb.FillInterval < minFillInterval {
+		addErr(tb.errorf(field, "fill_interval", "must be at least %v", minFillInterval))
+	}
+
+	return errs
+}
+
+func (lrl *LocalRateLimit) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	errs = append(errs, lrl.TokenBucket.validate(joinField(field, "token_bucket"))...)
+	fillInterval := lrl.TokenBucket.WithDefaults().FillInterval
+	for i, d := range lrl.Descriptors {
+		field := joinField(field, fmt.Sprintf("descriptors[%v]", i))
+		errs = append(errs, validateRateLimitDescriptor(d.node, field, d.RemoteAddress, d.Header, d.Path, false)...)
+		errs = append(errs, d.TokenBucket.validate(joinField(field, "token_bucket"))...)
+		if fi := d.TokenBucket.WithDefaults().FillInterval; fi%fillInterval != 0 {
+			addErr(d.TokenBucket.errorf(joinField(field, "token_bucket"), "fill_interval", "must be a multiple of local rate limit fill_interval (%v)", fillInterval))
+		}
+	}
+
+	return errs
+}
+
+func (rl *RateLimit) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if len(rl.Descriptors) == 0 {
+		addErr(rl.errorf(field, "descriptors", "must not be empty"))
+	}
+	for i, d := range rl.Descriptors {
+		field := joinField(field, fmt.Sprintf("descriptors[%v]", i))
+		errs = append(errs, validateRateLimitDescriptor(d.node, field, d.RemoteAddress, d.Header, d.Path, true)...)
+		if d.RequestsPerUnit == 0 {
+			addErr(d.errorf(field, "requests_per_unit", "must be greater than 0"))
+		}
+		switch d.Unit {
+		case "second", "minute", "hour", "day":
+		default:
+			addErr(d.errorf(field, "unit", "unknown unit %q, expected \"second\", \"minute\", \"hour\" or \"day\"", d.Unit))
+		}
+	}
+
+	return errs
+}
+
+// validateRateLimitDescriptor validates rate limit descriptor fields of
+// mapping n. If wildcard is true, remote address may be AnyRemoteAddress and
+// header value may be empty.
+func validateRateLimitDescriptor(n node, field string, remoteAddress string, header *HeaderMatch, path string, wildcard bool) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if remoteAddress == "" && header == nil && path == "" {
+		addErr(n.errorf(field, "", "one of remote_address, header or path must be set"))
+	}
+	if remoteAddress != "" && (!wildcard || remoteAddress != AnyRemoteAddress) {
+		_, addrErr := netip.ParseAddr(remoteAddress)
+		_, prefixErr := netip.ParsePrefix(remoteAddress)
+		if addrErr != nil && prefixErr != nil {
+			addErr(n.errorf(field, "remote_address", "invalid IP address or CIDR prefix %q", remoteAddress))
+		}
+	}
+	if header != nil {
+		if header.Name == "" {
+			addErr(header.errorf(joinField(field, "header"), "name", "must not be empty"))
+		}
+		if header.Value == "" && !wildcard {
+			addErr(header.errorf(joinField(field, "header"), "value", "must not be empty"))
+		}
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		addErr(n.errorf(field, "path", "must start with a '/'"))
+	}
+
+	return errs
+}
+
+func (t *Tls) validate(field string, acmeDomains map[string]struct{}) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if _, ok := tlsVersions[t.MinVersion]; !ok {
+		addErr(t.errorf(field, "min_version", "unknown TLS version %q, expected \"1.0\", \"1.1\", \"1.2\" or \"1.3\"", t.MinVersion))
+	}
+	for i, c := range t.Certificates {
+		errs = append(errs, c.validate(joinField(field, fmt.Sprintf("certificates[%v]", i)), acmeDomains)...)
+	}
+	for _, p := range t.Alpn {
+		if p == "" {
+			addErr(t.errorf(field, "alpn", "protocol must not be empty"))
+		}
+	}
+
+	return errs
+}
+
+func (tc *TlsCertificate) validate(field string, acmeDomains map[string]struct{}) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if tc.Acme != "" {
+		if tc.CertFile != "" || tc.KeyFile != "" {
+			addErr(tc.errorf(field, "acme", "acme and cert_file/key_file are mutually exclusive"))
+		}
+		if _, ok := acmeDomains[tc.Acme]; !ok {
+			addErr(tc.errorf(field, "acme", "domain %q is not an acme domain", tc.Acme))
+		}
+		return errs
+	}
+	if tc.CertFile == "" {
+		addErr(tc.errorf(field, "cert_file", "must not be empty"))
+	}
+	if tc.KeyFile == "" {
+		addErr(tc.errorf(field, "key_file", "must not be empty"))
+	}
+
+	return errs
+}
+
+func (a *Acme) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if len(a.Domains) == 0 {
+		addErr(a.errorf(field, "domains", "must not be empty"))
+	}
+	domains := make(map[string]struct{})
+	for _, d := range a.Domains {
+		switch {
+		case d == "":
+			addErr(a.errorf(field, "domains", "domain must not be empty"))
+		case strings.Contains(d, "*"):
+			addErr(a.errorf(field, "domains", "wildcard domain %q can't be validated using HTTP-01 challenges", d))
+		case !xnet.IsHostname(d):
+			addErr(a.errorf(field, "domains", "invalid domain %q", d))
+		}
+		if _, ok := domains[d]; ok {
+			addErr(a.errorf(field, "domains", "duplicate domain %q", d))
+		}
+		domains[d] = struct{}{}
+	}
+	if a.DirectoryUrl != "" && !strings.HasPrefix(a.DirectoryUrl, "https://") && !strings.HasPrefix(a.DirectoryUrl, "http://") {
+		addErr(a.errorf(field, "directory_url", "invalid URL %q", a.DirectoryUrl))
+	}
+	if a.RenewBefore < 0 {
+		addErr(a.errorf(field, "renew_before", "must be positive"))
+	}
+
+	return errs
+}
+
+func (rls *RateLimitService) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if rs := rls.Redis; rs != nil {
+		field := joinField(field, "redis")
+		if _, _, err := net.SplitHostPort(rs.Address); err != nil {
+			addErr(rs.errorf(field, "address", "invalid address %q: must be a HOST:PORT address", rs.Address))
+		}
+		if rs.Db < 0 {
+			addErr(rs.errorf(field, "db", "must be positive"))
+		}
+	}
+
+	return errs
+}
+
+func (cp *ControlPlane) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	if cp.Address != "" {
+		addr, err := netip.ParseAddrPort(cp.Address)
+		if err != nil {
+			addErr(cp.errorf(field, "address", "invalid address %q: must be an IP:PORT address", cp.Address))
+		} else if !addr.Addr().IsLoopback() && (cp.Tls == nil || cp.Tls.ClientCaFile == "") {
+			addErr(cp.errorf(field, "address", "non loopback address %q requires tls with a client_ca_file (mTLS)", cp.Address))
+		}
+	}
+	switch cp.NodeHash {
+	case "", "id", "cluster":
+	default:
+		addErr(cp.errorf(field, "node_hash", "unknown node hash %q, expected \"id\" or \"cluster\"", cp.NodeHash))
+	}
+	if t := cp.Tls; t != nil {
+		field := joinField(field, "tls")
+		if t.CertFile == "" {
+			addErr(t.errorf(field, "cert_file", "must not be empty"))
+		}
+		if t.KeyFile == "" {
+			addErr(t.errorf(field, "key_file", "must not be empty"))
+		}
+	}
+
+	return errs
+}
+
+func (e *Envoy) validate(field string) []error {
+	var errs []error
+	if e.AdminAddress != "" {
+		if _, err := netip.ParseAddrPort(e.AdminAddress); err != nil {
+			errs = append(errs, e.errorf(field, "admin_address", "invalid address %q: must be an IP:PORT address", e.AdminAddress))
+		}
+	}
+	if e.Restart != nil {
+		errs = append(errs, e.Restart.validate(joinField(field, "restart"))...)
+	}
+	_, bootstrapErrs := e.bootstrapProto(field)
+	errs = append(errs, bootstrapErrs...)
+
+	return errs
+}
+
+func (cb *CircuitBreakers) validate(field string) []error {
+	var errs []error
+	if cb.Default != nil {
+		errs = append(errs, cb.Default.validate(joinField(field, "default"))...)
+	}
+	if cb.High != nil {
+		errs = append(errs, cb.High.validate(joinField(field, "high"))...)
+	}
+
+	return errs
+}
+
+func (cbt *CircuitBreakerThresholds) validate(field string) []error {
+	var errs []error
+	if rb := cbt.RetryBudget; rb != nil && rb.BudgetPercent != nil && (*rb.BudgetPercent < 0 || *rb.BudgetPercent > 100) {
+		errs = append(errs, rb.errorf(joinField(field, "retry_budget"), "budget_percent", "must be between 0 and 100"))
+	}
+
+	return errs
+}
+
+func (rp *RestartPolicy) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	switch rp.Policy {
+	case "", RestartAlways, RestartOnFailure, RestartNever:
+	default:
+		addErr(rp.errorf(field, "policy", "unknown restart policy %q, expected %q, %q or %q",
+			rp.Policy, RestartAlways, RestartOnFailure, RestartNever))
+	}
+	if rp.MaxRetries < 0 {
+		addErr(rp.errorf(field, "max_retries", "must be positive"))
+	}
+	if rp.InitialBackoff < 0 {
+		addErr(rp.errorf(field, "initial_backoff", "must be positive"))
+	}
+	if rp.MaxBackoff < 0 {
+		addErr(rp.errorf(field, "max_backoff", "must be positive"))
+	} else if rp.MaxBackoff != 0 && rp.MaxBackoff < rp.InitialBackoff {
+		addErr(rp.errorf(field, "max_backoff", "must be greater than initial_backoff"))
+	}
+	if rp.CrashLoopWindow < 0 {
+		addErr(rp.errorf(field, "crash_loop_window", "must be positive"))
+	}
+	if rp.CrashLoopRestarts < 0 {
+		addErr(rp.errorf(field, "crash_loop_restarts", "must be positive"))
+	}
+
+	return errs
+}
+
+func (rp *ReadinessProbe) validate(field string) []error {
+	var errs []error
+	addErr := func(err *Error) {
+		errs = append(errs, err)
+	}
+
+	probes := 0
+	for _, set := range []bool{rp.Tcp != nil, rp.Http != nil, rp.Exec != nil} {
+		if set {
+			probes++
+		}
+	}
+	if probes > 1 {
+		addErr(rp.errorf(field, "", "only one probe type must be set"))
+	}
+
+	if rp.Http != nil {
+		field := joinField(field, "http")
+		if !strings.HasPrefix(rp.Http.Path, "/") {
+			addErr(rp.Http.errorf(field, "path", "must start with a '/'"))
+		}
+		if rp.Http.Status != 0 && (rp.Http.Status < 100 || rp.Http.Status > 599) {
+			addErr(rp.Http.errorf(field, "status", "invalid HTTP status %v", rp.Http.Status))
+		}
+	}
+	if rp.Exec != nil {
+		if err := validateCommand(rp.Exec.Command, rp.Exec.Shell); err != nil {
+			addErr(rp.Exec.errorf(joinField(field, "exec"), "command", "%v", err))
+		}
+	}
+	if rp.Interval < 0 {
+		addErr(rp.errorf(field, "interval", "must be positive"))
+	}
+	if rp.StartupTimeout < 0 {
+		addErr(rp.errorf(field, "startup_timeout", "must be positive"))
+	}
+
+	return errs
+}
+
+func validateCommand(command string, shell bool) error {
+	if shell {
+		if strings.TrimSpace(command) == "" {
+			return fmt.Errorf("must not be empty")
+		}
+		return nil
+	}
+
+	_, args, err := shlex.SplitCommand(command, nil)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("must not be empty")
+	}
+
+	return nil
+}
@@ -0,0 +1,250 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+// listener returns a listener configuration proxying HTTP requests with the
+// given http filters and virtual host fields.
+func listener(httpFilters, virtualHost string) string {
+	return `
+listeners:
+  - name: entrypoint
+    address: 0.0.0.0:8080
+    filter_chains:
+      - filters:
+          - http_proxy:
+              http_filters: ` + httpFilters + `
+              route_config:
+                name: entrypoint
+                virtual_hosts:
+                  - name: default
+                    domains: ["*"]
+` + virtualHost
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		err    string
+	}{
+		{
+			name: "Valid",
+			config: `
+services:
+  - name: api
+    command: ./api --port=$PORT
+` + listener("[router]", `
+                    routes:
+                      - prefix: /
+                        cluster: api
+`),
+		},
+		{
+			name: "DuplicateService",
+			config: `
+services:
+  - { name: api, command: ./api }
+  - { name: api, command: ./api }
+`,
+			err: `<config>:4:7: services[1].name: duplicate service "api"`,
+		},
+		{
+			name: "DuplicatePrefix",
+			config: `
+services:
+  - { name: api, command: ./api }
+` + listener("[router]", `
+                    routes:
+                      - { prefix: /, cluster: api }
+                      - { prefix: /, cluster: api }
+`),
+			err: `listeners[0].filter_chains[0].filters[0].http_proxy.route_config.virtual_hosts[0].routes[1].prefix: duplicate prefix "/", route is unreachable`,
+		},
+		{
+			name: "UnknownCluster",
+			config: listener("[router]", `
+                    routes:
+                      - { prefix: /, cluster: api }
+`),
+			err: `listeners[0].filter_chains[0].filters[0].http_proxy.route_config.virtual_hosts[0].routes[0].cluster: unknown cluster "api"`,
+		},
+		{
+			name: "AcmeInvalidDomain",
+			config: `
+acme:
+  email: admin@example.com
+  domains: [api.example.com, "api example.com"]
+`,
+			err: `<config>:4:3: acme.domains: invalid domain "api example.com"`,
+		},
+		{
+			name: "ControlPlaneLoopback",
+			config: `
+control_plane:
+  address: 127.0.0.1:18000
+`,
+		},
+		{
+			name: "ControlPlaneNonLoopbackWithoutMtls",
+			config: `
+control_plane:
+  address: 0.0.0.0:18000
+`,
+			err: `<config>:3:3: control_plane.address: non loopback address "0.0.0.0:18000" requires tls with a client_ca_file (mTLS)`,
+		},
+		{
+			name: "LocalRateLimitCidr",
+			config: `
+services:
+  - { name: api, command: ./api }
+` + listener("[local_rate_limit, router]", `
+                    local_rate_limit:
+                      token_bucket: { max_tokens: 100, fill_interval: 1s }
+                      descriptors:
+                        - remote_address: 198.51.100.0/24
+                          token_bucket: { max_tokens: 50 }
+                    routes:
+                      - { prefix: /, cluster: api }
+`),
+		},
+		{
+			name: "LocalRateLimitInvalidRemoteAddress",
+			config: `
+services:
+  - { name: api, command: ./api }
+` + listener("[local_rate_limit, router]", `
+                    local_rate_limit:
+                      token_bucket: { max_tokens: 100, fill_interval: 1s }
+                      descriptors:
+                        - remote_address: 198.51.100.0/33
+                          token_bucket: { max_tokens: 50 }
+                    routes:
+                      - { prefix: /, cluster: api }
+`),
+			err: `remote_address: invalid IP address or CIDR prefix "198.51.100.0/33"`,
+		},
+		{
+			name: "LocalRateLimitFillInterval",
+			config: `
+services:
+  - { name: api, command: ./api }
+` + listener("[local_rate_limit, router]", `
+                    local_rate_limit:
+                      token_bucket: { max_tokens: 100, fill_interval: 1ms }
+                    routes:
+                      - { prefix: /, cluster: api }
+`),
+			err: `local_rate_limit.token_bucket.fill_interval: must be at least`,
+		},
+		{
+			name: "RateLimitCidr",
+			config: `
+services:
+  - { name: api, command: ./api }
+` + listener("[rate_limit, router]", `
+                    rate_limit:
+                      descriptors:
+                        - remote_address: 2001:db8::/32
+                          requests_per_unit: 100
+                          unit: second
+                    routes:
+                      - { prefix: /, cluster: api }
+`),
+		},
+		{
+			name: "EnvoyBootstrap",
+			config: `
+envoy:
+  stats_sinks:
+    - name: envoy.stat_sinks.statsd
+      typed_config:
+        "@type": type.googleapis.com/envoy.config.metrics.v3.StatsdSink
+        address: { socket_address: { address: 127.0.0.1, port_value: 8125 } }
+  runtime_layers:
+    - name: static
+      static_layer: { overload.global_downstream_max_connections: 50000 }
+`,
+		},
+		{
+			name: "EnvoyBootstrapUnknownField",
+			config: `
+envoy:
+  tracing: { provider: { name: envoy.tracers.zipkin }, sampling: 1 }
+`,
+			err: `<config>:3:3: envoy.tracing: invalid envoy tracing: proto:`,
+		},
+		{
+			name: "CircuitBreakerBudgetPercent",
+			config: `
+clusters:
+  - name: api
+    endpoints: [127.0.0.1:8000]
+    circuit_breakers:
+      default:
+        max_retries: 0
+        retry_budget: { budget_percent: 120 }
+`,
+			err: `clusters[0].circuit_breakers.default.retry_budget.budget_percent: must be between 0 and 100`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := Parse([]byte(test.config))
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestValidateControlPlane(t *testing.T) {
+	cfg, err := Parse([]byte(`
+services:
+  - { name: api, command: ./api }
+acme:
+  email: admin@example.com
+  domains: [api.example.com]
+` + listener("[rate_limit, router]", `
+                    routes:
+                      - { prefix: /, cluster: api }
+`)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	err = cfg.ValidateControlPlane()
+	expected := []string{
+		"<config>:2:1: services: services listen on loopback interface and aren't reachable by remote envoy nodes in control-plane mode",
+		"<config>:4:1: acme: acme isn't supported in control-plane mode",
+		"<config>:14:30: listeners[0].filter_chains[0].filters[0].http_proxy.http_filters[0].rate_limit: rate_limit filter isn't supported in control-plane mode",
+	}
+	if err == nil || err.Error() != strings.Join(expected, "\n") {
+		t.Fatalf("expected error %q, got %v", strings.Join(expected, "\n"), err)
+	}
+
+	cfg, err = Parse([]byte(`
+clusters:
+  - name: api
+    endpoints: [127.0.0.1:8000]
+` + listener("[router]", `
+                    routes:
+                      - { prefix: /, cluster: api }
+`)))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	err = cfg.ValidateControlPlane()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
@@ -6,9 +6,12 @@ import (
 	"google.golang.org/protobuf/types/known/structpb"
 )
 
-// MustMarshalAny marshal given data or panic.
+// MustMarshalAny marshal given data or panic. Data is marshaled
+// deterministically so resources embedding it can be versioned by content
+// hash.
 func MustMarshalAny(pb interface{}) *anypb.Any {
-	msg, err := anypb.New(pb.(proto.Message))
+	msg := &anypb.Any{}
+	err := anypb.MarshalFrom(msg, pb.(proto.Message), proto.MarshalOptions{Deterministic: true})
 	if err != nil {
 		panic(err)
 	}
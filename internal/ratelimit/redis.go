@@ -0,0 +1,259 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// redisMaxIdleConns is the maximum number of idle connections kept by
+// RedisStore.
+const redisMaxIdleConns = 8
+
+// redisIncrementScript increments counter KEYS[1] by ARGV[1] and sets its
+// expiration to ARGV[2] milliseconds if it has none. Scripts run atomically
+// so a counter can't expire between both commands and be recreated without
+// expiration.
+const redisIncrementScript = `local count = redis.call("INCRBY", KEYS[1], ARGV[1])
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return count`
+
+// RedisOptions define options of a RedisStore.
+type RedisOptions struct {
+	// Address is the HOST:PORT address of Redis server.
+	Address string
+	// Password is used to authenticate connections if it isn't empty.
+	Password string
+	// Db is the index of the Redis database storing counters.
+	Db int
+	// DialTimeout is the maximum duration to establish a connection.
+	DialTimeout time.Duration
+}
+
+// RedisStore is a Store backed by a Redis server. Aegis instances sharing the
+// same server enforce the same limits. Counters are incremented and given
+// their expiration atomically by a Lua script.
+type RedisStore struct {
+	opts RedisOptions
+
+	mu   sync.Mutex
+	idle []*redisConn
+}
+
+var _ Store = (*RedisStore)(nil)
+
+// NewRedisStore returns a new store backed by the Redis server of opts.
+// Connections are established lazily.
+func NewRedisStore(opts RedisOptions) *RedisStore {
+	return &RedisStore{opts: opts}
+}
+
+// Increment implements Store.
+func (rs *RedisStore) Increment(ctx context.Context, key string, hits uint64, expiration time.Duration) (uint64, error) {
+	conn, err := rs.conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+
+	ms := strconv.FormatInt(max(expiration.Milliseconds(), 1), 10)
+	replies, err := conn.do(ctx,
+		[]string{"EVAL", redisIncrementScript, "1", key, strconv.FormatUint(hits, 10), ms},
+	)
+	if err != nil {
+		conn.Close()
+		return 0, fmt.Errorf("redis request failed: %w", err)
+	}
+	rs.release(conn)
+
+	count, ok := replies[0].(int64)
+	if !ok || count < 0 {
+		return 0, fmt.Errorf("unexpected redis EVAL reply %v", replies[0])
+	}
+	return uint64(count), nil
+}
+
+// Close closes idle connections.
+func (rs *RedisStore) Close() error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	var errs []error
+	for _, conn := range rs.idle {
+		errs = append(errs, conn.Close())
+	}
+	rs.idle = nil
+
+	return errors.Join(errs...)
+}
+
+// conn returns an idle connection or establishes a new one.
+func (rs *RedisStore) conn(ctx context.Context) (*redisConn, error) {
+	rs.mu.Lock()
+	if n := len(rs.idle); n > 0 {
+		conn := rs.idle[n-1]
+		rs.idle = rs.idle[:n-1]
+		rs.mu.Unlock()
+		return conn, nil
+	}
+	rs.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: rs.opts.DialTimeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", rs.opts.Address)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+
+	var cmds [][]string
+	if rs.opts.Password != "" {
+		cmds = append(cmds, []string{"AUTH", rs.opts.Password})
+	}
+	if rs.opts.Db != 0 {
+		cmds = append(cmds, []string{"SELECT", strconv.Itoa(rs.opts.Db)})
+	}
+	if len(cmds) > 0 {
+		_, err = conn.do(ctx, cmds...)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+// release returns conn to idle connections or closes it if there are too
+// many.
+func (rs *RedisStore) release(conn *redisConn) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if len(rs.idle) >= redisMaxIdleConns {
+		conn.Close()
+		return
+	}
+	rs.idle = append(rs.idle, conn)
+}
+
+// redisConn is a connection to a Redis server speaking RESP2.
+// See https://redis.io/docs/latest/develop/reference/protocol-spec/
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// redisError is an error reply of Redis server.
+type redisError string
+
+// Error implements error.
+func (re redisError) Error() string {
+	return string(re)
+}
+
+// do sends pipelined commands and returns their replies. Replies are int64,
+// string, nil or []any values. An error is returned if a command failed.
+func (rc *redisConn) do(ctx context.Context, cmds ...[]string) ([]any, error) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = rc.SetDeadline(deadline)
+	} else {
+		_ = rc.SetDeadline(time.Time{})
+	}
+
+	var buf []byte
+	for _, args := range cmds {
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(args)), 10)
+		buf = append(buf, '\r', '\n')
+		for _, arg := range args {
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+			buf = append(buf, '\r', '\n')
+			buf = append(buf, arg...)
+			buf = append(buf, '\r', '\n')
+		}
+	}
+	_, err := rc.Write(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	replies := make([]any, len(cmds))
+	var errs []error
+	for i := range cmds {
+		replies[i], err = rc.readReply()
+		var re redisError
+		if errors.As(err, &re) {
+			errs = append(errs, fmt.Errorf("%v: %w", cmds[i][0], err))
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return replies, errors.Join(errs...)
+}
+
+func (rc *redisConn) readReply() (any, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		_, err = io.ReadFull(rc.r, data)
+		if err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			items[i], err = rc.readReply()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("unexpected redis reply %q", line)
+	}
+}
+
+func (rc *redisConn) readLine() (string, error) {
+	line, err := rc.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("malformed redis reply %q", line)
+	}
+	return line[:len(line)-2], nil
+}
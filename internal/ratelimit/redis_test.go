@@ -0,0 +1,192 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is a Redis server supporting the commands used by RedisStore.
+// EVAL only runs redisIncrementScript.
+type fakeRedis struct {
+	mu     sync.Mutex
+	values map[string]int64
+	// ttls contains expiration in milliseconds of keys that have one.
+	ttls     map[string]int64
+	commands []string
+}
+
+func startFakeRedis(t *testing.T) (*fakeRedis, string) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	t.Cleanup(func() { lis.Close() })
+
+	fr := &fakeRedis{values: make(map[string]int64), ttls: make(map[string]int64)}
+	go func() {
+		for {
+			conn, err := lis.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(conn)
+		}
+	}()
+
+	return fr, lis.Addr().String()
+}
+
+func (fr *fakeRedis) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+
+		fr.mu.Lock()
+		if strings.ToUpper(args[0]) == "EVAL" {
+			fr.commands = append(fr.commands, strings.Join(append([]string{"EVAL"}, args[2:]...), " "))
+		} else {
+			fr.commands = append(fr.commands, strings.Join(args, " "))
+		}
+		var reply string
+		switch strings.ToUpper(args[0]) {
+		case "AUTH":
+			if args[1] == "secret" {
+				reply = "+OK\r\n"
+			} else {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case "SELECT":
+			reply = "+OK\r\n"
+		case "EVAL":
+			if args[1] != redisIncrementScript || args[2] != "1" {
+				reply = "-ERR unknown script\r\n"
+				break
+			}
+			key := args[3]
+			n, _ := strconv.ParseInt(args[4], 10, 64)
+			fr.values[key] += n
+			if _, ok := fr.ttls[key]; !ok {
+				fr.ttls[key], _ = strconv.ParseInt(args[5], 10, 64)
+			}
+			reply = fmt.Sprintf(":%v\r\n", fr.values[key])
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		fr.mu.Unlock()
+
+		_, err = io.WriteString(conn, reply)
+		if err != nil {
+			return
+		}
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:size])
+	}
+
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	fr, addr := startFakeRedis(t)
+	store := NewRedisStore(RedisOptions{Address: addr, Password: "secret", Db: 2, DialTimeout: time.Second})
+	defer store.Close()
+
+	for i, hits := range []uint64{1, 2, 3} {
+		count, err := store.Increment(context.Background(), "aegis|remote_address=192.0.2.1", hits, 1500*time.Millisecond)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if expected := []uint64{1, 3, 6}[i]; count != expected {
+			t.Fatalf("expected count %v, got %v", expected, count)
+		}
+	}
+
+	// Connection is authenticated and reused.
+	expected := []string{
+		"AUTH secret",
+		"SELECT 2",
+		"EVAL 1 aegis|remote_address=192.0.2.1 1 1500",
+		"EVAL 1 aegis|remote_address=192.0.2.1 2 1500",
+		"EVAL 1 aegis|remote_address=192.0.2.1 3 1500",
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if strings.Join(fr.commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected commands %q, got %q", expected, fr.commands)
+	}
+	if ttl := fr.ttls["aegis|remote_address=192.0.2.1"]; ttl != 1500 {
+		t.Fatalf("expected 1500ms expiration, got %v", ttl)
+	}
+}
+
+func TestRedisStoreCounterWithoutExpiration(t *testing.T) {
+	fr, addr := startFakeRedis(t)
+	store := NewRedisStore(RedisOptions{Address: addr})
+	defer store.Close()
+
+	// Counter expired and was recreated without expiration.
+	fr.mu.Lock()
+	fr.values["key"] = 5
+	fr.mu.Unlock()
+
+	count, err := store.Increment(context.Background(), "key", 1, time.Second)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if count != 6 {
+		t.Fatalf("expected count 6, got %v", count)
+	}
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	if ttl, ok := fr.ttls["key"]; !ok || ttl != 1000 {
+		t.Fatalf("expected 1000ms expiration, got %v", ttl)
+	}
+}
+
+func TestRedisStoreAuthError(t *testing.T) {
+	_, addr := startFakeRedis(t)
+	store := NewRedisStore(RedisOptions{Address: addr, Password: "wrong"})
+	defer store.Close()
+
+	_, err := store.Increment(context.Background(), "key", 1, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Fatalf("expected authentication error, got %v", err)
+	}
+}
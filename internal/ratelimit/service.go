@@ -0,0 +1,242 @@
+// Package ratelimit implements Envoy global rate limit service. Requests
+// descriptors are matched against rules using the same semantics as
+// https://github.com/envoyproxy/ratelimit and limited using fixed window
+// counters.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	commonratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	rlsconf "github.com/envoyproxy/go-control-plane/ratelimit/config/ratelimit/v3"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+// Service implements Envoy RateLimitService. Each request descriptor is
+// matched against rules of request domain: entries are matched in order
+// against nested rule descriptors with the same key and value, or with the
+// same key and an empty value. In the latter case, each entry value has its
+// own counter. Descriptors without matching rule aren't limited.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/service/ratelimit/v3/rls.proto
+type Service struct {
+	rls.UnimplementedRateLimitServiceServer
+	logger     *slog.Logger
+	store      Store
+	grpcServer *grpc.Server
+
+	mu      sync.RWMutex
+	domains map[string]*rlsconf.RateLimitConfig
+}
+
+var _ rls.RateLimitServiceServer = (*Service)(nil)
+
+// NewService returns a new rate limit service with no rules storing counters
+// in store. If store is nil, counters are stored in memory.
+func NewService(logger *slog.Logger, store Store, opts ...grpc.ServerOption) *Service {
+	if store == nil {
+		store = NewMemoryStore()
+	}
+
+	s := &Service{
+		logger:     logger,
+		store:      store,
+		grpcServer: grpc.NewServer(opts...),
+		domains:    make(map[string]*rlsconf.RateLimitConfig),
+	}
+	rls.RegisterRateLimitServiceServer(s.grpcServer, s)
+
+	return s
+}
+
+// Serve accepts incoming connections on the listener lis. It returns when lis
+// is closed or service is stopped.
+func (s *Service) Serve(lis net.Listener) error {
+	return s.grpcServer.Serve(lis)
+}
+
+// GracefulStop stops service gRPC server gracefully.
+func (s *Service) GracefulStop() {
+	s.grpcServer.GracefulStop()
+}
+
+// SetConfigs replaces rate limit rules. An error is returned and rules are
+// left untouched if configs are invalid.
+func (s *Service) SetConfigs(configs []*rlsconf.RateLimitConfig) error {
+	domains := make(map[string]*rlsconf.RateLimitConfig, len(configs))
+	var errs []error
+	for _, cfg := range configs {
+		if cfg.Domain == "" {
+			errs = append(errs, fmt.Errorf("rate limit config %q: domain must not be empty", cfg.Name))
+		} else if _, ok := domains[cfg.Domain]; ok {
+			errs = append(errs, fmt.Errorf("rate limit config %q: duplicate domain %q", cfg.Name, cfg.Domain))
+		}
+		domains[cfg.Domain] = cfg
+		errs = append(errs, validateDescriptors(cfg.Domain, cfg.Descriptors)...)
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domains = domains
+
+	return nil
+}
+
+func validateDescriptors(path string, descriptors []*rlsconf.RateLimitDescriptor) []error {
+	var errs []error
+	seen := make(map[string]struct{}, len(descriptors))
+	for _, d := range descriptors {
+		if d.Key == "" {
+			errs = append(errs, fmt.Errorf("%v: descriptor key must not be empty", path))
+			continue
+		}
+		path := path + "." + d.Key + "_" + d.Value
+		if _, ok := seen[path]; ok {
+			errs = append(errs, fmt.Errorf("%v: duplicate descriptor", path))
+		}
+		seen[path] = struct{}{}
+
+		if rl := d.RateLimit; rl != nil && !rl.Unlimited {
+			if _, ok := unitDurations[rl.Unit]; !ok {
+				errs = append(errs, fmt.Errorf("%v: unknown rate limit unit %v", path, rl.Unit))
+			}
+		}
+		errs = append(errs, validateDescriptors(path, d.Descriptors)...)
+	}
+
+	return errs
+}
+
+// unitDurations maps rate limit units to their duration.
+var unitDurations = map[rlsconf.RateLimitUnit]time.Duration{
+	rlsconf.RateLimitUnit_SECOND: time.Second,
+	rlsconf.RateLimitUnit_MINUTE: time.Minute,
+	rlsconf.RateLimitUnit_HOUR:   time.Hour,
+	rlsconf.RateLimitUnit_DAY:    24 * time.Hour,
+}
+
+// ShouldRateLimit implements rls.RateLimitServiceServer.
+func (s *Service) ShouldRateLimit(ctx context.Context, req *rls.RateLimitRequest) (*rls.RateLimitResponse, error) {
+	s.mu.RLock()
+	cfg := s.domains[req.Domain]
+	s.mu.RUnlock()
+
+	resp := &rls.RateLimitResponse{
+		OverallCode: rls.RateLimitResponse_OK,
+		Statuses:    make([]*rls.RateLimitResponse_DescriptorStatus, len(req.Descriptors)),
+	}
+	now := time.Now()
+	for i, d := range req.Descriptors {
+		st, err := s.shouldRateLimit(ctx, now, req, cfg, d)
+		if err != nil {
+			s.logger.Error("failed to check rate limit", slog.String("domain", req.Domain), slog.Any("error", err))
+			return nil, status.Errorf(codes.Unavailable, "failed to check rate limit: %v", err)
+		}
+		if st.Code == rls.RateLimitResponse_OVER_LIMIT {
+			resp.OverallCode = rls.RateLimitResponse_OVER_LIMIT
+		}
+		resp.Statuses[i] = st
+	}
+
+	return resp, nil
+}
+
+func (s *Service) shouldRateLimit(ctx context.Context, now time.Time, req *rls.RateLimitRequest, cfg *rlsconf.RateLimitConfig, d *commonratelimit.RateLimitDescriptor) (*rls.RateLimitResponse_DescriptorStatus, error) {
+	ok := &rls.RateLimitResponse_DescriptorStatus{Code: rls.RateLimitResponse_OK}
+	if cfg == nil {
+		return ok, nil
+	}
+	rule := matchRule(cfg.Descriptors, d.Entries)
+	if rule == nil || rule.RateLimit == nil || rule.RateLimit.Unlimited {
+		return ok, nil
+	}
+	limit := rule.RateLimit
+
+	unit := unitDurations[limit.Unit]
+	windowStart := now.Truncate(unit)
+	resetIn := windowStart.Add(unit).Sub(now)
+	hits := uint64(max(req.HitsAddend, 1))
+	if d.HitsAddend != nil {
+		hits = d.HitsAddend.Value
+	}
+
+	var key strings.Builder
+	key.WriteString(req.Domain)
+	for _, e := range d.Entries {
+		key.WriteString("|" + e.Key + "=" + e.Value)
+	}
+	key.WriteString("|" + strconv.FormatInt(windowStart.Unix(), 10))
+	count, err := s.store.Increment(ctx, key.String(), hits, resetIn)
+	if err != nil {
+		return nil, err
+	}
+
+	st := &rls.RateLimitResponse_DescriptorStatus{
+		Code: rls.RateLimitResponse_OK,
+		CurrentLimit: &rls.RateLimitResponse_RateLimit{
+			Name:            limit.Name,
+			RequestsPerUnit: limit.RequestsPerUnit,
+			Unit:            rls.RateLimitResponse_RateLimit_Unit(limit.Unit),
+		},
+		DurationUntilReset: durationpb.New(resetIn),
+	}
+	if count <= uint64(limit.RequestsPerUnit) {
+		st.LimitRemaining = limit.RequestsPerUnit - uint32(count)
+		return st, nil
+	}
+
+	s.logger.Debug("rate limit exceeded",
+		slog.String("domain", req.Domain),
+		slog.String("key", key.String()),
+		slog.Bool("shadow_mode", rule.ShadowMode),
+	)
+	if !rule.ShadowMode {
+		st.Code = rls.RateLimitResponse_OVER_LIMIT
+	}
+
+	return st, nil
+}
+
+// matchRule returns rule descriptor matching entries or nil if there is none.
+func matchRule(rules []*rlsconf.RateLimitDescriptor, entries []*commonratelimit.RateLimitDescriptor_Entry) *rlsconf.RateLimitDescriptor {
+	var rule *rlsconf.RateLimitDescriptor
+	for _, e := range entries {
+		var wildcard *rlsconf.RateLimitDescriptor
+		rule = nil
+		for _, r := range rules {
+			if r.Key != e.Key {
+				continue
+			}
+			if r.Value == e.Value {
+				rule = r
+				break
+			}
+			if r.Value == "" {
+				wildcard = r
+			}
+		}
+		if rule == nil {
+			rule = wildcard
+		}
+		if rule == nil {
+			return nil
+		}
+		rules = rule.Descriptors
+	}
+
+	return rule
+}
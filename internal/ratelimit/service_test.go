@@ -0,0 +1,167 @@
+package ratelimit
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+
+	commonratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	rls "github.com/envoyproxy/go-control-plane/envoy/service/ratelimit/v3"
+	rlsconf "github.com/envoyproxy/go-control-plane/ratelimit/config/ratelimit/v3"
+)
+
+func entries(kv ...string) []*commonratelimit.RateLimitDescriptor_Entry {
+	var result []*commonratelimit.RateLimitDescriptor_Entry
+	for i := 0; i < len(kv); i += 2 {
+		result = append(result, &commonratelimit.RateLimitDescriptor_Entry{Key: kv[i], Value: kv[i+1]})
+	}
+	return result
+}
+
+func limit(name string, requestsPerUnit uint32) *rlsconf.RateLimitPolicy {
+	return &rlsconf.RateLimitPolicy{Name: name, Unit: rlsconf.RateLimitUnit_DAY, RequestsPerUnit: requestsPerUnit}
+}
+
+// testRules contains a rule per client IP of an API key, a rule for a specific
+// client IP and a rule per path.
+var testRules = []*rlsconf.RateLimitDescriptor{
+	{
+		Key:   "x-api-key",
+		Value: "free-tier",
+		Descriptors: []*rlsconf.RateLimitDescriptor{
+			{Key: "remote_address", RateLimit: limit("free-tier", 1)},
+		},
+	},
+	{Key: "remote_address", Value: "203.0.113.7", RateLimit: limit("client", 2)},
+	{Key: "remote_address", RateLimit: limit("any-client", 3)},
+	{Key: "path", Value: "/login", RateLimit: &rlsconf.RateLimitPolicy{Unlimited: true}},
+}
+
+func TestMatchRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*commonratelimit.RateLimitDescriptor_Entry
+		rule    string
+	}{
+		{name: "Value", entries: entries("remote_address", "203.0.113.7"), rule: "client"},
+		{name: "Wildcard", entries: entries("remote_address", "198.51.100.1"), rule: "any-client"},
+		{name: "Nested", entries: entries("x-api-key", "free-tier", "remote_address", "198.51.100.1"), rule: "free-tier"},
+		{name: "NestedMissingEntry", entries: entries("x-api-key", "free-tier")},
+		{name: "UnknownValue", entries: entries("x-api-key", "paid-tier", "remote_address", "198.51.100.1")},
+		{name: "UnknownKey", entries: entries("user-agent", "curl")},
+		{name: "TooManyEntries", entries: entries("remote_address", "203.0.113.7", "path", "/")},
+		{name: "NoEntries"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule := matchRule(testRules, test.entries)
+			name := ""
+			if rule != nil && rule.RateLimit != nil {
+				name = rule.RateLimit.Name
+			}
+			if name != test.rule {
+				t.Fatalf("expected rule %q, got %q", test.rule, name)
+			}
+		})
+	}
+}
+
+func TestShouldRateLimit(t *testing.T) {
+	s := NewService(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	err := s.SetConfigs([]*rlsconf.RateLimitConfig{{Name: "aegis", Domain: "aegis", Descriptors: testRules}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	shouldRateLimit := func(domain string, descriptors ...[]*commonratelimit.RateLimitDescriptor_Entry) *rls.RateLimitResponse {
+		t.Helper()
+		req := &rls.RateLimitRequest{Domain: domain}
+		for _, e := range descriptors {
+			req.Descriptors = append(req.Descriptors, &commonratelimit.RateLimitDescriptor{Entries: e})
+		}
+		resp, err := s.ShouldRateLimit(context.Background(), req)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		return resp
+	}
+
+	t.Run("CounterPerValue", func(t *testing.T) {
+		for i := range 3 {
+			resp := shouldRateLimit("aegis", entries("remote_address", "192.0.2.1"))
+			if resp.OverallCode != rls.RateLimitResponse_OK {
+				t.Fatalf("request %v: expected OK, got %v", i, resp.OverallCode)
+			}
+			if remaining := resp.Statuses[0].LimitRemaining; remaining != uint32(2-i) {
+				t.Fatalf("request %v: expected %v remaining requests, got %v", i, 2-i, remaining)
+			}
+		}
+		resp := shouldRateLimit("aegis", entries("remote_address", "192.0.2.1"))
+		if resp.OverallCode != rls.RateLimitResponse_OVER_LIMIT {
+			t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+		}
+		if name := resp.Statuses[0].CurrentLimit.Name; name != "any-client" {
+			t.Fatalf("expected limit %q, got %q", "any-client", name)
+		}
+
+		// Other client IPs have their own counter.
+		resp = shouldRateLimit("aegis", entries("remote_address", "192.0.2.2"))
+		if resp.OverallCode != rls.RateLimitResponse_OK {
+			t.Fatalf("expected OK, got %v", resp.OverallCode)
+		}
+	})
+
+	t.Run("OverallCode", func(t *testing.T) {
+		shouldRateLimit("aegis", entries("x-api-key", "free-tier", "remote_address", "192.0.2.3"))
+		resp := shouldRateLimit("aegis",
+			entries("remote_address", "192.0.2.3"),
+			entries("x-api-key", "free-tier", "remote_address", "192.0.2.3"),
+		)
+		if resp.OverallCode != rls.RateLimitResponse_OVER_LIMIT {
+			t.Fatalf("expected OVER_LIMIT, got %v", resp.OverallCode)
+		}
+		if code := resp.Statuses[0].Code; code != rls.RateLimitResponse_OK {
+			t.Fatalf("expected first descriptor to be OK, got %v", code)
+		}
+		if code := resp.Statuses[1].Code; code != rls.RateLimitResponse_OVER_LIMIT {
+			t.Fatalf("expected second descriptor to be OVER_LIMIT, got %v", code)
+		}
+	})
+
+	t.Run("Unlimited", func(t *testing.T) {
+		for range 10 {
+			resp := shouldRateLimit("aegis", entries("path", "/login"))
+			if resp.OverallCode != rls.RateLimitResponse_OK || resp.Statuses[0].CurrentLimit != nil {
+				t.Fatalf("expected unlimited OK status, got %v", resp.Statuses[0])
+			}
+		}
+	})
+
+	t.Run("UnknownDomain", func(t *testing.T) {
+		for range 10 {
+			resp := shouldRateLimit("other", entries("remote_address", "192.0.2.4"))
+			if resp.OverallCode != rls.RateLimitResponse_OK {
+				t.Fatalf("expected OK, got %v", resp.OverallCode)
+			}
+		}
+	})
+}
+
+func TestSetConfigs(t *testing.T) {
+	s := NewService(slog.New(slog.NewTextHandler(io.Discard, nil)), nil)
+	err := s.SetConfigs([]*rlsconf.RateLimitConfig{{
+		Name:   "aegis",
+		Domain: "aegis",
+		Descriptors: []*rlsconf.RateLimitDescriptor{
+			{Key: "remote_address", RateLimit: limit("a", 1)},
+			{Key: "remote_address", RateLimit: limit("b", 1)},
+			{Key: "path", Value: "/", RateLimit: &rlsconf.RateLimitPolicy{Unit: rlsconf.RateLimitUnit_UNKNOWN}},
+		},
+	}})
+	expected := "aegis.remote_address_: duplicate descriptor\naegis.path_/: unknown rate limit unit UNKNOWN"
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected error %q, got %v", expected, err)
+	}
+}
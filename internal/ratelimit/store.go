@@ -0,0 +1,70 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Store define a storage of rate limit counters. Implementations backed by a
+// shared database let multiple aegis instances enforce the same limits.
+type Store interface {
+	// Increment adds hits to counter key and returns its new value. Counter
+	// is reset once expiration elapsed since its creation.
+	Increment(ctx context.Context, key string, hits uint64, expiration time.Duration) (uint64, error)
+}
+
+// sweepInterval is the minimum delay between two removals of expired counters
+// of MemoryStore.
+const sweepInterval = time.Minute
+
+// MemoryStore is an in-memory Store. Counters are lost on restart.
+type MemoryStore struct {
+	mu        sync.Mutex
+	counters  map[string]memoryCounter
+	nextSweep time.Time
+}
+
+type memoryCounter struct {
+	value     uint64
+	expiresAt time.Time
+}
+
+var _ Store = (*MemoryStore)(nil)
+
+// NewMemoryStore returns a new empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{counters: make(map[string]memoryCounter)}
+}
+
+// Increment implements Store.
+func (ms *MemoryStore) Increment(_ context.Context, key string, hits uint64, expiration time.Duration) (uint64, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	now := time.Now()
+	ms.sweep(now)
+
+	counter, ok := ms.counters[key]
+	if !ok || !now.Before(counter.expiresAt) {
+		counter = memoryCounter{expiresAt: now.Add(expiration)}
+	}
+	counter.value += hits
+	ms.counters[key] = counter
+
+	return counter.value, nil
+}
+
+// sweep removes expired counters if sweep interval elapsed since last sweep.
+func (ms *MemoryStore) sweep(now time.Time) {
+	if now.Before(ms.nextSweep) {
+		return
+	}
+	ms.nextSweep = now.Add(sweepInterval)
+
+	for key, counter := range ms.counters {
+		if !now.Before(counter.expiresAt) {
+			delete(ms.counters, key)
+		}
+	}
+}
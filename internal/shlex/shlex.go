@@ -0,0 +1,239 @@
+package shlex
+
+import (
+	"errors"
+	"strings"
+)
+
+var (
+	ErrUnterminatedSingleQuote = errors.New("unterminated single-quoted string")
+	ErrUnterminatedDoubleQuote = errors.New("unterminated double-quoted string")
+	ErrUnterminatedBrace       = errors.New("unterminated ${ expansion")
+	ErrTrailingBackslash       = errors.New("trailing backslash")
+)
+
+// Split splits command into words following POSIX shell rules: words are
+// separated by unquoted blanks, single quotes preserve literal value of
+// characters, double quotes preserve literal value of characters except '$',
+// '`', '\' and backslash escapes the next character. $NAME and ${NAME}
+// outside single quotes are substituted using getEnv. Substituted values are
+// not split into multiple words. If getEnv is nil, no substitution is
+// performed.
+func Split(command string, getEnv func(string) string) ([]string, error) {
+	p := parser{input: command, getEnv: getEnv}
+	words, _, err := p.split()
+	return words, err
+}
+
+// SplitCommand splits command like Split and returns its leading variable
+// assignments separately from its arguments. As in POSIX shells, a word is an
+// assignment if it starts with an unquoted NAME followed by an unquoted '=',
+// before quote removal and substitution: "FOO=bar" and $VAR are arguments.
+func SplitCommand(command string, getEnv func(string) string) (assignments []string, args []string, err error) {
+	p := parser{input: command, getEnv: getEnv}
+	words, isAssignment, err := p.split()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	i := 0
+	for i < len(words) && isAssignment[i] {
+		i++
+	}
+
+	return words[:i], words[i:], nil
+}
+
+type parser struct {
+	input  string
+	pos    int
+	getEnv func(string) string
+}
+
+// split returns words of input and whether each one is an assignment.
+func (p *parser) split() ([]string, []bool, error) {
+	var words []string
+	var assignments []bool
+	var word strings.Builder
+	inWord := false
+	// literal is true while word only contains unquoted characters and
+	// assignment is true once an '=' follows such a NAME.
+	literal, assignment := true, false
+
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch c {
+		case ' ', '\t', '\n':
+			p.pos++
+			if inWord {
+				words = append(words, word.String())
+				assignments = append(assignments, assignment)
+				word.Reset()
+				inWord = false
+				literal, assignment = true, false
+			}
+
+		case '=':
+			if literal && !assignment && word.Len() > 0 {
+				assignment = true
+			}
+			literal = false
+			word.WriteByte(c)
+			p.pos++
+			inWord = true
+
+		case '\\':
+			literal = false
+			p.pos++
+			if p.pos >= len(p.input) {
+				return nil, nil, ErrTrailingBackslash
+			}
+			// Backslash newline is a line continuation.
+			if p.input[p.pos] != '\n' {
+				word.WriteByte(p.input[p.pos])
+				inWord = true
+			}
+			p.pos++
+
+		case '\'':
+			literal = false
+			p.pos++
+			end := strings.IndexByte(p.input[p.pos:], '\'')
+			if end == -1 {
+				return nil, nil, ErrUnterminatedSingleQuote
+			}
+			word.WriteString(p.input[p.pos : p.pos+end])
+			p.pos += end + 1
+			inWord = true
+
+		case '"':
+			literal = false
+			p.pos++
+			err := p.doubleQuoted(&word)
+			if err != nil {
+				return nil, nil, err
+			}
+			inWord = true
+
+		case '$':
+			literal = false
+			err := p.expand(&word)
+			if err != nil {
+				return nil, nil, err
+			}
+			inWord = true
+
+		default:
+			if !isNameChar(c, word.Len() == 0) {
+				literal = false
+			}
+			word.WriteByte(c)
+			p.pos++
+			inWord = true
+		}
+	}
+
+	if inWord {
+		words = append(words, word.String())
+		assignments = append(assignments, assignment)
+	}
+
+	return words, assignments, nil
+}
+
+// doubleQuoted parses a double-quoted string up to closing quote.
+func (p *parser) doubleQuoted(word *strings.Builder) error {
+	for p.pos < len(p.input) {
+		c := p.input[p.pos]
+		switch c {
+		case '"':
+			p.pos++
+			return nil
+
+		case '\\':
+			p.pos++
+			if p.pos >= len(p.input) {
+				return ErrUnterminatedDoubleQuote
+			}
+			switch next := p.input[p.pos]; next {
+			case '$', '`', '"', '\\':
+				word.WriteByte(next)
+			case '\n':
+				// Line continuation.
+			default:
+				word.WriteByte('\\')
+				word.WriteByte(next)
+			}
+			p.pos++
+
+		case '$':
+			err := p.expand(word)
+			if err != nil {
+				return err
+			}
+
+		default:
+			word.WriteByte(c)
+			p.pos++
+		}
+	}
+
+	return ErrUnterminatedDoubleQuote
+}
+
+// expand parses a $NAME or ${NAME} expansion. A '$' not followed by a name is
+// kept as is.
+func (p *parser) expand(word *strings.Builder) error {
+	dollar := p.pos
+	p.pos++ // Skip '$'.
+
+	var name string
+	if p.pos < len(p.input) && p.input[p.pos] == '{' {
+		end := strings.IndexByte(p.input[p.pos:], '}')
+		if end == -1 {
+			return ErrUnterminatedBrace
+		}
+		name = p.input[p.pos+1 : p.pos+end]
+		if !isName(name) {
+			return errors.New("bad substitution ${" + name + "}")
+		}
+		p.pos += end + 1
+	} else {
+		start := p.pos
+		for p.pos < len(p.input) && isNameChar(p.input[p.pos], p.pos == start) {
+			p.pos++
+		}
+		name = p.input[start:p.pos]
+		if name == "" {
+			word.WriteByte('$')
+			return nil
+		}
+	}
+
+	if p.getEnv == nil {
+		word.WriteString(p.input[dollar:p.pos])
+	} else {
+		word.WriteString(p.getEnv(name))
+	}
+
+	return nil
+}
+
+func isName(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func isNameChar(c byte, first bool) bool {
+	return c == '_' ||
+		(c >= 'a' && c <= 'z') ||
+		(c >= 'A' && c <= 'Z') ||
+		(!first && c >= '0' && c <= '9')
+}
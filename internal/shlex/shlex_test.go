@@ -0,0 +1,115 @@
+package shlex
+
+import (
+	"errors"
+	"slices"
+	"testing"
+)
+
+func testEnv(name string) string {
+	switch name {
+	case "PORT":
+		return "8080"
+	case "X":
+		return "A=b"
+	case "SPACES":
+		return "a b"
+	default:
+		return ""
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		name    string
+		command string
+		words   []string
+		err     error
+	}{
+		{name: "Empty", command: "", words: nil},
+		{name: "Blanks", command: " \t\n", words: nil},
+		{name: "Words", command: "deno run  -A\t./main.ts", words: []string{"deno", "run", "-A", "./main.ts"}},
+		{name: "SingleQuotes", command: `echo 'a  b' '$PORT' '\n'`, words: []string{"echo", "a  b", "$PORT", `\n`}},
+		{name: "DoubleQuotes", command: `echo "a  b" "$PORT" "\$PORT" "\"" "\n"`, words: []string{"echo", "a  b", "8080", "$PORT", `"`, `\n`}},
+		{name: "EmptyQuotes", command: `echo '' ""`, words: []string{"echo", "", ""}},
+		{name: "Concatenation", command: `a'b'"c"\d`, words: []string{"abcd"}},
+		{name: "Escapes", command: `echo a\ b \$PORT \\`, words: []string{"echo", "a b", "$PORT", `\`}},
+		{name: "LineContinuation", command: "echo a\\\nb", words: []string{"echo", "ab"}},
+		{name: "JsonFlag", command: `app --config '{"port": 8080}'`, words: []string{"app", "--config", `{"port": 8080}`}},
+		{name: "Expansion", command: "app --port=$PORT --addr=:${PORT}", words: []string{"app", "--port=8080", "--addr=:8080"}},
+		{name: "ExpansionNotSplit", command: "echo $SPACES", words: []string{"echo", "a b"}},
+		{name: "UnsetVariable", command: "echo $UNSET.", words: []string{"echo", "."}},
+		{name: "LoneDollar", command: "echo $ $1", words: []string{"echo", "$", "$1"}},
+		{name: "BadSubstitution", command: "echo ${1}", err: errors.New("bad substitution ${1}")},
+		{name: "UnterminatedBrace", command: "echo ${PORT", err: ErrUnterminatedBrace},
+		{name: "UnterminatedSingleQuote", command: "echo 'a", err: ErrUnterminatedSingleQuote},
+		{name: "UnterminatedDoubleQuote", command: `echo "a`, err: ErrUnterminatedDoubleQuote},
+		{name: "TrailingBackslash", command: `echo \`, err: ErrTrailingBackslash},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			words, err := Split(test.command, testEnv)
+			if test.err != nil {
+				if err == nil || err.Error() != test.err.Error() {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(words, test.words) {
+				t.Fatalf("expected words %q, got %q", test.words, words)
+			}
+		})
+	}
+}
+
+func TestSplitNoSubstitution(t *testing.T) {
+	words, err := Split(`app --port=$PORT "${PORT}"`, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := []string{"app", "--port=$PORT", "${PORT}"}
+	if !slices.Equal(words, expected) {
+		t.Fatalf("expected words %q, got %q", expected, words)
+	}
+}
+
+func TestSplitCommand(t *testing.T) {
+	tests := []struct {
+		name        string
+		command     string
+		assignments []string
+		args        []string
+	}{
+		{name: "NoAssignment", command: "app --port=$PORT", args: []string{"app", "--port=8080"}},
+		{name: "Assignments", command: "FOO=bar _B2=$PORT app", assignments: []string{"FOO=bar", "_B2=8080"}, args: []string{"app"}},
+		{name: "QuotedValue", command: `FOO="a b" BAR='c' app`, assignments: []string{"FOO=a b", "BAR=c"}, args: []string{"app"}},
+		{name: "EmptyValue", command: "FOO= app", assignments: []string{"FOO="}, args: []string{"app"}},
+		{name: "OnlyLeading", command: "FOO=bar app BAR=baz", assignments: []string{"FOO=bar"}, args: []string{"app", "BAR=baz"}},
+		{name: "OnlyAssignments", command: "FOO=bar", assignments: []string{"FOO=bar"}, args: []string{}},
+		{name: "QuotedName", command: `"FOO=bar" app`, args: []string{"FOO=bar", "app"}},
+		{name: "PartiallyQuotedName", command: `F"OO"=bar app`, args: []string{"FOO=bar", "app"}},
+		{name: "EscapedEqual", command: `FOO\=bar app`, args: []string{"FOO=bar", "app"}},
+		{name: "ExpandedAssignment", command: "$X app", args: []string{"A=b", "app"}},
+		{name: "InvalidName", command: "1FOO=bar FOO-BAR=baz app", args: []string{"1FOO=bar", "FOO-BAR=baz", "app"}},
+		{name: "MissingName", command: "=bar app", args: []string{"=bar", "app"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assignments, args, err := SplitCommand(test.command, testEnv)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !slices.Equal(assignments, test.assignments) {
+				t.Fatalf("expected assignments %q, got %q", test.assignments, assignments)
+			}
+			if !slices.Equal(args, test.args) {
+				t.Fatalf("expected args %q, got %q", test.args, args)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package ads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
+	"google.golang.org/genproto/googleapis/rpc/status"
+)
+
+// callbacks implements server.Callbacks. It tracks responses sent on each
+// stream until Envoy acknowledges them and records rejected configurations.
+type callbacks struct {
+	logger *slog.Logger
+	hash   cache.NodeHash
+	key    string
+
+	mu      sync.Mutex
+	streams map[int64]*stream
+	// nacks contains last rejected version of each resource type indexed by
+	// node key and type URL.
+	nacks map[string]map[string]Nack
+}
+
+var _ server.Callbacks = (*callbacks)(nil)
+
+type stream struct {
+	nodeId string
+	// key is the snapshot key of stream node.
+	key string
+	// types contains type URLs requested on stream.
+	types map[string]struct{}
+	// pending contains responses not yet acknowledged indexed by nonce.
+	pending map[string]response
+}
+
+type response struct {
+	typeUrl string
+	version string
+}
+
+// Nack define a configuration rejected by Envoy.
+type Nack struct {
+	TypeUrl string
+	Version string
+	Err     error
+}
+
+// Error implements error.
+func (n Nack) Error() string {
+	return fmt.Sprintf("envoy rejected %v version %v: %v", n.TypeUrl, n.Version, n.Err)
+}
+
+// Unwrap returns Envoy error.
+func (n Nack) Unwrap() error {
+	return n.Err
+}
+
+func newCallbacks(logger *slog.Logger, hash cache.NodeHash, key string) *callbacks {
+	return &callbacks{
+		logger:  logger,
+		hash:    hash,
+		key:     key,
+		streams: make(map[int64]*stream),
+		nacks:   make(map[string]map[string]Nack),
+	}
+}
+
+// status returns whether a node with the given key has an open stream, the
+// number of resource types requested by such nodes and the number of responses
+// they didn't acknowledge yet.
+func (c *callbacks) status(key string) (connected bool, types int, pending int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, st := range c.streams {
+		if st.key != key {
+			continue
+		}
+		connected = true
+		types += len(st.types)
+		pending += len(st.pending)
+	}
+
+	return connected, types, pending
+}
+
+// nack returns last rejected version of resource type by a node with the given
+// key, if any.
+func (c *callbacks) nack(key string, typeUrl string) (Nack, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	nack, ok := c.nacks[key][typeUrl]
+	return nack, ok
+}
+
+func (c *callbacks) onStreamOpen(id int64, typeUrl string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.streams[id] = &stream{
+		types:   make(map[string]struct{}),
+		pending: make(map[string]response),
+	}
+	c.logger.Debug("xDS stream opened", slog.Int64("stream", id), slog.String("type_url", typeUrl))
+	return nil
+}
+
+func (c *callbacks) onStreamClosed(id int64, node *core.Node) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.streams, id)
+	c.logger.Debug("xDS stream closed", slog.Int64("stream", id), slog.String("node_id", node.GetId()))
+}
+
+func (c *callbacks) onRequest(id int64, node *core.Node, typeUrl string, nonce string, errDetail *status.Status) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.streams[id]
+	if !ok {
+		return nil
+	}
+	if node != nil && st.nodeId == "" {
+		st.nodeId = node.GetId()
+		st.key = c.hash.ID(node)
+		if st.key != c.key {
+			c.logger.Warn("envoy node isn't served by aegis",
+				slog.String("node_id", node.GetId()),
+				slog.String("node_cluster", node.GetCluster()),
+			)
+		}
+	}
+	st.types[typeUrl] = struct{}{}
+
+	resp, ok := st.pending[nonce]
+	if !ok {
+		return nil
+	}
+	delete(st.pending, nonce)
+
+	logger := c.logger.With(
+		slog.String("node_id", st.nodeId),
+		slog.String("type_url", resp.typeUrl),
+		slog.String("version", resp.version),
+	)
+	if errDetail != nil {
+		nack := Nack{
+			TypeUrl: resp.typeUrl,
+			Version: resp.version,
+			Err:     errors.New(errDetail.GetMessage()),
+		}
+		if c.nacks[st.key] == nil {
+			c.nacks[st.key] = make(map[string]Nack)
+		}
+		c.nacks[st.key][resp.typeUrl] = nack
+		logger.Error("envoy rejected configuration", slog.String("error", errDetail.GetMessage()))
+	} else {
+		delete(c.nacks[st.key], resp.typeUrl)
+		logger.Debug("envoy accepted configuration")
+	}
+
+	return nil
+}
+
+func (c *callbacks) onResponse(id int64, typeUrl string, nonce string, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	st, ok := c.streams[id]
+	if !ok {
+		return
+	}
+	st.pending[nonce] = response{typeUrl: typeUrl, version: version}
+}
+
+// OnStreamOpen implements server.Callbacks.
+func (c *callbacks) OnStreamOpen(_ context.Context, id int64, typeUrl string) error {
+	return c.onStreamOpen(id, typeUrl)
+}
+
+// OnStreamClosed implements server.Callbacks.
+func (c *callbacks) OnStreamClosed(id int64, node *core.Node) {
+	c.onStreamClosed(id, node)
+}
+
+// OnStreamRequest implements server.Callbacks.
+func (c *callbacks) OnStreamRequest(id int64, req *discovery.DiscoveryRequest) error {
+	return c.onRequest(id, req.GetNode(), req.GetTypeUrl(), req.GetResponseNonce(), req.GetErrorDetail())
+}
+
+// OnStreamResponse implements server.Callbacks.
+func (c *callbacks) OnStreamResponse(_ context.Context, id int64, _ *discovery.DiscoveryRequest, resp *discovery.DiscoveryResponse) {
+	c.onResponse(id, resp.GetTypeUrl(), resp.GetNonce(), resp.GetVersionInfo())
+}
+
+// OnDeltaStreamOpen implements server.Callbacks.
+func (c *callbacks) OnDeltaStreamOpen(_ context.Context, id int64, typeUrl string) error {
+	return c.onStreamOpen(id, typeUrl)
+}
+
+// OnDeltaStreamClosed implements server.Callbacks.
+func (c *callbacks) OnDeltaStreamClosed(id int64, node *core.Node) {
+	c.onStreamClosed(id, node)
+}
+
+// OnStreamDeltaRequest implements server.Callbacks.
+func (c *callbacks) OnStreamDeltaRequest(id int64, req *discovery.DeltaDiscoveryRequest) error {
+	return c.onRequest(id, req.GetNode(), req.GetTypeUrl(), req.GetResponseNonce(), req.GetErrorDetail())
+}
+
+// OnStreamDeltaResponse implements server.Callbacks.
+func (c *callbacks) OnStreamDeltaResponse(id int64, _ *discovery.DeltaDiscoveryRequest, resp *discovery.DeltaDiscoveryResponse) {
+	c.onResponse(id, resp.GetTypeUrl(), resp.GetNonce(), resp.GetSystemVersionInfo())
+}
+
+// OnFetchRequest implements server.Callbacks.
+func (c *callbacks) OnFetchRequest(context.Context, *discovery.DiscoveryRequest) error {
+	return nil
+}
+
+// OnFetchResponse implements server.Callbacks.
+func (c *callbacks) OnFetchResponse(*discovery.DiscoveryRequest, *discovery.DiscoveryResponse) {}
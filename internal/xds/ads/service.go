@@ -3,50 +3,105 @@ package ads
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net"
-	"strconv"
 	"sync"
-	"sync/atomic"
+	"time"
 
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
-	"github.com/envoyproxy/go-control-plane/pkg/resource/v3"
 	server "github.com/envoyproxy/go-control-plane/pkg/server/v3"
 	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
 	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/sds"
+	"github.com/negrel/aegis/internal/xds/versioned"
 	"google.golang.org/grpc"
 )
 
-// Service define an Envoy Aggregated xDS Service.
+// commitDebounce is the delay during which committed transactions are
+// coalesced into a single snapshot.
+const commitDebounce = 20 * time.Millisecond
+
+// NodeHash computes the snapshot key of an Envoy node.
+type NodeHash = cache.NodeHash
+
+// IdHash is a NodeHash using node id as key.
+type IdHash = cache.IDHash
+
+// ClusterHash is a NodeHash using node cluster as key. It is used to serve the
+// same snapshot to every Envoy node of a cluster.
+type ClusterHash struct{}
+
+// ID implements NodeHash.
+func (ClusterHash) ID(node *core.Node) string {
+	return node.GetCluster()
+}
+
+// Service define an Envoy Aggregated xDS Service. Resources are modified using
+// transactions, see Service.Begin.
 type Service struct {
-	mu         sync.Mutex
-	version    atomic.Uint64
+	key        string
 	cache      cache.SnapshotCache
+	callbacks  *callbacks
 	grpcServer *grpc.Server
 
-	LDS lds.Service
-	CDS cds.Service
+	mu      sync.Mutex
+	pending *pendingSnapshot
+	// current is the last snapshot set.
+	current *cache.Snapshot
+	lds     lds.Service
+	rds     rds.Service
+	cds     cds.Service
+	eds     eds.Service
+	sds     sds.Service
+}
+
+// pendingSnapshot define a snapshot set once commit debounce delay expired.
+// done is closed once snapshot is set.
+type pendingSnapshot struct {
+	done     chan struct{}
+	snapshot *cache.Snapshot
+	err      error
 }
 
-// ProvideService is a wire provider for Envoy ADS server service.
+// ProvideService is a wire provider for Envoy ADS server service. Snapshots
+// are served to Envoy nodes whose hash is key. Configurations rejected by
+// Envoy are logged using logger. gRPC server options, such as transport
+// credentials, are applied to the underlying server.
 func ProvideService(
+	logger *slog.Logger,
+	hash NodeHash,
+	key string,
 	lds lds.Service,
+	rds rds.Service,
 	cds cds.Service,
+	eds eds.Service,
+	sds sds.Service,
+	opts ...grpc.ServerOption,
 ) *Service {
-	grpcSrv := grpc.NewServer()
+	grpcSrv := grpc.NewServer(opts...)
 
-	cache := cache.NewSnapshotCache(true, cache.IDHash{}, nil)
-	srv := server.NewServer(context.Background(), cache, nil)
+	cache := cache.NewSnapshotCache(true, hash, nil)
+	callbacks := newCallbacks(logger, hash, key)
+	srv := server.NewServer(context.Background(), cache, callbacks)
 
 	// Register services
 	discovery.RegisterAggregatedDiscoveryServiceServer(grpcSrv, srv)
 
 	return &Service{
+		key:        key,
 		grpcServer: grpcSrv,
 		cache:      cache,
-		LDS:        lds,
-		CDS:        cds,
+		callbacks:  callbacks,
+		lds:        lds,
+		rds:        rds,
+		cds:        cds,
+		eds:        eds,
+		sds:        sds,
 	}
 }
 
@@ -62,30 +117,115 @@ func (s *Service) GracefulStop() {
 	s.grpcServer.GracefulStop()
 }
 
-// Snapshot implements Service.
-func (s *Service) Snapshot(ctx context.Context) error {
+// snapshot returns a snapshot of current resources. Each resource type is
+// versioned by a hash of its resources so unchanged types aren't sent again to
+// Envoy. Over delta xDS, only added, modified and removed resources are sent.
+func (s *Service) snapshot() *cache.Snapshot {
+	snapshot := &cache.Snapshot{
+		VersionMap: make(map[string]map[string]string),
+	}
+	for typ, resources := range s.resources() {
+		items := make([]types.Resource, len(resources))
+		versions := make(map[string]string, len(resources))
+		for i, r := range resources {
+			items[i] = r.Resource
+			versions[r.Name] = r.Version
+		}
+		snapshot.Resources[typ] = cache.NewResources(versioned.Version(resources), items)
+		typeUrl, _ := cache.GetResponseTypeURL(typ)
+		snapshot.VersionMap[typeUrl] = versions
+	}
+
+	return snapshot
+}
+
+// resources returns current resources indexed by type.
+func (s *Service) resources() map[types.ResponseType][]versioned.Resource {
+	return map[types.ResponseType][]versioned.Resource{
+		cds.ResourceType: s.cds.Resources(),
+		eds.ResourceType: s.eds.Resources(),
+		lds.ResourceType: s.lds.Resources(),
+		rds.ResourceType: s.rds.Resources(),
+		sds.ResourceType: s.sds.Resources(),
+	}
+}
+
+// flush sets a snapshot of current resources once commit debounce delay
+// expired.
+func (s *Service) flush() {
 	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	versionNum := s.version.Add(1)
-	version := strconv.FormatUint(versionNum, 10)
-
-	listeners := s.LDS.Resources()
-	clusters := s.CDS.Resources()
-	snapshot, err := cache.NewSnapshot(version,
-		map[resource.Type][]types.Resource{
-			resource.ClusterType:  clusters,
-			resource.ListenerType: listeners,
-		},
-	)
+	f := s.pending
+	s.pending = nil
+	snapshot := s.snapshot()
+	err := snapshot.Consistent()
 	if err != nil {
-		return err
+		err = fmt.Errorf("inconsistent snapshot: %w", err)
+	} else {
+		err = s.cache.SetSnapshot(context.Background(), s.key, snapshot)
+		if err != nil {
+			err = fmt.Errorf("failed to set snapshot: %w", err)
+		} else {
+			s.current = snapshot
+		}
 	}
+	s.mu.Unlock()
 
-	err = s.cache.SetSnapshot(ctx, "expo-envoy", snapshot)
-	if err != nil {
-		return fmt.Errorf("failed to set snapshot: %v", err)
+	f.snapshot, f.err = snapshot, err
+	close(f.done)
+}
+
+// WaitSync waits until Envoy nodes acknowledged the current snapshot. Snapshot
+// is served again to restarted Envoy nodes once they connect, WaitSync
+// returns once they're in sync. A Nack error is returned if they reject it.
+func (s *Service) WaitSync(ctx context.Context) error {
+	s.mu.Lock()
+	current := s.current
+	s.mu.Unlock()
+	if current == nil {
+		return nil
 	}
 
-	return nil
+	return s.waitAck(ctx, current, false)
+}
+
+// waitAck waits until Envoy nodes are connected and acknowledged every response
+// sent after snapshot was set. Nodes are in sync once every requested resource
+// type has an open watch again. If disconnected is true, waitAck returns as
+// soon as no node is connected.
+func (s *Service) waitAck(ctx context.Context, snapshot *cache.Snapshot, disconnected bool) error {
+	nackErr := func() error {
+		for typ := range snapshot.VersionMap {
+			nack, ok := s.callbacks.nack(s.key, typ)
+			if ok && nack.Version == snapshot.GetVersion(typ) {
+				return nack
+			}
+		}
+		return nil
+	}
+
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if err := nackErr(); err != nil {
+			return err
+		}
+
+		connected, types, pending := s.callbacks.status(s.key)
+		if !connected && disconnected {
+			return nil
+		}
+		if connected && pending == 0 {
+			info := s.cache.GetStatusInfo(s.key)
+			if info != nil && info.GetNumWatches()+info.GetNumDeltaWatches() >= types {
+				// A rejection is recorded before watch is reopened.
+				return nackErr()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("envoy didn't acknowledge configuration: %w", ctx.Err())
+		case <-ticker.C:
+		}
+	}
 }
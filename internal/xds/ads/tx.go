@@ -0,0 +1,238 @@
+package ads
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/eds"
+	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/sds"
+	"github.com/negrel/aegis/internal/xds/versioned"
+)
+
+// typeNames contains human readable names of resource types.
+var typeNames = map[types.ResponseType]string{
+	lds.ResourceType: "listener",
+	rds.ResourceType: "route configuration",
+	cds.ResourceType: "cluster",
+	eds.ResourceType: "load assignment",
+	sds.ResourceType: "secret",
+}
+
+// Tx define an ADS transaction. Set and remove operations are staged until
+// transaction is committed. A Tx must not be used concurrently.
+type Tx struct {
+	s   *Service
+	ops []op
+	err error
+}
+
+// op define a staged operation on a resource. refs is nil if resource is
+// removed.
+type op struct {
+	typ    types.ResponseType
+	name   string
+	remove bool
+	refs   versioned.References
+	apply  func()
+}
+
+// Begin starts a new transaction.
+func (s *Service) Begin() *Tx {
+	return &Tx{s: s}
+}
+
+// SetListener stages addition or replacement of a listener.
+func (tx *Tx) SetListener(l *lds.Listener) {
+	tx.set(lds.ResourceType, l.ToResource(), l.References(), tx.s.lds.SetListener)
+}
+
+// RemoveListener stages removal of a listener.
+func (tx *Tx) RemoveListener(name string) {
+	tx.remove(lds.ResourceType, name, func() { tx.s.lds.RemoveListener(name) })
+}
+
+// SetRouteConfig stages addition or replacement of a route configuration.
+func (tx *Tx) SetRouteConfig(rc *rds.RouteConfig) {
+	tx.set(rds.ResourceType, rc.ToResource(), rc.References(), tx.s.rds.SetRouteConfig)
+}
+
+// RemoveRouteConfig stages removal of a route configuration.
+func (tx *Tx) RemoveRouteConfig(name string) {
+	tx.remove(rds.ResourceType, name, func() { tx.s.rds.RemoveRouteConfig(name) })
+}
+
+// SetCluster stages addition or replacement of a cluster.
+func (tx *Tx) SetCluster(c *cds.Cluster) {
+	tx.set(cds.ResourceType, c.ToResource(), c.References(), tx.s.cds.SetCluster)
+}
+
+// RemoveCluster stages removal of a cluster.
+func (tx *Tx) RemoveCluster(name string) {
+	tx.remove(cds.ResourceType, name, func() { tx.s.cds.RemoveCluster(name) })
+}
+
+// SetLoadAssignment stages addition or replacement of a cluster load
+// assignment.
+func (tx *Tx) SetLoadAssignment(cla *eds.ClusterLoadAssignment) {
+	tx.set(eds.ResourceType, cla.ToResource(), nil, tx.s.eds.SetLoadAssignment)
+}
+
+// RemoveLoadAssignment stages removal of a cluster load assignment.
+func (tx *Tx) RemoveLoadAssignment(clusterName string) {
+	tx.remove(eds.ResourceType, clusterName, func() { tx.s.eds.RemoveLoadAssignment(clusterName) })
+}
+
+// SetSecret stages addition or replacement of a secret.
+func (tx *Tx) SetSecret(secret *sds.Secret) {
+	tx.set(sds.ResourceType, secret.ToResource(), nil, tx.s.sds.SetSecret)
+}
+
+// RemoveSecret stages removal of a secret.
+func (tx *Tx) RemoveSecret(name string) {
+	tx.remove(sds.ResourceType, name, func() { tx.s.sds.RemoveSecret(name) })
+}
+
+// set stages a resource versioned before commit. An error is returned by
+// Commit if resource can't be marshaled.
+func (tx *Tx) set(typ types.ResponseType, resource types.Resource, refs versioned.References, apply func(versioned.Resource) bool) {
+	r, err := versioned.New(resource, refs)
+	if err != nil {
+		tx.err = errors.Join(tx.err, fmt.Errorf("invalid %v %q: %w", typeNames[typ], cache.GetResourceName(resource), err))
+		return
+	}
+	tx.ops = append(tx.ops, op{typ: typ, name: r.Name, refs: refs, apply: func() { apply(r) }})
+}
+
+func (tx *Tx) remove(typ types.ResponseType, name string, apply func()) {
+	tx.ops = append(tx.ops, op{typ: typ, name: name, remove: true, apply: apply})
+}
+
+// CommitOption define an option of Tx.Commit.
+type CommitOption func(*commitOptions)
+
+type commitOptions struct {
+	waitAck      bool
+	disconnected bool
+}
+
+// WaitAck makes Tx.Commit block until Envoy acknowledges the snapshot
+// containing the transaction. A Nack error is returned if Envoy rejects it.
+func WaitAck() CommitOption {
+	return func(opts *commitOptions) {
+		opts.waitAck = true
+	}
+}
+
+// AllowDisconnected makes WaitAck only wait for Envoy nodes connected when
+// snapshot is set, Tx.Commit doesn't wait for a node to connect.
+func AllowDisconnected() CommitOption {
+	return func(opts *commitOptions) {
+		opts.disconnected = true
+	}
+}
+
+// Commit validates references between resources and applies staged
+// operations. Nothing is applied if a resource can't be marshaled, references a
+// missing one or if a route configuration or a load assignment isn't referenced.
+// Transactions committed within a short window are sent to Envoy in a single
+// snapshot, Commit returns once it is set.
+func (tx *Tx) Commit(ctx context.Context, opts ...CommitOption) error {
+	var options commitOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+
+	if tx.err != nil {
+		return tx.err
+	}
+
+	s := tx.s
+	s.mu.Lock()
+	err := s.validate(tx.ops)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	for _, op := range tx.ops {
+		op.apply()
+	}
+	pending := s.pending
+	if pending == nil {
+		pending = &pendingSnapshot{done: make(chan struct{})}
+		s.pending = pending
+		time.AfterFunc(commitDebounce, s.flush)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pending.done:
+	}
+	if pending.err != nil {
+		return pending.err
+	}
+
+	if options.waitAck {
+		return s.waitAck(ctx, pending.snapshot, options.disconnected)
+	}
+	return nil
+}
+
+// validate returns an error if resources resulting of ops are inconsistent.
+// Envoy requests route configurations and load assignments by name so they
+// must all be referenced.
+func (s *Service) validate(ops []op) error {
+	resources := make(map[types.ResponseType]map[string]versioned.References)
+	for typ, items := range s.resources() {
+		resources[typ] = make(map[string]versioned.References, len(items))
+		for _, r := range items {
+			resources[typ][r.Name] = r.References
+		}
+	}
+	for _, op := range ops {
+		if op.remove {
+			delete(resources[op.typ], op.name)
+		} else {
+			resources[op.typ][op.name] = op.refs
+		}
+	}
+
+	var errs []error
+	referenced := make(map[types.ResponseType]map[string]struct{})
+	for _, typ := range slices.Sorted(maps.Keys(resources)) {
+		for _, name := range slices.Sorted(maps.Keys(resources[typ])) {
+			refs := resources[typ][name]
+			for _, refTyp := range slices.Sorted(maps.Keys(refs)) {
+				if referenced[refTyp] == nil {
+					referenced[refTyp] = make(map[string]struct{})
+				}
+				for _, refName := range refs[refTyp] {
+					referenced[refTyp][refName] = struct{}{}
+					if _, ok := resources[refTyp][refName]; !ok {
+						errs = append(errs, fmt.Errorf("%v %q references unknown %v %q",
+							typeNames[typ], name, typeNames[refTyp], refName))
+					}
+				}
+			}
+		}
+	}
+	for _, typ := range []types.ResponseType{rds.ResourceType, eds.ResourceType} {
+		for _, name := range slices.Sorted(maps.Keys(resources[typ])) {
+			if _, ok := referenced[typ][name]; !ok {
+				errs = append(errs, fmt.Errorf("%v %q isn't referenced", typeNames[typ], name))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,261 @@
+// Package bootstrap builds the Envoy bootstrap configuration. Envoy fetches
+// every other resource from aegis over ADS.
+package bootstrap
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	bootstrap "github.com/envoyproxy/go-control-plane/envoy/config/bootstrap/v3"
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	metrics "github.com/envoyproxy/go-control-plane/envoy/config/metrics/v3"
+	overload "github.com/envoyproxy/go-control-plane/envoy/config/overload/v3"
+	trace "github.com/envoyproxy/go-control-plane/envoy/config/trace/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	upstreamhttp "github.com/envoyproxy/go-control-plane/envoy/extensions/upstreams/http/v3"
+	// Typed configurations of stats sinks and overload manager resource
+	// monitors referenced by bootstrap extensions.
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/resource_monitors/cpu_utilization/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/resource_monitors/downstream_connections/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/resource_monitors/fixed_heap/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/resource_monitors/injected_resource/v3"
+	_ "github.com/envoyproxy/go-control-plane/envoy/extensions/stat_sinks/graphite_statsd/v3"
+	"github.com/negrel/aegis/internal/pbutils"
+	"github.com/negrel/aegis/internal/xnet"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// XdsClusterName is the name of the static cluster of aegis ADS server.
+const XdsClusterName = "xds-cluster"
+
+// Bootstrap define Envoy bootstrap configuration. Envoy identifies itself as
+// node NodeId of NodeCluster to the ADS server at Xds and serves its admin
+// interface on AdminAddress. StaticClusters are added to the ADS server
+// cluster (e.g. aegis rate limit service). Stats, overload manager, runtime
+// layers and tracing are optional and left to Envoy defaults if unset.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/bootstrap/v3/bootstrap.proto
+type Bootstrap struct {
+	NodeId       string
+	NodeCluster  string
+	AdminAddress netip.AddrPort
+	Xds          Xds
+
+	StaticClusters  []*cluster.Cluster
+	StatsConfig     *metrics.StatsConfig
+	StatsSinks      []*metrics.StatsSink
+	OverloadManager *overload.OverloadManager
+	RuntimeLayers   []*bootstrap.RuntimeLayer
+	Tracing         *trace.Tracing
+}
+
+// Xds define how Envoy connects to aegis ADS server. Connection uses TLS if
+// Tls is set.
+type Xds struct {
+	Address xnet.SocketAddr
+	Tls     *XdsTls
+}
+
+// XdsTls define TLS parameters of connection to ADS server. Server certificate
+// is verified against CA certificates of CaFile if set. CertFile and KeyFile
+// are an optional client certificate (mTLS).
+type XdsTls struct {
+	Sni      string
+	CaFile   string
+	CertFile string
+	KeyFile  string
+}
+
+// toTransportSocket returns TLS transport socket of ADS server connection. TLS
+// context is validated here as Bootstrap.ValidateAll doesn't validate typed
+// configurations.
+func (t *XdsTls) toTransportSocket() (*core.TransportSocket, error) {
+	if (t.CertFile == "") != (t.KeyFile == "") {
+		return nil, fmt.Errorf("xds client certificate and private key must be set together")
+	}
+
+	common := &tlsv3.CommonTlsContext{}
+	if t.CaFile != "" {
+		common.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContext{
+			ValidationContext: &tlsv3.CertificateValidationContext{
+				TrustedCa: fileDataSource(t.CaFile),
+			},
+		}
+	}
+	if t.CertFile != "" {
+		common.TlsCertificates = []*tlsv3.TlsCertificate{{
+			CertificateChain: fileDataSource(t.CertFile),
+			PrivateKey:       fileDataSource(t.KeyFile),
+		}}
+	}
+
+	tlsCtx := &tlsv3.UpstreamTlsContext{
+		Sni:              t.Sni,
+		CommonTlsContext: common,
+	}
+	err := tlsCtx.ValidateAll()
+	if err != nil {
+		return nil, err
+	}
+
+	return &core.TransportSocket{
+		Name: "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(tlsCtx),
+		},
+	}, nil
+}
+
+func fileDataSource(path string) *core.DataSource {
+	return &core.DataSource{
+		Specifier: &core.DataSource_Filename{Filename: path},
+	}
+}
+
+func (x *Xds) toCluster() (*cluster.Cluster, error) {
+	c := GrpcCluster(XdsClusterName, x.Address)
+	if x.Tls != nil {
+		var err error
+		c.TransportSocket, err = x.Tls.toTransportSocket()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// GrpcCluster returns a static cluster named name of the gRPC server at
+// address.
+func GrpcCluster(name string, address xnet.SocketAddr) *cluster.Cluster {
+	host, port := address.HostPort()
+	return &cluster.Cluster{
+		Name:           name,
+		ConnectTimeout: durationpb.New(5 * time.Second),
+		ClusterDiscoveryType: &cluster.Cluster_Type{
+			Type: cluster.Cluster_STRICT_DNS,
+		},
+		TypedExtensionProtocolOptions: map[string]*anypb.Any{
+			"envoy.extensions.upstreams.http.v3.HttpProtocolOptions": pbutils.MustMarshalAny(&upstreamhttp.HttpProtocolOptions{
+				UpstreamProtocolOptions: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_{
+					ExplicitHttpConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig{
+						ProtocolConfig: &upstreamhttp.HttpProtocolOptions_ExplicitHttpConfig_Http2ProtocolOptions{
+							Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+						},
+					},
+				},
+			}),
+		},
+		LoadAssignment: &endpoint.ClusterLoadAssignment{
+			ClusterName: name,
+			Endpoints: []*endpoint.LocalityLbEndpoints{{
+				LbEndpoints: []*endpoint.LbEndpoint{{
+					HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+						Endpoint: &endpoint.Endpoint{
+							Address: socketAddress(host, port),
+						},
+					},
+				}},
+			}},
+		},
+	}
+}
+
+func socketAddress(host string, port uint16) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Address:       host,
+				PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+			},
+		},
+	}
+}
+
+// applicationLogFormat is the format of Envoy logs. Records are JSON objects
+// parsed and forwarded to aegis logs.
+var applicationLogFormat = map[string]any{
+	"component": "envoy",
+	"log":       "app",
+	"time":      "%Y-%m-%dT%T.%F",
+	"thread-id": "%t",
+	"line":      "%s:%#",
+	"level":     "%l",
+	"msg":       "%j",
+}
+
+// ToProto returns bootstrap configuration protobuf. An error is returned if it
+// is invalid.
+func (b *Bootstrap) ToProto() (*bootstrap.Bootstrap, error) {
+	xdsCluster, err := b.Xds.toCluster()
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy bootstrap: %w", err)
+	}
+	ads := &core.ConfigSource{
+		ResourceApiVersion:    core.ApiVersion_V3,
+		ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+	}
+
+	pb := &bootstrap.Bootstrap{
+		Node: &core.Node{
+			Id:      b.NodeId,
+			Cluster: b.NodeCluster,
+		},
+		ApplicationLogConfig: &bootstrap.Bootstrap_ApplicationLogConfig{
+			LogFormat: &bootstrap.Bootstrap_ApplicationLogConfig_LogFormat{
+				LogFormat: &bootstrap.Bootstrap_ApplicationLogConfig_LogFormat_JsonFormat{
+					JsonFormat: &structpb.Struct{Fields: pbutils.MustMarshalValueMap(applicationLogFormat)},
+				},
+			},
+		},
+		DynamicResources: &bootstrap.Bootstrap_DynamicResources{
+			AdsConfig: &core.ApiConfigSource{
+				ApiType:             core.ApiConfigSource_DELTA_GRPC,
+				TransportApiVersion: core.ApiVersion_V3,
+				GrpcServices: []*core.GrpcService{{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: XdsClusterName},
+					},
+				}},
+			},
+			CdsConfig: ads,
+			LdsConfig: ads,
+		},
+		StaticResources: &bootstrap.Bootstrap_StaticResources{
+			Clusters: append([]*cluster.Cluster{xdsCluster}, b.StaticClusters...),
+		},
+		Admin: &bootstrap.Admin{
+			Address: socketAddress(b.AdminAddress.Addr().String(), b.AdminAddress.Port()),
+		},
+		StatsConfig:     b.StatsConfig,
+		StatsSinks:      b.StatsSinks,
+		OverloadManager: b.OverloadManager,
+		Tracing:         b.Tracing,
+	}
+	if len(b.RuntimeLayers) > 0 {
+		pb.LayeredRuntime = &bootstrap.LayeredRuntime{Layers: b.RuntimeLayers}
+	}
+
+	err = pb.ValidateAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid envoy bootstrap: %w", err)
+	}
+
+	return pb, nil
+}
+
+// Marshal returns JSON encoded bootstrap configuration. An error is returned
+// if it is invalid.
+func (b *Bootstrap) Marshal() ([]byte, error) {
+	pb, err := b.ToProto()
+	if err != nil {
+		return nil, err
+	}
+
+	return protojson.MarshalOptions{Multiline: true, UseProtoNames: true}.Marshal(pb)
+}
@@ -0,0 +1,64 @@
+package cds
+
+import (
+	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// CircuitBreakers define thresholds of connections and requests to cluster
+// hosts. Default thresholds apply to requests of routes with default priority
+// and High ones to requests of routes with high priority. Requests exceeding
+// a threshold fail with a 503 status and the UO response flag.
+// See https://www.envoyproxy.io/docs/envoy/latest/intro/arch_overview/upstream/circuit_breaking
+type CircuitBreakers struct {
+	Default Thresholds
+	High    Thresholds
+}
+
+// Thresholds define circuit breaker thresholds of a routing priority.
+// MaxRetries is ignored if RetryBudget is set.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/cluster/v3/circuit_breaker.proto#config-cluster-v3-circuitbreakers-thresholds
+type Thresholds struct {
+	MaxConnections     uint32
+	MaxPendingRequests uint32
+	MaxRequests        uint32
+	MaxRetries         uint32
+	RetryBudget        *RetryBudget
+}
+
+// RetryBudget limits concurrent retries to BudgetPercent percent of active
+// requests, with at least MinRetryConcurrency retries allowed.
+type RetryBudget struct {
+	BudgetPercent       float64
+	MinRetryConcurrency uint32
+}
+
+func (cb *CircuitBreakers) toCircuitBreakers() *cluster.CircuitBreakers {
+	return &cluster.CircuitBreakers{
+		Thresholds: []*cluster.CircuitBreakers_Thresholds{
+			cb.Default.toThresholds(core.RoutingPriority_DEFAULT),
+			cb.High.toThresholds(core.RoutingPriority_HIGH),
+		},
+	}
+}
+
+func (t *Thresholds) toThresholds(priority core.RoutingPriority) *cluster.CircuitBreakers_Thresholds {
+	thresholds := &cluster.CircuitBreakers_Thresholds{
+		Priority:           priority,
+		MaxConnections:     wrapperspb.UInt32(t.MaxConnections),
+		MaxPendingRequests: wrapperspb.UInt32(t.MaxPendingRequests),
+		MaxRequests:        wrapperspb.UInt32(t.MaxRequests),
+		MaxRetries:         wrapperspb.UInt32(t.MaxRetries),
+		TrackRemaining:     true,
+	}
+	if t.RetryBudget != nil {
+		thresholds.RetryBudget = &cluster.CircuitBreakers_Thresholds_RetryBudget{
+			BudgetPercent:       &typev3.Percent{Value: t.RetryBudget.BudgetPercent},
+			MinRetryConcurrency: wrapperspb.UInt32(t.RetryBudget.MinRetryConcurrency),
+		}
+	}
+
+	return thresholds
+}
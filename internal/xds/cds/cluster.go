@@ -5,9 +5,12 @@ import (
 
 	cluster "github.com/envoyproxy/go-control-plane/envoy/config/cluster/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
-	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
-	"github.com/negrel/aegis/internal/xnet"
+	"github.com/negrel/aegis/internal/pbutils"
+	"github.com/negrel/aegis/internal/xds/eds"
+	"github.com/negrel/aegis/internal/xds/sds"
+	"github.com/negrel/aegis/internal/xds/versioned"
 	"google.golang.org/protobuf/types/known/durationpb"
 	"google.golang.org/protobuf/types/known/wrapperspb"
 )
@@ -16,13 +19,51 @@ import (
 // to. Envoy discovers the members of a cluster via service discovery. It
 // optionally determines the health of cluster members via active health
 // checking. The cluster member that Envoy routes a request to is determined by
-// the load balancing policy.
+// the load balancing policy. Cluster members are fetched over ADS from the EDS
+// load assignment named after the cluster. Envoy default circuit breakers
+// thresholds are used if CircuitBreakers is nil.
 type Cluster struct {
-	Name           string
-	ConnectTimeout time.Duration
-	LbPolicy       cluster.Cluster_LbPolicy
-	Endpoints      []xnet.SocketAddr
-	TcpKeepAlive   *TcpKeepAlive
+	Name            string
+	ConnectTimeout  time.Duration
+	LbPolicy        cluster.Cluster_LbPolicy
+	TcpKeepAlive    *TcpKeepAlive
+	Tls             *Tls
+	CircuitBreakers *CircuitBreakers
+}
+
+// Tls define TLS parameters of connections to cluster endpoints.
+// ValidationContext is the name of the SDS secret used to verify endpoints
+// certificates, they're not verified if it is empty. Certificate is the name
+// of the SDS secret containing client certificate, if any.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/extensions/transport_sockets/tls/v3/tls.proto#envoy-v3-api-msg-extensions-transport-sockets-tls-v3-upstreamtlscontext
+type Tls struct {
+	Sni               string
+	ValidationContext string
+	Certificate       string
+}
+
+func (t *Tls) toTransportSocket() *core.TransportSocket {
+	common := &tlsv3.CommonTlsContext{}
+	if t.ValidationContext != "" {
+		common.ValidationContextType = &tlsv3.CommonTlsContext_ValidationContextSdsSecretConfig{
+			ValidationContextSdsSecretConfig: sds.SecretConfig(t.ValidationContext),
+		}
+	}
+	if t.Certificate != "" {
+		common.TlsCertificateSdsSecretConfigs = []*tlsv3.SdsSecretConfig{
+			sds.SecretConfig(t.Certificate),
+		}
+	}
+
+	return &core.TransportSocket{
+		Name: "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(&tlsv3.UpstreamTlsContext{
+				Sni:              t.Sni,
+				CommonTlsContext: common,
+			}),
+		},
+	}
 }
 
 func (c *Cluster) ToResource() types.Resource {
@@ -30,40 +71,45 @@ func (c *Cluster) ToResource() types.Resource {
 		Name:           c.Name,
 		ConnectTimeout: durationpb.New(c.ConnectTimeout),
 		LbPolicy:       c.LbPolicy,
-		LoadAssignment: &endpoint.ClusterLoadAssignment{
-			ClusterName: c.Name,
-			Endpoints: []*endpoint.LocalityLbEndpoints{{
-				LbEndpoints: []*endpoint.LbEndpoint{},
-			}},
+		ClusterDiscoveryType: &cluster.Cluster_Type{
+			Type: cluster.Cluster_EDS,
+		},
+		EdsClusterConfig: &cluster.Cluster_EdsClusterConfig{
+			EdsConfig: &core.ConfigSource{
+				ResourceApiVersion:    core.ApiVersion_V3,
+				ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+			},
 		},
 		UpstreamConnectionOptions: &cluster.UpstreamConnectionOptions{
 			TcpKeepalive: c.TcpKeepAlive.ToCoreTcpKeepAlive(),
 		},
 	}
 
-	for _, addr := range c.Endpoints {
-		host, port := addr.HostPort()
-
-		resource.LoadAssignment.Endpoints[0].LbEndpoints = append(resource.LoadAssignment.Endpoints[0].LbEndpoints, &endpoint.LbEndpoint{
-			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
-				Endpoint: &endpoint.Endpoint{
-					Address: &core.Address{
-						Address: &core.Address_SocketAddress{
-							SocketAddress: &core.SocketAddress{
-								Address:       host,
-								PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
-								Ipv4Compat:    true,
-							},
-						},
-					},
-				},
-			},
-		})
+	if c.Tls != nil {
+		resource.TransportSocket = c.Tls.toTransportSocket()
+	}
+	if c.CircuitBreakers != nil {
+		resource.CircuitBreakers = c.CircuitBreakers.toCircuitBreakers()
 	}
 
 	return resource
 }
 
+// References returns name of cluster load assignment and names of secrets
+// used to connect to endpoints.
+func (c *Cluster) References() versioned.References {
+	refs := versioned.References{eds.ResourceType: {c.Name}}
+	if c.Tls != nil {
+		for _, name := range []string{c.Tls.ValidationContext, c.Tls.Certificate} {
+			if name != "" {
+				refs[sds.ResourceType] = append(refs[sds.ResourceType], name)
+			}
+		}
+	}
+
+	return refs
+}
+
 // Cluster TcpKeepAlive options.
 // See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/core/v3/address.proto#envoy-v3-api-msg-config-core-v3-tcpkeepalive
 type TcpKeepAlive struct {
@@ -5,35 +5,37 @@ import (
 
 	"github.com/elliotchance/orderedmap/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/versioned"
 )
 
 const ResourceType = types.Cluster
 
 // Service define an Envoy CDS (Cluster Discovery Service) server service.
+// Resources are versioned by content hash before they are set.
 type Service interface {
-	SetCluster(*Cluster) bool
+	SetCluster(versioned.Resource) bool
 	RemoveCluster(name string) bool
-	Resources() []types.Resource
+	Resources() []versioned.Resource
 }
 
 // ProvideService define a wire provider for Envoy CDS server service.
 func ProvideService() Service {
 	return &service{
-		clusters: orderedmap.NewOrderedMap[string, *Cluster](),
+		clusters: orderedmap.NewOrderedMap[string, versioned.Resource](),
 	}
 }
 
 type service struct {
 	mu       sync.Mutex
-	clusters *orderedmap.OrderedMap[string, *Cluster]
+	clusters *orderedmap.OrderedMap[string, versioned.Resource]
 }
 
 // SetCluster implements Service.
-func (s *service) SetCluster(c *Cluster) bool {
+func (s *service) SetCluster(r versioned.Resource) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.clusters.Set(c.Name, c)
+	return s.clusters.Set(r.Name, r)
 }
 
 // RemoveCluster implements Service.
@@ -45,14 +47,13 @@ func (s *service) RemoveCluster(name string) bool {
 }
 
 // Resources implements Service.
-func (s *service) Resources() []types.Resource {
+func (s *service) Resources() []versioned.Resource {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var resources []types.Resource
-
-	for _, c := range s.clusters.AllFromFront() {
-		resources = append(resources, c.ToResource())
+	resources := make([]versioned.Resource, 0, s.clusters.Len())
+	for _, r := range s.clusters.AllFromFront() {
+		resources = append(resources, r)
 	}
 
 	return resources
@@ -0,0 +1,94 @@
+package eds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	endpoint "github.com/envoyproxy/go-control-plane/envoy/config/endpoint/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xnet"
+)
+
+// ClusterLoadAssignment define members of the cluster named ClusterName.
+// Updating a load assignment changes cluster membership without modifying the
+// cluster itself, connection pools of remaining endpoints are preserved.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/endpoint/v3/endpoint.proto#envoy-v3-api-msg-config-endpoint-v3-clusterloadassignment
+type ClusterLoadAssignment struct {
+	ClusterName string
+	Endpoints   []Endpoint
+}
+
+// Endpoint define an upstream host of a cluster.
+type Endpoint struct {
+	Address xnet.SocketAddr
+	Health  HealthStatus
+}
+
+// HealthStatus define health status of an endpoint. Envoy only sends new
+// requests to healthy endpoints.
+type HealthStatus int
+
+const (
+	// Healthy endpoints receive traffic.
+	Healthy HealthStatus = iota
+	// Draining endpoints are being removed, they don't receive new requests
+	// but in flight requests are completed.
+	Draining
+	// Unhealthy endpoints don't receive traffic (e.g. process is restarting).
+	Unhealthy
+)
+
+// String implements fmt.Stringer.
+func (hs HealthStatus) String() string {
+	switch hs {
+	case Healthy:
+		return "healthy"
+	case Draining:
+		return "draining"
+	case Unhealthy:
+		return "unhealthy"
+	default:
+		return "unknown"
+	}
+}
+
+func (hs HealthStatus) toCoreHealthStatus() core.HealthStatus {
+	switch hs {
+	case Healthy:
+		return core.HealthStatus_HEALTHY
+	case Draining:
+		return core.HealthStatus_DRAINING
+	case Unhealthy:
+		return core.HealthStatus_UNHEALTHY
+	default:
+		return core.HealthStatus_UNKNOWN
+	}
+}
+
+func (cla *ClusterLoadAssignment) ToResource() types.Resource {
+	lbEndpoints := make([]*endpoint.LbEndpoint, len(cla.Endpoints))
+	for i, e := range cla.Endpoints {
+		host, port := e.Address.HostPort()
+		lbEndpoints[i] = &endpoint.LbEndpoint{
+			HealthStatus: e.Health.toCoreHealthStatus(),
+			HostIdentifier: &endpoint.LbEndpoint_Endpoint{
+				Endpoint: &endpoint.Endpoint{
+					Address: &core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Address:       host,
+								PortSpecifier: &core.SocketAddress_PortValue{PortValue: uint32(port)},
+								Ipv4Compat:    true,
+							},
+						},
+					},
+				},
+			},
+		}
+	}
+
+	return &endpoint.ClusterLoadAssignment{
+		ClusterName: cla.ClusterName,
+		Endpoints: []*endpoint.LocalityLbEndpoints{{
+			LbEndpoints: lbEndpoints,
+		}},
+	}
+}
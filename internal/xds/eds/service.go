@@ -0,0 +1,60 @@
+package eds
+
+import (
+	"sync"
+
+	"github.com/elliotchance/orderedmap/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/versioned"
+)
+
+const ResourceType = types.Endpoint
+
+// Service define an Envoy EDS (Endpoint Discovery Service) server service.
+// Resources are versioned by content hash before they are set.
+type Service interface {
+	SetLoadAssignment(versioned.Resource) bool
+	RemoveLoadAssignment(clusterName string) bool
+	Resources() []versioned.Resource
+}
+
+// ProvideService define a wire provider for Envoy EDS server service.
+func ProvideService() Service {
+	return &service{
+		loadAssignments: orderedmap.NewOrderedMap[string, versioned.Resource](),
+	}
+}
+
+type service struct {
+	mu              sync.Mutex
+	loadAssignments *orderedmap.OrderedMap[string, versioned.Resource]
+}
+
+// SetLoadAssignment implements Service.
+func (s *service) SetLoadAssignment(r versioned.Resource) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loadAssignments.Set(r.Name, r)
+}
+
+// RemoveLoadAssignment implements Service.
+func (s *service) RemoveLoadAssignment(clusterName string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.loadAssignments.Delete(clusterName)
+}
+
+// Resources implements Service.
+func (s *service) Resources() []versioned.Resource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resources := make([]versioned.Resource, 0, s.loadAssignments.Len())
+	for _, r := range s.loadAssignments.AllFromFront() {
+		resources = append(resources, r)
+	}
+
+	return resources
+}
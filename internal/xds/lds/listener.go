@@ -4,7 +4,6 @@ import (
 	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
 	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
 	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
-	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
 	accesslogfile "github.com/envoyproxy/go-control-plane/envoy/extensions/access_loggers/file/v3"
 	httprouter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/router/v3"
 	httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
@@ -12,8 +11,12 @@ import (
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
 	"github.com/negrel/aegis/internal/pbutils"
 	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/sds"
+	"github.com/negrel/aegis/internal/xds/versioned"
 	"github.com/negrel/aegis/internal/xnet"
 	"google.golang.org/protobuf/types/known/structpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 // Listener is a named network location (e.g., port, unix domain socket, etc.)
@@ -22,7 +25,16 @@ import (
 type Listener struct {
 	Name         string
 	Address      xnet.SocketAddr
-	FilterChains [][]Filter
+	FilterChains []FilterChain
+}
+
+// FilterChain define a chain of filters processing connections whose SNI
+// matches one of ServerNames or any connection if ServerNames is empty. If Tls
+// is set, TLS is terminated before connection is processed by filters.
+type FilterChain struct {
+	ServerNames []string
+	Tls         *Tls
+	Filters     []Filter
 }
 
 // Filter define a listener filter.
@@ -46,24 +58,59 @@ func (l *Listener) ToResource() types.Resource {
 		FilterChains: []*listener.FilterChain{},
 	}
 
+	inspectTls := false
 	for _, chain := range l.FilterChains {
 		var filters []*listener.Filter
-		for _, f := range chain {
+		for _, f := range chain.Filters {
 			filters = append(filters, f.ToFilter())
 		}
+		if filters == nil {
+			continue
+		}
 
-		if filters != nil {
-			resource.FilterChains = append(resource.FilterChains,
-				&listener.FilterChain{
-					Filters: filters,
-				},
-			)
+		fc := &listener.FilterChain{
+			Filters: filters,
+		}
+		if len(chain.ServerNames) > 0 {
+			fc.FilterChainMatch = &listener.FilterChainMatch{
+				ServerNames: chain.ServerNames,
+			}
 		}
+		if chain.Tls != nil {
+			fc.TransportSocket = chain.Tls.toTransportSocket()
+		}
+		inspectTls = inspectTls || len(chain.ServerNames) > 0 || chain.Tls != nil
+		resource.FilterChains = append(resource.FilterChains, fc)
+	}
+
+	if inspectTls {
+		resource.ListenerFilters = append(resource.ListenerFilters, tlsInspector())
 	}
 
 	return resource
 }
 
+// References returns names of clusters and route configurations referenced by
+// listener filters and names of secrets used to terminate TLS.
+func (l *Listener) References() versioned.References {
+	refs := make(versioned.References)
+	for _, chain := range l.FilterChains {
+		if len(chain.Filters) > 0 && chain.Tls != nil {
+			refs[sds.ResourceType] = append(refs[sds.ResourceType], chain.Tls.Certificates...)
+		}
+		for _, f := range chain.Filters {
+			switch f := f.(type) {
+			case TcpProxyFilter:
+				refs[cds.ResourceType] = append(refs[cds.ResourceType], f.Cluster.Name)
+			case HttpProxyFilter:
+				refs[rds.ResourceType] = append(refs[rds.ResourceType], f.RouteConfigName)
+			}
+		}
+	}
+
+	return refs
+}
+
 type TcpProxyFilter struct {
 	Cluster *cds.Cluster
 }
@@ -83,23 +130,36 @@ func (tpf TcpProxyFilter) ToFilter() *listener.Filter {
 	}
 }
 
-// HttpProxyFilter is a listener filter to process HTTP streams.
+// HttpProxyFilter is a listener filter to process HTTP streams. Routes are
+// fetched over ADS from the route configuration named RouteConfigName.
+// Envoy is the edge proxy: client address used by rate limit descriptors is
+// the address of downstream connection and x-forwarded-proto is set to its
+// scheme, x-forwarded-for and x-forwarded-proto sent by clients are ignored.
 type HttpProxyFilter struct {
-	HttpFilters []HttpFilter
-	RouteConfig RouteConfig
+	HttpFilters     []HttpFilter
+	RouteConfigName string
 }
 
 func (hpf HttpProxyFilter) ToFilter() *listener.Filter {
 	filters := make([]*httpman.HttpFilter, len(hpf.HttpFilters))
+	var mappers []*httpman.ResponseMapper
 	for i, f := range hpf.HttpFilters {
 		filters[i] = f.ToHttpFilter()
+		if rm, ok := f.(responseMapper); ok {
+			mappers = append(mappers, rm.responseMappers()...)
+		}
+	}
+	var localReply *httpman.LocalReplyConfig
+	if len(mappers) > 0 {
+		localReply = &httpman.LocalReplyConfig{Mappers: mappers}
 	}
 
 	return &listener.Filter{
 		Name: "envoy.filters.network.http_connection_manager",
 		ConfigType: &listener.Filter_TypedConfig{
 			TypedConfig: pbutils.MustMarshalAny(&httpman.HttpConnectionManager{
-				StatPrefix: "http-conn-man",
+				StatPrefix:       "http-conn-man",
+				UseRemoteAddress: wrapperspb.Bool(true),
 				AccessLog: []*accesslog.AccessLog{
 					{
 						Name: "envoy.access_loggers.stdout",
@@ -147,9 +207,16 @@ func (hpf HttpProxyFilter) ToFilter() *listener.Filter {
 						},
 					},
 				},
-				HttpFilters: filters,
-				RouteSpecifier: &httpman.HttpConnectionManager_RouteConfig{
-					RouteConfig: hpf.RouteConfig.toRouteConfig(),
+				HttpFilters:      filters,
+				LocalReplyConfig: localReply,
+				RouteSpecifier: &httpman.HttpConnectionManager_Rds{
+					Rds: &httpman.Rds{
+						RouteConfigName: hpf.RouteConfigName,
+						ConfigSource: &core.ConfigSource{
+							ResourceApiVersion:    core.ApiVersion_V3,
+							ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+						},
+					},
 				},
 			}),
 		},
@@ -161,6 +228,12 @@ type HttpFilter interface {
 	ToHttpFilter() *httpman.HttpFilter
 }
 
+// responseMapper is implemented by HTTP filters modifying local replies of
+// their HTTP connection manager (e.g. rejected requests responses).
+type responseMapper interface {
+	responseMappers() []*httpman.ResponseMapper
+}
+
 // HttpRouter define an HTTP router filter.
 // See https://www.envoyproxy.io/docs/envoy/latest/api-v3/extensions/filters/http/router/v3/router.proto#envoy-v3-api-msg-extensions-filters-http-router-v3-router
 type HttpRouter struct{}
@@ -174,51 +247,3 @@ func (hr HttpRouter) ToHttpFilter() *httpman.HttpFilter {
 		Disabled:   false,
 	}
 }
-
-// RouteConfig define HTTP route configurations.
-// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/route/v3/route.proto#envoy-v3-api-msg-config-route-v3-routeconfiguration
-type RouteConfig struct {
-	Name         string
-	VirtualHosts []VirtualHost
-}
-
-func (rc RouteConfig) toRouteConfig() *route.RouteConfiguration {
-	vhosts := make([]*route.VirtualHost, len(rc.VirtualHosts))
-	for i, f := range rc.VirtualHosts {
-		vhosts[i] = f.toVirtualHost()
-	}
-
-	return &route.RouteConfiguration{
-		Name:         rc.Name,
-		VirtualHosts: vhosts,
-	}
-}
-
-// VirtualHost define virtual HTTP host.
-// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/route/v3/route_components.proto#envoy-v3-api-msg-config-route-v3-virtualhost
-type VirtualHost struct {
-	Name    string
-	Domains []string
-	Cluster *cds.Cluster
-}
-
-func (vh VirtualHost) toVirtualHost() *route.VirtualHost {
-	return &route.VirtualHost{
-		Name:    vh.Name,
-		Domains: vh.Domains,
-		Routes: []*route.Route{
-			{
-				Name: "route",
-				Match: &route.RouteMatch{
-					PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
-				},
-				Action: &route.Route_Route{
-					Route: &route.RouteAction{
-						ClusterSpecifier: &route.RouteAction_Cluster{Cluster: vh.Cluster.Name},
-					},
-				},
-			},
-		},
-		RequireTls: route.VirtualHost_NONE,
-	}
-}
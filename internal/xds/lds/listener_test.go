@@ -0,0 +1,34 @@
+package lds
+
+import (
+	"testing"
+
+	httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+)
+
+func TestHttpProxyFilter(t *testing.T) {
+	filter := HttpProxyFilter{
+		HttpFilters:     []HttpFilter{RateLimit{}, HttpRouter{}},
+		RouteConfigName: "entrypoint",
+	}
+
+	var hcm httpman.HttpConnectionManager
+	err := filter.ToFilter().GetTypedConfig().UnmarshalTo(&hcm)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Client supplied x-forwarded-for must not bypass client IP descriptors.
+	if !hcm.GetUseRemoteAddress().GetValue() {
+		t.Fatalf("expected use_remote_address to be true")
+	}
+	if hcm.XffNumTrustedHops != 0 {
+		t.Fatalf("expected 0 trusted x-forwarded-for hops, got %v", hcm.XffNumTrustedHops)
+	}
+	if name := hcm.GetRds().GetRouteConfigName(); name != "entrypoint" {
+		t.Fatalf("expected route config %q, got %q", "entrypoint", name)
+	}
+	if len(hcm.HttpFilters) != 2 || hcm.HttpFilters[0].Name != RateLimitFilterName {
+		t.Fatalf("expected rate limit and router filters, got %v", hcm.HttpFilters)
+	}
+}
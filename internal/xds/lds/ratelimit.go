@@ -0,0 +1,266 @@
+package lds
+
+import (
+	"time"
+
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v3"
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	ratelimitconf "github.com/envoyproxy/go-control-plane/envoy/config/ratelimit/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	ratelimitfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	httpman "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/network/http_connection_manager/v3"
+	typev3 "github.com/envoyproxy/go-control-plane/envoy/type/v3"
+	"github.com/negrel/aegis/internal/pbutils"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+const (
+	// LocalRateLimitFilterName is the name of Envoy local rate limit HTTP
+	// filter.
+	LocalRateLimitFilterName = "envoy.filters.http.local_ratelimit"
+	// RateLimitFilterName is the name of Envoy global rate limit HTTP filter.
+	RateLimitFilterName = "envoy.filters.http.ratelimit"
+	// RateLimitClusterName is the name of the static cluster of aegis rate
+	// limit service.
+	RateLimitClusterName = "ratelimit-cluster"
+	// RateLimitDomain is the domain of rate limit service requests.
+	RateLimitDomain = "aegis"
+	// rateLimitStage is the stage of global rate limit filter, local rate
+	// limit filter uses stage 0.
+	rateLimitStage = 1
+)
+
+// rateLimitedFlag is the response flag of rate limited requests.
+const rateLimitedFlag = "RL"
+
+// TokenBucket define a bucket of MaxTokens tokens refilled with TokensPerFill
+// tokens every FillInterval. Each request consumes a token and requests are
+// rejected once bucket is empty.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/type/v3/token_bucket.proto
+type TokenBucket struct {
+	MaxTokens     uint32
+	TokensPerFill uint32
+	FillInterval  time.Duration
+}
+
+func (tb *TokenBucket) toTokenBucket() *typev3.TokenBucket {
+	return &typev3.TokenBucket{
+		MaxTokens:     tb.MaxTokens,
+		TokensPerFill: wrapperspb.UInt32(tb.TokensPerFill),
+		FillInterval:  durationpb.New(tb.FillInterval),
+	}
+}
+
+// LocalRateLimit define an HTTP filter rejecting requests with a 429 status
+// once a token bucket shared by Envoy workers is empty. Requests are limited
+// by TokenBucket unless a virtual host or route overrides it using a
+// LocalRateLimitConfig. If TokenBucket is nil, only requests of those are
+// limited. ResponseBody is the body of rejected requests responses, Envoy
+// default is used if empty.
+// See https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_filters/local_rate_limit_filter
+type LocalRateLimit struct {
+	TokenBucket  *TokenBucket
+	ResponseBody string
+}
+
+// ToHttpFilter implements HttpFilter.
+func (lrl LocalRateLimit) ToHttpFilter() *httpman.HttpFilter {
+	config := &localratelimit.LocalRateLimit{StatPrefix: "http-local-rate-limit"}
+	if lrl.TokenBucket != nil {
+		config.TokenBucket = lrl.TokenBucket.toTokenBucket()
+		config.FilterEnabled = fullyEnabled("local_rate_limit_enabled")
+		config.FilterEnforced = fullyEnabled("local_rate_limit_enforced")
+	}
+
+	return &httpman.HttpFilter{
+		Name: LocalRateLimitFilterName,
+		ConfigType: &httpman.HttpFilter_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(config),
+		},
+	}
+}
+
+func (lrl LocalRateLimit) responseMappers() []*httpman.ResponseMapper {
+	return rateLimitedResponseMappers(lrl.ResponseBody)
+}
+
+// LocalRateLimitConfig define local rate limit of a virtual host or route.
+// Requests generating one of Descriptors consume tokens of descriptor bucket,
+// other requests consume tokens of TokenBucket. VirtualHost must be true for
+// virtual host configurations, descriptors of virtual host are then generated
+// for routes with rate limits of other filters too.
+type LocalRateLimitConfig struct {
+	TokenBucket TokenBucket
+	Descriptors []LocalRateLimitDescriptor
+	VirtualHost bool
+}
+
+// LocalRateLimitDescriptor define a token bucket of requests generating
+// Descriptor. TokenBucket fill interval must be a multiple of the fill
+// interval of LocalRateLimitConfig token bucket.
+type LocalRateLimitDescriptor struct {
+	Descriptor  rds.RateLimitDescriptor
+	TokenBucket TokenBucket
+}
+
+// FilterName implements rds.FilterConfig.
+func (lrlc *LocalRateLimitConfig) FilterName() string {
+	return LocalRateLimitFilterName
+}
+
+// ToFilterConfig implements rds.FilterConfig.
+func (lrlc *LocalRateLimitConfig) ToFilterConfig() *anypb.Any {
+	descriptors := make([]*ratelimit.LocalRateLimitDescriptor, len(lrlc.Descriptors))
+	for i, d := range lrlc.Descriptors {
+		descriptors[i] = &ratelimit.LocalRateLimitDescriptor{
+			Entries:     d.Descriptor.Entries(),
+			TokenBucket: d.TokenBucket.toTokenBucket(),
+		}
+	}
+
+	return pbutils.MustMarshalAny(&localratelimit.LocalRateLimit{
+		StatPrefix:     "http-local-rate-limit",
+		TokenBucket:    lrlc.TokenBucket.toTokenBucket(),
+		FilterEnabled:  fullyEnabled("local_rate_limit_enabled"),
+		FilterEnforced: fullyEnabled("local_rate_limit_enforced"),
+		Descriptors:    descriptors,
+		VhRateLimits:   vhRateLimits(lrlc.VirtualHost),
+	})
+}
+
+// RateLimits implements rds.FilterConfig.
+func (lrlc *LocalRateLimitConfig) RateLimits() []*route.RateLimit {
+	rateLimits := make([]*route.RateLimit, len(lrlc.Descriptors))
+	for i, d := range lrlc.Descriptors {
+		// Local rate limit filter uses stage 0.
+		rateLimits[i] = d.Descriptor.ToRateLimit(0)
+	}
+
+	return rateLimits
+}
+
+// RateLimit define an HTTP filter rejecting requests with a 429 status once
+// aegis rate limit service reports that a descriptor generated for request is
+// over limit. Descriptors are generated by RateLimitConfig of virtual hosts
+// and routes. Requests are allowed if rate limit service doesn't answer
+// within Timeout, unless FailureModeDeny is true. ResponseBody is the body of
+// rejected requests responses, Envoy default is used if empty.
+// See https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_filters/rate_limit_filter
+type RateLimit struct {
+	Timeout         time.Duration
+	FailureModeDeny bool
+	ResponseBody    string
+}
+
+// ToHttpFilter implements HttpFilter.
+func (rl RateLimit) ToHttpFilter() *httpman.HttpFilter {
+	config := &ratelimitfilter.RateLimit{
+		Domain:          RateLimitDomain,
+		Stage:           rateLimitStage,
+		FailureModeDeny: rl.FailureModeDeny,
+		RateLimitService: &ratelimitconf.RateLimitServiceConfig{
+			GrpcService: &core.GrpcService{
+				TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+					EnvoyGrpc: &core.GrpcService_EnvoyGrpc{ClusterName: RateLimitClusterName},
+				},
+			},
+			TransportApiVersion: core.ApiVersion_V3,
+		},
+		EnableXRatelimitHeaders: ratelimitfilter.RateLimit_DRAFT_VERSION_03,
+		StatPrefix:              "http-rate-limit",
+	}
+	if rl.Timeout != 0 {
+		config.Timeout = durationpb.New(rl.Timeout)
+	}
+
+	return &httpman.HttpFilter{
+		Name: RateLimitFilterName,
+		ConfigType: &httpman.HttpFilter_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(config),
+		},
+	}
+}
+
+func (rl RateLimit) responseMappers() []*httpman.ResponseMapper {
+	return rateLimitedResponseMappers(rl.ResponseBody)
+}
+
+// RateLimitConfig define descriptors sent to aegis rate limit service for
+// requests of a virtual host or route. See LocalRateLimitConfig for
+// VirtualHost, descriptors of a route override virtual host ones.
+type RateLimitConfig struct {
+	Descriptors []rds.RateLimitDescriptor
+	VirtualHost bool
+}
+
+// FilterName implements rds.FilterConfig.
+func (rlc *RateLimitConfig) FilterName() string {
+	return RateLimitFilterName
+}
+
+// ToFilterConfig implements rds.FilterConfig.
+func (rlc *RateLimitConfig) ToFilterConfig() *anypb.Any {
+	vhRateLimits := ratelimitfilter.RateLimitPerRoute_OVERRIDE
+	if rlc.VirtualHost {
+		vhRateLimits = ratelimitfilter.RateLimitPerRoute_INCLUDE
+	}
+
+	return pbutils.MustMarshalAny(&ratelimitfilter.RateLimitPerRoute{
+		VhRateLimits: vhRateLimits,
+	})
+}
+
+// RateLimits implements rds.FilterConfig.
+func (rlc *RateLimitConfig) RateLimits() []*route.RateLimit {
+	rateLimits := make([]*route.RateLimit, len(rlc.Descriptors))
+	for i, d := range rlc.Descriptors {
+		rateLimits[i] = d.ToRateLimit(rateLimitStage)
+	}
+
+	return rateLimits
+}
+
+// vhRateLimits returns whether virtual host rate limits are included in
+// addition to routes ones. By default, they're only used for routes without
+// rate limits.
+func vhRateLimits(virtualHost bool) ratelimit.VhRateLimitsOptions {
+	if virtualHost {
+		return ratelimit.VhRateLimitsOptions_INCLUDE
+	}
+	return ratelimit.VhRateLimitsOptions_OVERRIDE
+}
+
+// fullyEnabled returns a runtime fractional percent of 100% by default.
+func fullyEnabled(runtimeKey string) *core.RuntimeFractionalPercent {
+	return &core.RuntimeFractionalPercent{
+		DefaultValue: &typev3.FractionalPercent{
+			Numerator:   100,
+			Denominator: typev3.FractionalPercent_HUNDRED,
+		},
+		RuntimeKey: runtimeKey,
+	}
+}
+
+// rateLimitedResponseMappers returns local reply mappers replacing body of
+// rate limited requests responses.
+func rateLimitedResponseMappers(body string) []*httpman.ResponseMapper {
+	if body == "" {
+		return nil
+	}
+
+	return []*httpman.ResponseMapper{{
+		Filter: &accesslog.AccessLogFilter{
+			FilterSpecifier: &accesslog.AccessLogFilter_ResponseFlagFilter{
+				ResponseFlagFilter: &accesslog.ResponseFlagFilter{Flags: []string{rateLimitedFlag}},
+			},
+		},
+		Body: &core.DataSource{
+			Specifier: &core.DataSource_InlineString{InlineString: body},
+		},
+	}}
+}
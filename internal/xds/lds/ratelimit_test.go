@@ -0,0 +1,106 @@
+package lds
+
+import (
+	"testing"
+	"time"
+
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	localratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/local_ratelimit/v3"
+	ratelimitfilter "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/http/ratelimit/v3"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestLocalRateLimitConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		virtualHost  bool
+		vhRateLimits ratelimit.VhRateLimitsOptions
+	}{
+		{name: "VirtualHost", virtualHost: true, vhRateLimits: ratelimit.VhRateLimitsOptions_INCLUDE},
+		{name: "Route", virtualHost: false, vhRateLimits: ratelimit.VhRateLimitsOptions_OVERRIDE},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			descriptor := rds.RateLimitDescriptor{RemoteAddress: "203.0.113.7"}
+			config := &LocalRateLimitConfig{
+				TokenBucket: TokenBucket{MaxTokens: 100, TokensPerFill: 100, FillInterval: time.Second},
+				Descriptors: []LocalRateLimitDescriptor{{
+					Descriptor:  descriptor,
+					TokenBucket: TokenBucket{MaxTokens: 10, TokensPerFill: 10, FillInterval: time.Second},
+				}},
+				VirtualHost: test.virtualHost,
+			}
+
+			var filterConfig localratelimit.LocalRateLimit
+			err := config.ToFilterConfig().UnmarshalTo(&filterConfig)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if filterConfig.TokenBucket.MaxTokens != 100 {
+				t.Fatalf("expected 100 max tokens, got %v", filterConfig.TokenBucket.MaxTokens)
+			}
+			if filterConfig.VhRateLimits != test.vhRateLimits {
+				t.Fatalf("expected vh_rate_limits %v, got %v", test.vhRateLimits, filterConfig.VhRateLimits)
+			}
+			if len(filterConfig.Descriptors) != 1 {
+				t.Fatalf("expected 1 descriptor, got %v", len(filterConfig.Descriptors))
+			}
+			d := filterConfig.Descriptors[0]
+			if d.TokenBucket.MaxTokens != 10 {
+				t.Fatalf("expected 10 max tokens, got %v", d.TokenBucket.MaxTokens)
+			}
+			if len(d.Entries) != 1 || !proto.Equal(d.Entries[0], descriptor.Entries()[0]) {
+				t.Fatalf("expected entries %v, got %v", descriptor.Entries(), d.Entries)
+			}
+
+			rateLimits := config.RateLimits()
+			if len(rateLimits) != 1 || !proto.Equal(rateLimits[0], descriptor.ToRateLimit(0)) {
+				t.Fatalf("expected stage 0 rate limit of descriptor, got %v", rateLimits)
+			}
+		})
+	}
+}
+
+func TestRateLimitConfig(t *testing.T) {
+	descriptors := []rds.RateLimitDescriptor{
+		{Name: "entrypoint/default#0", RemoteAddress: "*"},
+		{Name: "entrypoint/default#1", PathPrefix: "/login"},
+	}
+
+	vhTests := []struct {
+		name         string
+		virtualHost  bool
+		vhRateLimits ratelimitfilter.RateLimitPerRoute_VhRateLimitsOptions
+	}{
+		{name: "VirtualHost", virtualHost: true, vhRateLimits: ratelimitfilter.RateLimitPerRoute_INCLUDE},
+		{name: "Route", virtualHost: false, vhRateLimits: ratelimitfilter.RateLimitPerRoute_OVERRIDE},
+	}
+	for _, test := range vhTests {
+		t.Run(test.name, func(t *testing.T) {
+			config := &RateLimitConfig{Descriptors: descriptors, VirtualHost: test.virtualHost}
+			var perRoute ratelimitfilter.RateLimitPerRoute
+			err := config.ToFilterConfig().UnmarshalTo(&perRoute)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if perRoute.VhRateLimits != test.vhRateLimits {
+				t.Fatalf("expected vh_rate_limits %v, got %v", test.vhRateLimits, perRoute.VhRateLimits)
+			}
+		})
+	}
+
+	t.Run("RateLimits", func(t *testing.T) {
+		config := &RateLimitConfig{Descriptors: descriptors}
+		rateLimits := config.RateLimits()
+		if len(rateLimits) != len(descriptors) {
+			t.Fatalf("expected %v rate limits, got %v", len(descriptors), len(rateLimits))
+		}
+		for i, rl := range rateLimits {
+			if expected := descriptors[i].ToRateLimit(rateLimitStage); !proto.Equal(rl, expected) {
+				t.Fatalf("expected rate limit %v, got %v", expected, rl)
+			}
+		}
+	})
+}
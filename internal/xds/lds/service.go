@@ -5,27 +5,29 @@ import (
 
 	"github.com/elliotchance/orderedmap/v3"
 	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/versioned"
 )
 
 const ResourceType = types.Listener
 
 // Service define an Envoy LDS (Listener Discovery Service) server service.
+// Resources are versioned by content hash before they are set.
 type Service interface {
-	SetListener(*Listener) bool
+	SetListener(versioned.Resource) bool
 	RemoveListener(name string) bool
-	Resources() []types.Resource
+	Resources() []versioned.Resource
 }
 
 // ProvideService define a wire provider for Envoy LDS server service.
 func ProvideService() Service {
 	return &service{
-		listeners: orderedmap.NewOrderedMap[string, *Listener](),
+		listeners: orderedmap.NewOrderedMap[string, versioned.Resource](),
 	}
 }
 
 type service struct {
 	mu        sync.Mutex
-	listeners *orderedmap.OrderedMap[string, *Listener]
+	listeners *orderedmap.OrderedMap[string, versioned.Resource]
 }
 
 // RemoveListener implements Service.
@@ -37,22 +39,22 @@ func (s *service) RemoveListener(name string) bool {
 }
 
 // Resources implements Service.
-func (s *service) Resources() []types.Resource {
+func (s *service) Resources() []versioned.Resource {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	var resources []types.Resource
+	resources := make([]versioned.Resource, 0, s.listeners.Len())
 	for _, r := range s.listeners.AllFromFront() {
-		resources = append(resources, r.ToResource())
+		resources = append(resources, r)
 	}
 
 	return resources
 }
 
 // SetListener implements Service.
-func (s *service) SetListener(l *Listener) bool {
+func (s *service) SetListener(r versioned.Resource) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	return s.listeners.Set(l.Name, l)
+	return s.listeners.Set(r.Name, r)
 }
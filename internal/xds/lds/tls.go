@@ -0,0 +1,54 @@
+package lds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	listener "github.com/envoyproxy/go-control-plane/envoy/config/listener/v3"
+	tlsinspector "github.com/envoyproxy/go-control-plane/envoy/extensions/filters/listener/tls_inspector/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/negrel/aegis/internal/pbutils"
+	"github.com/negrel/aegis/internal/xds/sds"
+)
+
+// Tls define TLS termination parameters of a filter chain. Certificates
+// contains names of SDS secrets.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/extensions/transport_sockets/tls/v3/tls.proto#envoy-v3-api-msg-extensions-transport-sockets-tls-v3-downstreamtlscontext
+type Tls struct {
+	Certificates []string
+	MinVersion   tlsv3.TlsParameters_TlsProtocol
+	CipherSuites []string
+	// ALPN protocols advertised to clients (e.g. h2, http/1.1).
+	Alpn []string
+}
+
+func (t *Tls) toTransportSocket() *core.TransportSocket {
+	certs := make([]*tlsv3.SdsSecretConfig, len(t.Certificates))
+	for i, name := range t.Certificates {
+		certs[i] = sds.SecretConfig(name)
+	}
+
+	return &core.TransportSocket{
+		Name: "envoy.transport_sockets.tls",
+		ConfigType: &core.TransportSocket_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(&tlsv3.DownstreamTlsContext{
+				CommonTlsContext: &tlsv3.CommonTlsContext{
+					TlsParams: &tlsv3.TlsParameters{
+						TlsMinimumProtocolVersion: t.MinVersion,
+						CipherSuites:              t.CipherSuites,
+					},
+					TlsCertificateSdsSecretConfigs: certs,
+					AlpnProtocols:                  t.Alpn,
+				},
+			}),
+		},
+	}
+}
+
+// tlsInspector returns a listener filter extracting SNI of TLS connections.
+func tlsInspector() *listener.ListenerFilter {
+	return &listener.ListenerFilter{
+		Name: "envoy.filters.listener.tls_inspector",
+		ConfigType: &listener.ListenerFilter_TypedConfig{
+			TypedConfig: pbutils.MustMarshalAny(&tlsinspector.TlsInspector{}),
+		},
+	}
+}
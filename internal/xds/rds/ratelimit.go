@@ -0,0 +1,166 @@
+package rds
+
+import (
+	"net/netip"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// FilterConfig define an HTTP filter configuration overriding listener one
+// for a virtual host or route. ToFilterConfig may return nil if filter has no
+// specific configuration. Rate limit filters also provide descriptors
+// generated for requests.
+type FilterConfig interface {
+	FilterName() string
+	ToFilterConfig() *anypb.Any
+	RateLimits() []*route.RateLimit
+}
+
+// Descriptor keys of rate limit descriptors entries.
+const (
+	NameKey                = "name"
+	RemoteAddressKey       = "remote_address"
+	MaskedRemoteAddressKey = "masked_remote_address"
+	PathKey                = "path"
+)
+
+// RateLimitDescriptor define a rate limit descriptor generated for requests
+// matching all set fields: requests from client IP RemoteAddress, with header
+// Header.Name equal to Header.Value and whose path starts with PathPrefix.
+// RemoteAddress may also be a CIDR prefix (e.g. 203.0.113.0/24) matching
+// client IPs of a network. At least one field must be set. If Name is set,
+// descriptor starts with an entry whose value is Name so rate limit service
+// can tell descriptors with the same entries apart. Entries values are only
+// used by local rate limit.
+// See https://www.envoyproxy.io/docs/envoy/latest/configuration/http/http_filters/rate_limit_filter#composing-actions
+type RateLimitDescriptor struct {
+	Name          string
+	RemoteAddress string
+	Header        *HeaderMatch
+	PathPrefix    string
+}
+
+// HeaderMatch define an HTTP header value.
+type HeaderMatch struct {
+	Name  string
+	Value string
+}
+
+// Entries returns descriptor entries in the order they're generated by
+// descriptor rate limit actions.
+func (rld *RateLimitDescriptor) Entries() []*ratelimit.RateLimitDescriptor_Entry {
+	var entries []*ratelimit.RateLimitDescriptor_Entry
+	if rld.Name != "" {
+		entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: NameKey, Value: rld.Name})
+	}
+	if prefix, ok := rld.remotePrefix(); ok {
+		entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: MaskedRemoteAddressKey, Value: prefix.String()})
+	} else if rld.RemoteAddress != "" {
+		entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: RemoteAddressKey, Value: rld.RemoteAddress})
+	}
+	if rld.Header != nil {
+		entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: rld.Header.Name, Value: rld.Header.Value})
+	}
+	if rld.PathPrefix != "" {
+		entries = append(entries, &ratelimit.RateLimitDescriptor_Entry{Key: PathKey, Value: rld.PathPrefix})
+	}
+
+	return entries
+}
+
+// ToRateLimit returns rate limit actions of filters with the given stage
+// generating descriptor.
+func (rld *RateLimitDescriptor) ToRateLimit(stage uint32) *route.RateLimit {
+	rl := &route.RateLimit{Stage: wrapperspb.UInt32(stage)}
+	if rld.Name != "" {
+		rl.Actions = append(rl.Actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_GenericKey_{
+				GenericKey: &route.RateLimit_Action_GenericKey{
+					DescriptorKey:   NameKey,
+					DescriptorValue: rld.Name,
+				},
+			},
+		})
+	}
+	if prefix, ok := rld.remotePrefix(); ok {
+		masked := &route.RateLimit_Action_MaskedRemoteAddress{}
+		if prefix.Addr().Is4() {
+			masked.V4PrefixMaskLen = wrapperspb.UInt32(uint32(prefix.Bits()))
+		} else {
+			masked.V6PrefixMaskLen = wrapperspb.UInt32(uint32(prefix.Bits()))
+		}
+		rl.Actions = append(rl.Actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_MaskedRemoteAddress_{
+				MaskedRemoteAddress: masked,
+			},
+		})
+	} else if rld.RemoteAddress != "" {
+		rl.Actions = append(rl.Actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{
+				RemoteAddress: &route.RateLimit_Action_RemoteAddress{},
+			},
+		})
+	}
+	if rld.Header != nil {
+		rl.Actions = append(rl.Actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{
+				RequestHeaders: &route.RateLimit_Action_RequestHeaders{
+					HeaderName:    rld.Header.Name,
+					DescriptorKey: rld.Header.Name,
+				},
+			},
+		})
+	}
+	if rld.PathPrefix != "" {
+		rl.Actions = append(rl.Actions, &route.RateLimit_Action{
+			ActionSpecifier: &route.RateLimit_Action_HeaderValueMatch_{
+				HeaderValueMatch: &route.RateLimit_Action_HeaderValueMatch{
+					DescriptorKey:   PathKey,
+					DescriptorValue: rld.PathPrefix,
+					Headers: []*route.HeaderMatcher{{
+						Name: ":path",
+						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+							StringMatch: &matcher.StringMatcher{
+								MatchPattern: &matcher.StringMatcher_Prefix{Prefix: rld.PathPrefix},
+							},
+						},
+					}},
+				},
+			},
+		})
+	}
+
+	return rl
+}
+
+// remotePrefix returns masked prefix of RemoteAddress if it is a CIDR prefix.
+func (rld *RateLimitDescriptor) remotePrefix() (netip.Prefix, bool) {
+	prefix, err := netip.ParsePrefix(rld.RemoteAddress)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	return prefix.Masked(), true
+}
+
+// filterConfigs returns typed per filter configurations and rate limits of
+// the given filter configurations.
+func filterConfigs(configs []FilterConfig) (map[string]*anypb.Any, []*route.RateLimit) {
+	if len(configs) == 0 {
+		return nil, nil
+	}
+
+	typed := make(map[string]*anypb.Any, len(configs))
+	var rateLimits []*route.RateLimit
+	for _, fc := range configs {
+		if config := fc.ToFilterConfig(); config != nil {
+			typed[fc.FilterName()] = config
+		}
+		rateLimits = append(rateLimits, fc.RateLimits()...)
+	}
+
+	return typed, rateLimits
+}
@@ -0,0 +1,106 @@
+package rds
+
+import (
+	"testing"
+
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	ratelimit "github.com/envoyproxy/go-control-plane/envoy/extensions/common/ratelimit/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestRateLimitDescriptor(t *testing.T) {
+	tests := []struct {
+		name       string
+		descriptor RateLimitDescriptor
+		entries    []*ratelimit.RateLimitDescriptor_Entry
+		actions    []*route.RateLimit_Action
+	}{
+		{
+			name:       "RemoteAddress",
+			descriptor: RateLimitDescriptor{RemoteAddress: "203.0.113.7"},
+			entries:    []*ratelimit.RateLimitDescriptor_Entry{{Key: RemoteAddressKey, Value: "203.0.113.7"}},
+			actions: []*route.RateLimit_Action{{
+				ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{RemoteAddress: &route.RateLimit_Action_RemoteAddress{}},
+			}},
+		},
+		{
+			name:       "RemoteAddressPrefix",
+			descriptor: RateLimitDescriptor{RemoteAddress: "203.0.113.7/24"},
+			entries:    []*ratelimit.RateLimitDescriptor_Entry{{Key: MaskedRemoteAddressKey, Value: "203.0.113.0/24"}},
+			actions: []*route.RateLimit_Action{{
+				ActionSpecifier: &route.RateLimit_Action_MaskedRemoteAddress_{MaskedRemoteAddress: &route.RateLimit_Action_MaskedRemoteAddress{
+					V4PrefixMaskLen: wrapperspb.UInt32(24),
+				}},
+			}},
+		},
+		{
+			name:       "RemoteAddressV6Prefix",
+			descriptor: RateLimitDescriptor{RemoteAddress: "2001:db8::/32"},
+			entries:    []*ratelimit.RateLimitDescriptor_Entry{{Key: MaskedRemoteAddressKey, Value: "2001:db8::/32"}},
+			actions: []*route.RateLimit_Action{{
+				ActionSpecifier: &route.RateLimit_Action_MaskedRemoteAddress_{MaskedRemoteAddress: &route.RateLimit_Action_MaskedRemoteAddress{
+					V6PrefixMaskLen: wrapperspb.UInt32(32),
+				}},
+			}},
+		},
+		{
+			name: "AllFields",
+			descriptor: RateLimitDescriptor{
+				Name:          "entrypoint/default#0",
+				RemoteAddress: "*",
+				Header:        &HeaderMatch{Name: "x-api-key", Value: "free-tier"},
+				PathPrefix:    "/search",
+			},
+			entries: []*ratelimit.RateLimitDescriptor_Entry{
+				{Key: NameKey, Value: "entrypoint/default#0"},
+				{Key: RemoteAddressKey, Value: "*"},
+				{Key: "x-api-key", Value: "free-tier"},
+				{Key: PathKey, Value: "/search"},
+			},
+			actions: []*route.RateLimit_Action{
+				{ActionSpecifier: &route.RateLimit_Action_GenericKey_{GenericKey: &route.RateLimit_Action_GenericKey{
+					DescriptorKey:   NameKey,
+					DescriptorValue: "entrypoint/default#0",
+				}}},
+				{ActionSpecifier: &route.RateLimit_Action_RemoteAddress_{RemoteAddress: &route.RateLimit_Action_RemoteAddress{}}},
+				{ActionSpecifier: &route.RateLimit_Action_RequestHeaders_{RequestHeaders: &route.RateLimit_Action_RequestHeaders{
+					HeaderName:    "x-api-key",
+					DescriptorKey: "x-api-key",
+				}}},
+				{ActionSpecifier: &route.RateLimit_Action_HeaderValueMatch_{HeaderValueMatch: &route.RateLimit_Action_HeaderValueMatch{
+					DescriptorKey:   PathKey,
+					DescriptorValue: "/search",
+					Headers: []*route.HeaderMatcher{{
+						Name: ":path",
+						HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+							StringMatch: &matcher.StringMatcher{
+								MatchPattern: &matcher.StringMatcher_Prefix{Prefix: "/search"},
+							},
+						},
+					}},
+				}}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries := test.descriptor.Entries()
+			if len(entries) != len(test.entries) {
+				t.Fatalf("expected %v entries, got %v", len(test.entries), len(entries))
+			}
+			for i := range entries {
+				if !proto.Equal(entries[i], test.entries[i]) {
+					t.Fatalf("expected entry %v, got %v", test.entries[i], entries[i])
+				}
+			}
+
+			expected := &route.RateLimit{Stage: wrapperspb.UInt32(1), Actions: test.actions}
+			if rl := test.descriptor.ToRateLimit(1); !proto.Equal(rl, expected) {
+				t.Fatalf("expected rate limit %v, got %v", expected, rl)
+			}
+		})
+	}
+}
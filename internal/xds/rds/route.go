@@ -0,0 +1,147 @@
+package rds
+
+import (
+	"slices"
+
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	route "github.com/envoyproxy/go-control-plane/envoy/config/route/v3"
+	matcher "github.com/envoyproxy/go-control-plane/envoy/type/matcher/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/versioned"
+)
+
+// RouteConfig define HTTP route configurations.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/route/v3/route.proto#envoy-v3-api-msg-config-route-v3-routeconfiguration
+type RouteConfig struct {
+	Name         string
+	VirtualHosts []VirtualHost
+}
+
+func (rc *RouteConfig) ToResource() types.Resource {
+	vhosts := make([]*route.VirtualHost, len(rc.VirtualHosts))
+	for i, f := range rc.VirtualHosts {
+		vhosts[i] = f.toVirtualHost()
+	}
+
+	return &route.RouteConfiguration{
+		Name:         rc.Name,
+		VirtualHosts: vhosts,
+	}
+}
+
+// VirtualHost define virtual HTTP host. PriorityRoutes are matched before
+// Routes. If HttpsRedirect is true, plain HTTP requests not matching any of
+// PriorityRoutes are redirected to HTTPS. FilterConfigs override listener HTTP
+// filters configuration for routes of virtual host.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/route/v3/route_components.proto#envoy-v3-api-msg-config-route-v3-virtualhost
+type VirtualHost struct {
+	Name           string
+	Domains        []string
+	Routes         []Route
+	PriorityRoutes []Route
+	HttpsRedirect  bool
+	FilterConfigs  []FilterConfig
+}
+
+// References returns names of clusters referenced by routes.
+func (rc *RouteConfig) References() versioned.References {
+	refs := make(versioned.References)
+	for _, vh := range rc.VirtualHosts {
+		for _, r := range slices.Concat(vh.PriorityRoutes, vh.Routes) {
+			if r.Cluster != nil {
+				refs[cds.ResourceType] = append(refs[cds.ResourceType], r.Cluster.Name)
+			}
+		}
+	}
+
+	return refs
+}
+
+func (vh VirtualHost) toVirtualHost() *route.VirtualHost {
+	var routes []*route.Route
+	for _, r := range vh.PriorityRoutes {
+		routes = append(routes, r.toRoute())
+	}
+	if vh.HttpsRedirect {
+		routes = append(routes, httpsRedirectRoute())
+	}
+	for _, r := range vh.Routes {
+		routes = append(routes, r.toRoute())
+	}
+
+	typedConfigs, rateLimits := filterConfigs(vh.FilterConfigs)
+
+	return &route.VirtualHost{
+		Name:                 vh.Name,
+		Domains:              vh.Domains,
+		Routes:               routes,
+		RequireTls:           route.VirtualHost_NONE,
+		TypedPerFilterConfig: typedConfigs,
+		RateLimits:           rateLimits,
+	}
+}
+
+// httpsRedirectRoute returns a route redirecting plain HTTP requests to HTTPS.
+// Requests are matched on x-forwarded-proto header, which edge HTTP connection
+// managers overwrite with the scheme of downstream connection, like Envoy
+// RequireTls does. Matching on TLS context would only check client
+// certificates.
+func httpsRedirectRoute() *route.Route {
+	return &route.Route{
+		Name: "https-redirect",
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: "/"},
+			Headers: []*route.HeaderMatcher{{
+				Name: "x-forwarded-proto",
+				HeaderMatchSpecifier: &route.HeaderMatcher_StringMatch{
+					StringMatch: &matcher.StringMatcher{
+						MatchPattern: &matcher.StringMatcher_Exact{Exact: "http"},
+					},
+				},
+			}},
+		},
+		Action: &route.Route_Redirect{
+			Redirect: &route.RedirectAction{
+				SchemeRewriteSpecifier: &route.RedirectAction_HttpsRedirect{HttpsRedirect: true},
+			},
+		},
+	}
+}
+
+// Route define an HTTP route forwarding requests whose path starts with Prefix
+// to Cluster. Routes are matched in order, first match wins. Priority selects
+// circuit breakers thresholds of Cluster used for requests. FilterConfigs
+// override listener and virtual host HTTP filters configuration.
+// See https://www.envoyproxy.io/docs/envoy/latest/api-v3/config/route/v3/route_components.proto#envoy-v3-api-msg-config-route-v3-route
+type Route struct {
+	Name          string
+	Prefix        string
+	Cluster       *cds.Cluster
+	Priority      core.RoutingPriority
+	FilterConfigs []FilterConfig
+}
+
+func (r Route) toRoute() *route.Route {
+	prefix := r.Prefix
+	if prefix == "" {
+		prefix = "/"
+	}
+
+	typedConfigs, rateLimits := filterConfigs(r.FilterConfigs)
+
+	return &route.Route{
+		Name: r.Name,
+		Match: &route.RouteMatch{
+			PathSpecifier: &route.RouteMatch_Prefix{Prefix: prefix},
+		},
+		Action: &route.Route_Route{
+			Route: &route.RouteAction{
+				ClusterSpecifier: &route.RouteAction_Cluster{Cluster: r.Cluster.Name},
+				Priority:         r.Priority,
+				RateLimits:       rateLimits,
+			},
+		},
+		TypedPerFilterConfig: typedConfigs,
+	}
+}
@@ -0,0 +1,60 @@
+package rds
+
+import (
+	"sync"
+
+	"github.com/elliotchance/orderedmap/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/versioned"
+)
+
+const ResourceType = types.Route
+
+// Service define an Envoy RDS (Route Discovery Service) server service.
+// Resources are versioned by content hash before they are set.
+type Service interface {
+	SetRouteConfig(versioned.Resource) bool
+	RemoveRouteConfig(name string) bool
+	Resources() []versioned.Resource
+}
+
+// ProvideService define a wire provider for Envoy RDS server service.
+func ProvideService() Service {
+	return &service{
+		routeConfigs: orderedmap.NewOrderedMap[string, versioned.Resource](),
+	}
+}
+
+type service struct {
+	mu           sync.Mutex
+	routeConfigs *orderedmap.OrderedMap[string, versioned.Resource]
+}
+
+// SetRouteConfig implements Service.
+func (s *service) SetRouteConfig(r versioned.Resource) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.routeConfigs.Set(r.Name, r)
+}
+
+// RemoveRouteConfig implements Service.
+func (s *service) RemoveRouteConfig(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.routeConfigs.Delete(name)
+}
+
+// Resources implements Service.
+func (s *service) Resources() []versioned.Resource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resources := make([]versioned.Resource, 0, s.routeConfigs.Len())
+	for _, r := range s.routeConfigs.AllFromFront() {
+		resources = append(resources, r)
+	}
+
+	return resources
+}
@@ -0,0 +1,70 @@
+package sds
+
+import (
+	core "github.com/envoyproxy/go-control-plane/envoy/config/core/v3"
+	tlsv3 "github.com/envoyproxy/go-control-plane/envoy/extensions/transport_sockets/tls/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+)
+
+// Secret define a named TLS secret delivered to Envoy over ADS. Exactly one of
+// TlsCertificate and ValidationContext must be set. Secret contents are sent
+// inline so updating a secret rotates it without modifying listeners and
+// clusters referencing it.
+// See https://www.envoyproxy.io/docs/envoy/latest/configuration/security/secret
+type Secret struct {
+	Name              string
+	TlsCertificate    *TlsCertificate
+	ValidationContext *ValidationContext
+}
+
+// TlsCertificate define a PEM encoded certificate chain and its private key.
+type TlsCertificate struct {
+	CertificateChain []byte
+	PrivateKey       []byte
+}
+
+// ValidationContext define PEM encoded CA certificates used to verify peer
+// certificates.
+type ValidationContext struct {
+	TrustedCa []byte
+}
+
+func (s *Secret) ToResource() types.Resource {
+	resource := &tlsv3.Secret{Name: s.Name}
+
+	switch {
+	case s.TlsCertificate != nil:
+		resource.Type = &tlsv3.Secret_TlsCertificate{
+			TlsCertificate: &tlsv3.TlsCertificate{
+				CertificateChain: inlineBytes(s.TlsCertificate.CertificateChain),
+				PrivateKey:       inlineBytes(s.TlsCertificate.PrivateKey),
+			},
+		}
+	case s.ValidationContext != nil:
+		resource.Type = &tlsv3.Secret_ValidationContext{
+			ValidationContext: &tlsv3.CertificateValidationContext{
+				TrustedCa: inlineBytes(s.ValidationContext.TrustedCa),
+			},
+		}
+	}
+
+	return resource
+}
+
+// SecretConfig returns a reference to the secret with the given name fetched
+// over ADS.
+func SecretConfig(name string) *tlsv3.SdsSecretConfig {
+	return &tlsv3.SdsSecretConfig{
+		Name: name,
+		SdsConfig: &core.ConfigSource{
+			ResourceApiVersion:    core.ApiVersion_V3,
+			ConfigSourceSpecifier: &core.ConfigSource_Ads{Ads: &core.AggregatedConfigSource{}},
+		},
+	}
+}
+
+func inlineBytes(b []byte) *core.DataSource {
+	return &core.DataSource{
+		Specifier: &core.DataSource_InlineBytes{InlineBytes: b},
+	}
+}
@@ -0,0 +1,60 @@
+package sds
+
+import (
+	"sync"
+
+	"github.com/elliotchance/orderedmap/v3"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/versioned"
+)
+
+const ResourceType = types.Secret
+
+// Service define an Envoy SDS (Secret Discovery Service) server service.
+// Resources are versioned by content hash before they are set.
+type Service interface {
+	SetSecret(versioned.Resource) bool
+	RemoveSecret(name string) bool
+	Resources() []versioned.Resource
+}
+
+// ProvideService define a wire provider for Envoy SDS server service.
+func ProvideService() Service {
+	return &service{
+		secrets: orderedmap.NewOrderedMap[string, versioned.Resource](),
+	}
+}
+
+type service struct {
+	mu      sync.Mutex
+	secrets *orderedmap.OrderedMap[string, versioned.Resource]
+}
+
+// SetSecret implements Service.
+func (s *service) SetSecret(r versioned.Resource) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.secrets.Set(r.Name, r)
+}
+
+// RemoveSecret implements Service.
+func (s *service) RemoveSecret(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.secrets.Delete(name)
+}
+
+// Resources implements Service.
+func (s *service) Resources() []versioned.Resource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	resources := make([]versioned.Resource, 0, s.secrets.Len())
+	for _, r := range s.secrets.AllFromFront() {
+		resources = append(resources, r)
+	}
+
+	return resources
+}
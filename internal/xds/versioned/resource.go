@@ -0,0 +1,54 @@
+// Package versioned provides xDS resources versioned by a hash of their
+// content. Unchanged resources keep the same version across snapshots so
+// Envoy isn't sent resources it already has.
+package versioned
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/envoyproxy/go-control-plane/pkg/cache/v3"
+)
+
+// Resource define an xDS resource, its version and the resources it
+// references.
+type Resource struct {
+	Name       string
+	Resource   types.Resource
+	Version    string
+	References References
+}
+
+// References contains names of referenced resources indexed by type.
+type References map[types.ResponseType][]string
+
+// New returns a versioned resource. Version is the same hash go-control-plane
+// uses for delta xDS.
+func New(r types.Resource, refs References) (Resource, error) {
+	data, err := cache.MarshalResource(r)
+	if err != nil {
+		return Resource{}, err
+	}
+
+	return Resource{
+		Name:       cache.GetResourceName(r),
+		Resource:   r,
+		Version:    cache.HashResource(data),
+		References: refs,
+	}, nil
+}
+
+// Version returns a version of a set of resources. It only changes if a
+// resource is added, removed or modified.
+func Version(resources []Resource) string {
+	hasher := sha256.New()
+	for _, r := range resources {
+		hasher.Write([]byte(r.Name))
+		hasher.Write([]byte{0})
+		hasher.Write([]byte(r.Version))
+		hasher.Write([]byte{0})
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil))
+}
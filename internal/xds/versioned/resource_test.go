@@ -0,0 +1,75 @@
+package versioned_test
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/pkg/cache/types"
+	"github.com/negrel/aegis/internal/xds/cds"
+	"github.com/negrel/aegis/internal/xds/lds"
+	"github.com/negrel/aegis/internal/xds/rds"
+	"github.com/negrel/aegis/internal/xds/versioned"
+	"github.com/negrel/aegis/internal/xnet"
+)
+
+func TestNewVersionIsStable(t *testing.T) {
+	cluster := &cds.Cluster{
+		Name:           "api",
+		ConnectTimeout: time.Second,
+		Tls:            &cds.Tls{Sni: "api.example.com", ValidationContext: "api-ca"},
+		CircuitBreakers: &cds.CircuitBreakers{
+			Default: cds.Thresholds{MaxConnections: 256, MaxRequests: 256, RetryBudget: &cds.RetryBudget{BudgetPercent: 20}},
+		},
+	}
+	rateLimit := &lds.RateLimitConfig{
+		Descriptors: []rds.RateLimitDescriptor{{RemoteAddress: "198.51.100.0/24"}},
+		VirtualHost: true,
+	}
+	routeConfig := &rds.RouteConfig{
+		Name: "entrypoint",
+		VirtualHosts: []rds.VirtualHost{{
+			Name:          "default",
+			Domains:       []string{"*"},
+			Routes:        []rds.Route{{Prefix: "/", Cluster: cluster}},
+			FilterConfigs: []rds.FilterConfig{rateLimit},
+		}},
+	}
+	listener := &lds.Listener{
+		Name:    "entrypoint",
+		Address: xnet.IPSocketAddr{Host: netip.MustParseAddr("0.0.0.0"), Port: 8080},
+		FilterChains: []lds.FilterChain{{
+			Filters: []lds.Filter{lds.HttpProxyFilter{
+				HttpFilters:     []lds.HttpFilter{lds.RateLimit{}, lds.HttpRouter{}},
+				RouteConfigName: routeConfig.Name,
+			}},
+		}},
+	}
+
+	tests := []struct {
+		name     string
+		resource func() types.Resource
+	}{
+		{name: "Listener", resource: listener.ToResource},
+		{name: "RouteConfig", resource: routeConfig.ToResource},
+		{name: "Cluster", resource: cluster.ToResource},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			expected, err := versioned.New(test.resource(), nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for range 10 {
+				r, err := versioned.New(test.resource(), nil)
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if r.Version != expected.Version {
+					t.Fatalf("expected version %v, got %v", expected.Version, r.Version)
+				}
+			}
+		})
+	}
+}
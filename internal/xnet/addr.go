@@ -3,8 +3,11 @@ package xnet
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/netip"
+	"strconv"
+	"strings"
 )
 
 // Addr define a socket address (TCP/UDP).
@@ -49,3 +52,45 @@ func HostSocketAddr(ctx context.Context, host string, port uint16) (SocketAddr,
 
 	return hostSocketAddr{host, port}, nil
 }
+
+// ParseSocketAddr parses a HOST:PORT address. Host is either an IP address or
+// a host name, it isn't resolved.
+func ParseSocketAddr(s string) (SocketAddr, error) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return IPSocketAddr{Host: addrPort.Addr(), Port: addrPort.Port()}, nil
+	}
+
+	host, portStr, err := net.SplitHostPort(s)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port %q", portStr)
+	}
+	if host == "" {
+		return nil, fmt.Errorf("missing host in address %q", s)
+	}
+
+	return hostSocketAddr{host, uint16(port)}, nil
+}
+
+// IsHostname reports whether s is a valid DNS host name: dot separated labels
+// of letters, digits and hyphens that don't start or end with a hyphen.
+func IsHostname(s string) bool {
+	if s == "" || len(s) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(s, "."), ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range []byte(label) {
+			if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+
+	return true
+}